@@ -20,13 +20,20 @@ func main() {
     allowWrite := false
     allowDirectoryListing := false
     port := 12345
+    verbose := false
     flag.StringVar(&directory, "dir", ".", "Directory to serve")
     flag.StringVar(&urlPathPrefix, "path", "/", "URL Path Prefix")
     flag.BoolVar(&allowWrite, "write", false, "Allow and process PUT, POST, DELETE without any authorization")
     flag.BoolVar(&allowDirectoryListing, "listing", false, "Allow Directory Listing on GET and HEAD")
     flag.IntVar(&port, "port", 12345, "Port to serve files")
+    flag.BoolVar(&verbose, "verbose", false, "Log every request and decision")
     flag.Parse()
     wm := webmachine.NewWebMachine()
+    if verbose {
+        wm.SetLogger(webmachine.NewStandardLogger(nil, webmachine.LOG_LEVEL_DEBUG))
+    } else {
+        wm.SetLogger(webmachine.NewStandardLogger(nil, webmachine.LOG_LEVEL_WARN))
+    }
     wm.AddRouteHandler(webmachine.NewFileResource(directory, urlPathPrefix, allowWrite, allowDirectoryListing))
     err := http.ListenAndServe(":"+strconv.Itoa(port), wm)
     if err != nil {
@@ -0,0 +1,348 @@
+package webmachine
+
+import (
+    "bytes"
+    "io"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// ResourceBuilder assembles a resource from closures so that only the
+// callbacks that matter need to be written, e.g.
+//
+//     wm.AddRouteHandler(NewResourceBuilder().
+//         Path("/hello").
+//         AllowedMethods(GET, HEAD).
+//         Provides("application/json", func(req Request, cxt Context, w io.Writer) error {
+//             _, err := io.WriteString(w, `{"hello":"world"}`)
+//             return err
+//         }).
+//         Build())
+//
+// Any non-nil error returned by a closure is sent as a 500, unless it is a
+// Halt.
+type ResourceBuilder struct {
+    resource BuiltResource
+}
+
+// BuiltResource is the RouteHandler and RequestHandler produced by
+// ResourceBuilder.Build.  Callbacks that were not set fall back to
+// DefaultRequestHandler.
+type BuiltResource struct {
+    DefaultRequestHandler
+    path                 string
+    allowedMethods       []string
+    startRequest         func(req Request) Context
+    serviceAvailable     func(req Request, cxt Context) (bool, error)
+    isAuthorized         func(req Request, cxt Context) (bool, string, error)
+    forbidden            func(req Request, cxt Context) (bool, error)
+    malformedRequest     func(req Request, cxt Context) (bool, error)
+    resourceExists       func(req Request, cxt Context) (bool, error)
+    etag                 func(req Request, cxt Context) (string, error)
+    lastModified         func(req Request, cxt Context) (time.Time, error)
+    expires              func(req Request, cxt Context) (time.Time, error)
+    deleteResource       func(req Request, cxt Context) (bool, error)
+    createPath           func(req Request, cxt Context) (string, error)
+    processPost          func(req Request, cxt Context) error
+    contentTypesProvided []MediaTypeHandler
+    contentTypesAccepted []MediaTypeInputHandler
+}
+
+func NewResourceBuilder() *ResourceBuilder {
+    return new(ResourceBuilder)
+}
+
+// Path restricts the resource to requests for path, or to everything below
+// path if it ends in "/".  Without a Path the resource matches every request.
+func (p *ResourceBuilder) Path(path string) *ResourceBuilder {
+    p.resource.path = path
+    return p
+}
+
+func (p *ResourceBuilder) AllowedMethods(methods ...string) *ResourceBuilder {
+    p.resource.allowedMethods = methods
+    return p
+}
+
+// StartRequest creates the Context handed to every other callback.
+func (p *ResourceBuilder) StartRequest(fn func(req Request) Context) *ResourceBuilder {
+    p.resource.startRequest = fn
+    return p
+}
+
+func (p *ResourceBuilder) ServiceAvailable(fn func(req Request, cxt Context) (bool, error)) *ResourceBuilder {
+    p.resource.serviceAvailable = fn
+    return p
+}
+
+// IsAuthorized returns whether the request is authorized and, if not, the
+// WWW-Authenticate challenge to send.
+func (p *ResourceBuilder) IsAuthorized(fn func(req Request, cxt Context) (bool, string, error)) *ResourceBuilder {
+    p.resource.isAuthorized = fn
+    return p
+}
+
+func (p *ResourceBuilder) Forbidden(fn func(req Request, cxt Context) (bool, error)) *ResourceBuilder {
+    p.resource.forbidden = fn
+    return p
+}
+
+func (p *ResourceBuilder) MalformedRequest(fn func(req Request, cxt Context) (bool, error)) *ResourceBuilder {
+    p.resource.malformedRequest = fn
+    return p
+}
+
+func (p *ResourceBuilder) ResourceExists(fn func(req Request, cxt Context) (bool, error)) *ResourceBuilder {
+    p.resource.resourceExists = fn
+    return p
+}
+
+func (p *ResourceBuilder) ETag(fn func(req Request, cxt Context) (string, error)) *ResourceBuilder {
+    p.resource.etag = fn
+    return p
+}
+
+func (p *ResourceBuilder) LastModified(fn func(req Request, cxt Context) (time.Time, error)) *ResourceBuilder {
+    p.resource.lastModified = fn
+    return p
+}
+
+func (p *ResourceBuilder) Expires(fn func(req Request, cxt Context) (time.Time, error)) *ResourceBuilder {
+    p.resource.expires = fn
+    return p
+}
+
+func (p *ResourceBuilder) DeleteResource(fn func(req Request, cxt Context) (bool, error)) *ResourceBuilder {
+    p.resource.deleteResource = fn
+    return p
+}
+
+// CreatePath makes POST create a new resource at the returned path, whose
+// body is then handled by the matching Accepts closure.
+func (p *ResourceBuilder) CreatePath(fn func(req Request, cxt Context) (string, error)) *ResourceBuilder {
+    p.resource.createPath = fn
+    return p
+}
+
+// ProcessPost handles POST requests when CreatePath is not set.
+func (p *ResourceBuilder) ProcessPost(fn func(req Request, cxt Context) error) *ResourceBuilder {
+    p.resource.processPost = fn
+    return p
+}
+
+// Provides adds a representation of the resource.  The closure writes the
+// body; the status and Content-Type are taken care of.
+func (p *ResourceBuilder) Provides(mediaType string, fn func(req Request, cxt Context, w io.Writer) error) *ResourceBuilder {
+    p.resource.contentTypesProvided = append(p.resource.contentTypesProvided, &funcMediaTypeHandler{mediaType: mediaType, fn: fn})
+    return p
+}
+
+// Accepts adds a media type that PUT and POST bodies may be sent as.  The
+// closure reads the body from req.
+func (p *ResourceBuilder) Accepts(mediaType string, fn func(req Request, cxt Context) error) *ResourceBuilder {
+    p.resource.contentTypesAccepted = append(p.resource.contentTypesAccepted, &funcMediaTypeInputHandler{mediaType: mediaType, fn: fn})
+    return p
+}
+
+// Build returns the resource.  The builder may be changed and built again
+// without affecting resources already built.
+func (p *ResourceBuilder) Build() *BuiltResource {
+    r := p.resource
+    r.allowedMethods = append([]string(nil), p.resource.allowedMethods...)
+    r.contentTypesProvided = append([]MediaTypeHandler(nil), p.resource.contentTypesProvided...)
+    r.contentTypesAccepted = append([]MediaTypeInputHandler(nil), p.resource.contentTypesAccepted...)
+    return &r
+}
+
+// builderErrorCode maps an error returned by a builder closure to the status
+// code to halt with, or 0 to carry on.
+func builderErrorCode(err error) int {
+    if err == nil {
+        return 0
+    }
+    if halt, ok := asHalt(err); ok && halt.StatusCode > 0 {
+        return halt.StatusCode
+    }
+    return http.StatusInternalServerError
+}
+
+func (p *BuiltResource) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    if len(p.path) == 0 {
+        return p
+    }
+    path := req.URL().Path
+    if path == p.path || (strings.HasSuffix(p.path, "/") && strings.HasPrefix(path, p.path)) {
+        return p
+    }
+    return nil
+}
+
+func (p *BuiltResource) StartRequest(req Request, cxt Context) (Request, Context) {
+    if p.startRequest != nil {
+        return req, p.startRequest(req)
+    }
+    return req, cxt
+}
+
+func (p *BuiltResource) AllowedMethods(req Request, cxt Context) ([]string, Request, Context, int, error) {
+    if len(p.allowedMethods) > 0 {
+        return p.allowedMethods, req, cxt, 0, nil
+    }
+    return p.DefaultRequestHandler.AllowedMethods(req, cxt)
+}
+
+func (p *BuiltResource) ServiceAvailable(req Request, cxt Context) (bool, Request, Context, int, error) {
+    if p.serviceAvailable != nil {
+        available, err := p.serviceAvailable(req, cxt)
+        return available, req, cxt, builderErrorCode(err), err
+    }
+    return p.DefaultRequestHandler.ServiceAvailable(req, cxt)
+}
+
+func (p *BuiltResource) IsAuthorized(req Request, cxt Context) (bool, string, Request, Context, int, error) {
+    if p.isAuthorized != nil {
+        authorized, challenge, err := p.isAuthorized(req, cxt)
+        return authorized, challenge, req, cxt, builderErrorCode(err), err
+    }
+    return p.DefaultRequestHandler.IsAuthorized(req, cxt)
+}
+
+func (p *BuiltResource) Forbidden(req Request, cxt Context) (bool, Request, Context, int, error) {
+    if p.forbidden != nil {
+        forbidden, err := p.forbidden(req, cxt)
+        return forbidden, req, cxt, builderErrorCode(err), err
+    }
+    return p.DefaultRequestHandler.Forbidden(req, cxt)
+}
+
+func (p *BuiltResource) MalformedRequest(req Request, cxt Context) (bool, Request, Context, int, error) {
+    if p.malformedRequest != nil {
+        malformed, err := p.malformedRequest(req, cxt)
+        return malformed, req, cxt, builderErrorCode(err), err
+    }
+    return p.DefaultRequestHandler.MalformedRequest(req, cxt)
+}
+
+func (p *BuiltResource) ResourceExists(req Request, cxt Context) (bool, Request, Context, int, error) {
+    if p.resourceExists != nil {
+        exists, err := p.resourceExists(req, cxt)
+        return exists, req, cxt, builderErrorCode(err), err
+    }
+    return p.DefaultRequestHandler.ResourceExists(req, cxt)
+}
+
+func (p *BuiltResource) GenerateETag(req Request, cxt Context) (string, Request, Context, int, error) {
+    if p.etag != nil {
+        etag, err := p.etag(req, cxt)
+        return etag, req, cxt, builderErrorCode(err), err
+    }
+    return p.DefaultRequestHandler.GenerateETag(req, cxt)
+}
+
+func (p *BuiltResource) LastModified(req Request, cxt Context) (time.Time, Request, Context, int, error) {
+    if p.lastModified != nil {
+        lastModified, err := p.lastModified(req, cxt)
+        return lastModified, req, cxt, builderErrorCode(err), err
+    }
+    return p.DefaultRequestHandler.LastModified(req, cxt)
+}
+
+func (p *BuiltResource) Expires(req Request, cxt Context) (time.Time, Request, Context, int, error) {
+    if p.expires != nil {
+        expires, err := p.expires(req, cxt)
+        return expires, req, cxt, builderErrorCode(err), err
+    }
+    return p.DefaultRequestHandler.Expires(req, cxt)
+}
+
+func (p *BuiltResource) DeleteResource(req Request, cxt Context) (bool, Request, Context, int, error) {
+    if p.deleteResource != nil {
+        deleted, err := p.deleteResource(req, cxt)
+        return deleted, req, cxt, builderErrorCode(err), err
+    }
+    return p.DefaultRequestHandler.DeleteResource(req, cxt)
+}
+
+func (p *BuiltResource) PostIsCreate(req Request, cxt Context) (bool, Request, Context, int, error) {
+    return p.createPath != nil, req, cxt, 0, nil
+}
+
+func (p *BuiltResource) CreatePath(req Request, cxt Context) (string, Request, Context, int, error) {
+    if p.createPath != nil {
+        path, err := p.createPath(req, cxt)
+        return path, req, cxt, builderErrorCode(err), err
+    }
+    return p.DefaultRequestHandler.CreatePath(req, cxt)
+}
+
+func (p *BuiltResource) ProcessPost(req Request, cxt Context) (Request, Context, int, http.Header, io.WriterTo, error) {
+    if p.processPost != nil {
+        err := p.processPost(req, cxt)
+        return req, cxt, builderErrorCode(err), nil, nil, err
+    }
+    return p.DefaultRequestHandler.ProcessPost(req, cxt)
+}
+
+func (p *BuiltResource) ContentTypesProvided(req Request, cxt Context) ([]MediaTypeHandler, Request, Context, int, error) {
+    if len(p.contentTypesProvided) > 0 {
+        return p.contentTypesProvided, req, cxt, 0, nil
+    }
+    return p.DefaultRequestHandler.ContentTypesProvided(req, cxt)
+}
+
+func (p *BuiltResource) ContentTypesAccepted(req Request, cxt Context) ([]MediaTypeInputHandler, Request, Context, int, error) {
+    return p.contentTypesAccepted, req, cxt, 0, nil
+}
+
+type funcMediaTypeHandler struct {
+    mediaType string
+    fn        func(req Request, cxt Context, w io.Writer) error
+}
+
+func (p *funcMediaTypeHandler) MediaTypeOutput() string {
+    return p.mediaType
+}
+
+// MediaTypeHandleOutputTo writes the body.  The decision core uses
+// mediaTypeOutputBody instead, so that an error returned by the closure can
+// still be rendered before anything is written.
+func (p *funcMediaTypeHandler) MediaTypeHandleOutputTo(req Request, cxt Context, writer io.Writer, resp ResponseWriter) {
+    if body, err := p.mediaTypeOutputBody(req, cxt); err == nil {
+        writer.Write(body)
+    }
+}
+
+func (p *funcMediaTypeHandler) mediaTypeOutputBody(req Request, cxt Context) ([]byte, error) {
+    buf := bytes.NewBuffer(nil)
+    if err := p.fn(req, cxt, buf); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+type funcMediaTypeInputHandler struct {
+    mediaType string
+    fn        func(req Request, cxt Context) error
+}
+
+func (p *funcMediaTypeInputHandler) MediaTypeInput() string {
+    return p.mediaType
+}
+
+// MediaTypeHandleInputFrom returns the status for an error, and the header
+// and body of a Halt.  The decision core uses mediaTypeInputFrom instead, so
+// that the error goes through the WebMachine's ErrorRenderer.
+func (p *funcMediaTypeInputHandler) MediaTypeHandleInputFrom(req Request, cxt Context) (int, http.Header, io.WriterTo) {
+    err := p.mediaTypeInputFrom(req, cxt)
+    if halt, ok := asHalt(err); ok && halt.Body != nil {
+        return builderErrorCode(err), halt.Header, bytes.NewBuffer(halt.Body)
+    } else if ok {
+        return builderErrorCode(err), halt.Header, nil
+    }
+    return builderErrorCode(err), nil, nil
+}
+
+func (p *funcMediaTypeInputHandler) mediaTypeInputFrom(req Request, cxt Context) error {
+    return p.fn(req, cxt)
+}
@@ -0,0 +1,187 @@
+package webmachine
+
+import (
+    "errors"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+type recordingErrorRenderer struct {
+    statusCode int
+    err        error
+}
+
+func (p *recordingErrorRenderer) RenderError(req Request, resp ResponseWriter, statusCode int, err error) {
+    p.statusCode, p.err = statusCode, err
+    resp.WriteHeader(statusCode)
+    io.WriteString(resp, "rendered")
+}
+
+func TestBuilderProvidesError(t *testing.T) {
+    failure := errors.New("failed")
+    tests := []struct {
+        err    error
+        status int
+    }{
+        {failure, http.StatusInternalServerError},
+        {&Halt{StatusCode: http.StatusConflict, Err: failure}, http.StatusConflict},
+    }
+    for _, tt := range tests {
+        renderer := new(recordingErrorRenderer)
+        wm := NewWebMachine()
+        wm.SetErrorRenderer(renderer)
+        wm.AddRouteHandler(NewResourceBuilder().
+            ETag(func(req Request, cxt Context) (string, error) { return "1", nil }).
+            Provides(MIME_TYPE_TEXT_PLAIN, func(req Request, cxt Context, w io.Writer) error {
+                io.WriteString(w, "partial")
+                return tt.err
+            }).
+            Build())
+        rec := httptest.NewRecorder()
+        wm.ServeHTTP(rec, httptest.NewRequest(GET, "/", nil))
+        if rec.Code != tt.status || renderer.statusCode != tt.status || renderer.err != tt.err || rec.Body.String() != "rendered" {
+            t.Errorf("%v: status %d, rendered %d %v, body %q", tt.err, rec.Code, renderer.statusCode, renderer.err, rec.Body.String())
+        }
+        if len(rec.Header().Get("ETag")) > 0 {
+            t.Errorf("%v: ETag %q sent with the error", tt.err, rec.Header().Get("ETag"))
+        }
+    }
+}
+
+func TestNegotiatingErrorRendererVary(t *testing.T) {
+    wm := NewWebMachine()
+    wm.AddRouteHandler(NewResourceBuilder().
+        Provides(MIME_TYPE_TEXT_PLAIN, func(req Request, cxt Context, w io.Writer) error { return errors.New("failed") }).
+        Provides(MIME_TYPE_JSON, func(req Request, cxt Context, w io.Writer) error { return errors.New("failed") }).
+        Build())
+    req := httptest.NewRequest(GET, "/", nil)
+    req.Header.Set("Accept", MIME_TYPE_JSON)
+    rec := httptest.NewRecorder()
+    wm.ServeHTTP(rec, req)
+    if rec.Code != http.StatusInternalServerError || rec.Header().Get("Content-Type") != MIME_TYPE_JSON+"; charset=utf-8" {
+        t.Errorf("status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+    }
+    if vary := rec.Header()["Vary"]; len(vary) != 1 || vary[0] != "Accept, Accept-Encoding" {
+        t.Errorf("Vary %q, want one header naming Accept once", vary)
+    }
+}
+
+func TestBuilderAcceptsError(t *testing.T) {
+    failure := errors.New("secret detail")
+    tests := []struct {
+        err    error
+        status int
+    }{
+        {failure, http.StatusInternalServerError},
+        {NewHalt(http.StatusConflict, failure).WithHeader("X-Conflict", "1"), http.StatusConflict},
+    }
+    for _, tt := range tests {
+        renderer := new(recordingErrorRenderer)
+        wm := NewWebMachine()
+        wm.SetErrorRenderer(renderer)
+        wm.AddRouteHandler(NewResourceBuilder().
+            AllowedMethods(PUT).
+            Provides(MIME_TYPE_TEXT_PLAIN, func(req Request, cxt Context, w io.Writer) error { return nil }).
+            Accepts(MIME_TYPE_TEXT_PLAIN, func(req Request, cxt Context) error { return tt.err }).
+            Build())
+        req := httptest.NewRequest(PUT, "/", strings.NewReader("body"))
+        req.Header.Set("Content-Type", MIME_TYPE_TEXT_PLAIN)
+        rec := httptest.NewRecorder()
+        wm.ServeHTTP(rec, req)
+        if rec.Code != tt.status || renderer.statusCode != tt.status || renderer.err != tt.err || rec.Body.String() != "rendered" {
+            t.Errorf("%v: status %d, rendered %d %v, body %q", tt.err, rec.Code, renderer.statusCode, renderer.err, rec.Body.String())
+        }
+        if _, ok := asHalt(tt.err); ok && rec.Header().Get("X-Conflict") != "1" {
+            t.Errorf("%v: Halt header not sent", tt.err)
+        }
+    }
+}
+
+func TestResourceBuilder(t *testing.T) {
+    created := false
+    wm := NewWebMachine()
+    wm.AddRouteHandler(NewResourceBuilder().
+        Path("/items/").
+        AllowedMethods(GET, HEAD, POST, DELETE).
+        StartRequest(func(req Request) Context { return req.URL().Path }).
+        ServiceAvailable(func(req Request, cxt Context) (bool, error) { return len(req.Header().Get("X-Down")) == 0, nil }).
+        IsAuthorized(func(req Request, cxt Context) (bool, string, error) {
+            return req.Header().Get("Authorization") != "none", `Basic realm="items"`, nil
+        }).
+        Forbidden(func(req Request, cxt Context) (bool, error) { return len(req.Header().Get("X-Forbidden")) > 0, nil }).
+        MalformedRequest(func(req Request, cxt Context) (bool, error) { return len(req.Header().Get("X-Malformed")) > 0, nil }).
+        ResourceExists(func(req Request, cxt Context) (bool, error) {
+            if len(req.Header().Get("X-Halt")) > 0 {
+                return false, NewHalt(http.StatusTeapot, errors.New("halted"))
+            }
+            return cxt.(string) != "/items/missing", nil
+        }).
+        ETag(func(req Request, cxt Context) (string, error) { return "1", nil }).
+        DeleteResource(func(req Request, cxt Context) (bool, error) { return true, nil }).
+        CreatePath(func(req Request, cxt Context) (string, error) {
+            created = true
+            return "/items/new", nil
+        }).
+        Provides(MIME_TYPE_TEXT_PLAIN, func(req Request, cxt Context, w io.Writer) error {
+            _, err := io.WriteString(w, cxt.(string))
+            return err
+        }).
+        Accepts(MIME_TYPE_TEXT_PLAIN, func(req Request, cxt Context) error { return nil }).
+        Build())
+    tests := []struct {
+        method string
+        path   string
+        header string
+        status int
+        body   string
+    }{
+        {GET, "/items/a", "", http.StatusOK, "/items/a"},
+        {GET, "/other", "", http.StatusBadRequest, ""},
+        {GET, "/items/a", "X-Down", http.StatusServiceUnavailable, ""},
+        {GET, "/items/a", "Authorization", http.StatusUnauthorized, ""},
+        {GET, "/items/a", "X-Forbidden", http.StatusForbidden, ""},
+        {GET, "/items/a", "X-Malformed", http.StatusBadRequest, ""},
+        {GET, "/items/missing", "", http.StatusNotFound, ""},
+        {GET, "/items/a", "X-Halt", http.StatusTeapot, ""},
+        {PUT, "/items/a", "", http.StatusMethodNotAllowed, ""},
+        {DELETE, "/items/a", "", http.StatusNoContent, ""},
+        {POST, "/items/", "", http.StatusNoContent, ""},
+    }
+    for _, tt := range tests {
+        req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("body"))
+        req.Header.Set("Content-Type", MIME_TYPE_TEXT_PLAIN)
+        if len(tt.header) > 0 {
+            req.Header.Set(tt.header, "none")
+        }
+        rec := httptest.NewRecorder()
+        wm.ServeHTTP(rec, req)
+        if rec.Code != tt.status || (len(tt.body) > 0 && rec.Body.String() != tt.body) {
+            t.Errorf("%s %s with %s: status %d, body %q, want %d, %q", tt.method, tt.path, tt.header, rec.Code, rec.Body.String(), tt.status, tt.body)
+        }
+        switch rec.Code {
+        case http.StatusOK:
+            if rec.Header().Get("ETag") != `"1"` {
+                t.Errorf("ETag %q", rec.Header().Get("ETag"))
+            }
+        case http.StatusUnauthorized:
+            if rec.Header().Get("WWW-Authenticate") != `Basic realm="items"` {
+                t.Errorf("WWW-Authenticate %q", rec.Header().Get("WWW-Authenticate"))
+            }
+        }
+    }
+    if !created {
+        t.Error("POST did not call CreatePath")
+    }
+}
+
+func TestResourceBuilderBuildCopies(t *testing.T) {
+    builder := NewResourceBuilder().AllowedMethods(GET)
+    first := builder.Build()
+    builder.AllowedMethods(GET, PUT)
+    if methods, _, _, _, _ := first.AllowedMethods(nil, nil); len(methods) != 1 {
+        t.Errorf("AllowedMethods() = %v after the builder changed", methods)
+    }
+}
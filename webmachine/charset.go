@@ -1,25 +1,321 @@
 package webmachine
 
 import (
+    "github.com/pomack/webmachine.go/webmachine/negotiation"
     "io"
+    "strings"
+    "unicode/utf16"
+    "unicode/utf8"
 )
 
+// StandardCharsetHandler transcodes between UTF-8 and the charsets with
+// CHARSET_ constants, including their common aliases.  Bodies in any other
+// charset are passed through unchanged.
 type StandardCharsetHandler struct {
     charset string
+    codec   charsetCodec
 }
 
 func NewStandardCharsetHandler(charset string) *StandardCharsetHandler {
-    return &StandardCharsetHandler{charset: charset}
+    return &StandardCharsetHandler{charset: charset, codec: charsetCodecs[canonicalCharset(charset)]}
+}
+
+func NewUSASCIICharsetHandler() *StandardCharsetHandler {
+    return NewStandardCharsetHandler(CHARSET_US_ASCII)
+}
+
+func NewISO88591CharsetHandler() *StandardCharsetHandler {
+    return NewStandardCharsetHandler(CHARSET_ISO_8859_1)
+}
+
+func NewWindows1252CharsetHandler() *StandardCharsetHandler {
+    return NewStandardCharsetHandler(CHARSET_WINDOWS_1252)
+}
+
+func NewUTF16LECharsetHandler() *StandardCharsetHandler {
+    return NewStandardCharsetHandler(CHARSET_UTF_16LE)
+}
+
+func NewUTF16BECharsetHandler() *StandardCharsetHandler {
+    return NewStandardCharsetHandler(CHARSET_UTF_16BE)
+}
+
+// IsSupportedCharset reports whether StandardCharsetHandler can transcode
+// charset.
+func IsSupportedCharset(charset string) bool {
+    charset = canonicalCharset(charset)
+    _, ok := charsetCodecs[charset]
+    return ok || charset == CHARSET_UTF_8
 }
 
 func (p *StandardCharsetHandler) Charset() string {
     return p.charset
 }
 
+// CharsetConverter decodes a request body in the handler's charset to UTF-8.
 func (p *StandardCharsetHandler) CharsetConverter(req Request, cxt Context, reader io.Reader) io.Reader {
-    return reader
+    if p.codec == nil {
+        return reader
+    }
+    return &charsetReader{reader: reader, codec: p.codec}
+}
+
+// CharsetEncoder encodes a response body written in UTF-8 into the handler's
+// charset.  Characters the charset cannot represent are written as '?'.
+func (p *StandardCharsetHandler) CharsetEncoder(req Request, cxt Context, writer io.Writer) io.Writer {
+    if p.codec == nil {
+        return writer
+    }
+    return &charsetWriter{writer: writer, codec: p.codec}
 }
 
 func (p *StandardCharsetHandler) String() string {
     return "NewStandardCharsetHandler(\"" + p.charset + "\")"
 }
+
+func canonicalCharset(charset string) string {
+    charset = strings.ToLower(strings.TrimSpace(charset))
+    switch charset {
+    case "utf8":
+        return CHARSET_UTF_8
+    case "ascii", "us", "iso646-us", "ansi_x3.4-1968":
+        return CHARSET_US_ASCII
+    case "latin1", "l1", "iso8859-1", "iso_8859-1", "iso-ir-100", "cp819", "ibm819":
+        return CHARSET_ISO_8859_1
+    case "cp1252", "x-cp1252":
+        return CHARSET_WINDOWS_1252
+    }
+    return charset
+}
+
+// chooseCharsetHandler picks from provided the charset with the highest
+// q-value in the Accept-Charset header, the first provided on a tie, or nil
+// if none is acceptable.
+func chooseCharsetHandler(provided []CharsetHandler, header string) CharsetHandler {
+    prefs := negotiation.ParseAcceptCharset(header)
+    for i := range prefs {
+        prefs[i].Value = canonicalCharset(prefs[i].Value)
+    }
+    var best CharsetHandler
+    bestQ := 0.0
+    for _, handler := range provided {
+        if q := negotiation.CharsetQuality(canonicalCharset(handler.Charset()), prefs); q > bestQ {
+            best, bestQ = handler, q
+        }
+    }
+    return best
+}
+
+// charsetCodec converts between one charset and Unicode.
+type charsetCodec interface {
+    // appendRune appends the encoding of r, or of a replacement character.
+    appendRune(dst []byte, r rune) []byte
+    // decode appends the UTF-8 for the complete characters at the start of
+    // src and returns how many bytes of src they took.  At EOF a trailing
+    // partial character is decoded as U+FFFD.
+    decode(dst []byte, src []byte, atEOF bool) ([]byte, int)
+}
+
+var charsetCodecs = map[string]charsetCodec{
+    CHARSET_US_ASCII:     newSingleByteCodec(nil, 0x80),
+    CHARSET_ISO_8859_1:   newSingleByteCodec(nil, 0x100),
+    CHARSET_WINDOWS_1252: newSingleByteCodec(windows1252High, 0x100),
+    CHARSET_UTF_16LE:     utf16Codec{bigEndian: false},
+    CHARSET_UTF_16BE:     utf16Codec{bigEndian: true},
+}
+
+// windows1252High holds the characters Windows-1252 has at 0x80 to 0x9F in
+// place of the C1 controls of ISO-8859-1.  The five unassigned bytes map to
+// the controls, as browsers do.
+var windows1252High = []rune{
+    0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+    0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+    0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+    0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+}
+
+type singleByteCodec struct {
+    decodeTable [256]rune
+    encodeTable map[rune]byte
+}
+
+// newSingleByteCodec returns the codec for a charset that matches Unicode for
+// the first size bytes, apart from high replacing 0x80 onwards.  Bytes past
+// size are invalid.
+func newSingleByteCodec(high []rune, size int) *singleByteCodec {
+    p := &singleByteCodec{encodeTable: make(map[rune]byte)}
+    for i := range p.decodeTable {
+        r := utf8.RuneError
+        if i < size {
+            r = rune(i)
+        }
+        if i >= 0x80 && i-0x80 < len(high) {
+            r = high[i-0x80]
+        }
+        p.decodeTable[i] = r
+        if r != utf8.RuneError {
+            p.encodeTable[r] = byte(i)
+        }
+    }
+    return p
+}
+
+func (p *singleByteCodec) appendRune(dst []byte, r rune) []byte {
+    if b, ok := p.encodeTable[r]; ok {
+        return append(dst, b)
+    }
+    return append(dst, '?')
+}
+
+func (p *singleByteCodec) decode(dst []byte, src []byte, atEOF bool) ([]byte, int) {
+    for _, b := range src {
+        dst = utf8.AppendRune(dst, p.decodeTable[b])
+    }
+    return dst, len(src)
+}
+
+type utf16Codec struct {
+    bigEndian bool
+}
+
+func (p utf16Codec) appendUnit(dst []byte, u uint16) []byte {
+    if p.bigEndian {
+        return append(dst, byte(u>>8), byte(u))
+    }
+    return append(dst, byte(u), byte(u>>8))
+}
+
+func (p utf16Codec) unit(src []byte) uint16 {
+    if p.bigEndian {
+        return uint16(src[0])<<8 | uint16(src[1])
+    }
+    return uint16(src[1])<<8 | uint16(src[0])
+}
+
+func (p utf16Codec) appendRune(dst []byte, r rune) []byte {
+    if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+        return p.appendUnit(p.appendUnit(dst, uint16(r1)), uint16(r2))
+    }
+    if utf16.IsSurrogate(r) || r > utf8.MaxRune {
+        r = utf8.RuneError
+    }
+    return p.appendUnit(dst, uint16(r))
+}
+
+func (p utf16Codec) decode(dst []byte, src []byte, atEOF bool) ([]byte, int) {
+    n := 0
+    for len(src)-n >= 2 {
+        u := rune(p.unit(src[n:]))
+        if !utf16.IsSurrogate(u) {
+            dst = utf8.AppendRune(dst, u)
+            n += 2
+            continue
+        }
+        if len(src)-n < 4 {
+            if !atEOF {
+                return dst, n
+            }
+            dst = utf8.AppendRune(dst, utf8.RuneError)
+            n += 2
+            continue
+        }
+        if r := utf16.DecodeRune(u, rune(p.unit(src[n+2:]))); r != utf8.RuneError {
+            dst = utf8.AppendRune(dst, r)
+            n += 4
+        } else {
+            dst = utf8.AppendRune(dst, utf8.RuneError)
+            n += 2
+        }
+    }
+    if atEOF && n < len(src) {
+        dst = utf8.AppendRune(dst, utf8.RuneError)
+        n = len(src)
+    }
+    return dst, n
+}
+
+// charsetReader decodes a body in some charset to UTF-8.
+type charsetReader struct {
+    reader io.Reader
+    codec  charsetCodec
+    buf    []byte
+    src    []byte
+    out    []byte
+    err    error
+}
+
+func (p *charsetReader) Read(b []byte) (int, error) {
+    for len(p.out) == 0 {
+        if p.err != nil {
+            return 0, p.err
+        }
+        if p.buf == nil {
+            p.buf = make([]byte, 4096)
+        }
+        n, err := p.reader.Read(p.buf)
+        p.src = append(p.src, p.buf[0:n]...)
+        p.err = err
+        var consumed int
+        p.out, consumed = p.codec.decode(p.out[:0], p.src, err != nil)
+        p.src = append(p.src[:0], p.src[consumed:]...)
+    }
+    n := copy(b, p.out)
+    p.out = p.out[n:]
+    return n, nil
+}
+
+func (p *charsetReader) Close() error {
+    if closer, ok := p.reader.(io.Closer); ok {
+        return closer.Close()
+    }
+    return nil
+}
+
+// charsetWriter encodes a body written in UTF-8 into some charset, holding
+// back a character split across writes until it is complete.
+type charsetWriter struct {
+    writer  io.Writer
+    codec   charsetCodec
+    pending []byte
+    buf     []byte
+}
+
+func (p *charsetWriter) Write(b []byte) (int, error) {
+    src := b
+    if len(p.pending) > 0 {
+        src = append(p.pending, b...)
+        p.pending = nil
+    }
+    p.buf = p.buf[:0]
+    for len(src) > 0 {
+        if !utf8.FullRune(src) {
+            p.pending = append([]byte(nil), src...)
+            break
+        }
+        r, size := utf8.DecodeRune(src)
+        p.buf = p.codec.appendRune(p.buf, r)
+        src = src[size:]
+    }
+    if _, err := p.writer.Write(p.buf); err != nil {
+        return 0, err
+    }
+    return len(b), nil
+}
+
+func (p *charsetWriter) Flush() error {
+    if f, ok := p.writer.(Flusher); ok {
+        return f.Flush()
+    }
+    return nil
+}
+
+// Close writes out an incomplete trailing character as a replacement.  It
+// does not close the underlying writer.
+func (p *charsetWriter) Close() error {
+    if len(p.pending) == 0 {
+        return nil
+    }
+    p.pending = nil
+    _, err := p.writer.Write(p.codec.appendRune(nil, utf8.RuneError))
+    return err
+}
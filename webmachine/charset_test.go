@@ -0,0 +1,154 @@
+package webmachine
+
+import (
+    "bytes"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "testing/iotest"
+)
+
+func TestCharsetEncoder(t *testing.T) {
+    tests := []struct {
+        charset string
+        writes  []string
+        out     string
+    }{
+        {CHARSET_ISO_8859_1, []string{"caf\xc3", "\xa9"}, "caf\xe9"},
+        {CHARSET_WINDOWS_1252, []string{"\xe2", "\x82", "\xac5"}, "\x805"},
+        {CHARSET_WINDOWS_1252, []string{"“quoted” Š"}, "\x93quoted\x94 \x8a"},
+        // characters the charset lacks become '?'
+        {CHARSET_US_ASCII, []string{"café"}, "caf?"},
+        {CHARSET_ISO_8859_1, []string{"5€"}, "5?"},
+        {CHARSET_WINDOWS_1252, []string{"中"}, "?"},
+        // Close writes a trailing partial character as a replacement
+        {CHARSET_ISO_8859_1, []string{"a\xe2\x82"}, "a?"},
+        {CHARSET_UTF_16LE, []string{"a\xe2\x82"}, "a\x00\xfd\xff"},
+        {CHARSET_UTF_16LE, []string{"a\U0001F600"}, "a\x00\x3d\xd8\x00\xde"},
+        {CHARSET_UTF_16BE, []string{"a\xf0\x9f", "\x98\x80"}, "\x00a\xd8\x3d\xde\x00"},
+    }
+    for _, tt := range tests {
+        var buf bytes.Buffer
+        w := NewStandardCharsetHandler(tt.charset).CharsetEncoder(nil, nil, &buf)
+        for _, s := range tt.writes {
+            if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+                t.Errorf("%s: Write(%q) = %d, %v", tt.charset, s, n, err)
+            }
+        }
+        w.(*charsetWriter).Close()
+        if buf.String() != tt.out {
+            t.Errorf("%s: %q encoded as %q, want %q", tt.charset, tt.writes, buf.String(), tt.out)
+        }
+    }
+}
+
+func TestCharsetConverter(t *testing.T) {
+    tests := []struct {
+        charset string
+        in      string
+        out     string
+    }{
+        {CHARSET_ISO_8859_1, "caf\xe9\x80", "café\u0080"},
+        {CHARSET_US_ASCII, "caf\xe9", "caf�"},
+        {CHARSET_WINDOWS_1252, "\x80\x81\x8a\x93\x94\x99\x9f\xa0\xff", "€\u0081Š“”™Ÿ ÿ"},
+        {CHARSET_UTF_16LE, "a\x00\x3d\xd8\x00\xde", "a\U0001F600"},
+        {CHARSET_UTF_16BE, "\x00a\xd8\x3d\xde\x00", "a\U0001F600"},
+        // a high surrogate without its low surrogate, a lone low surrogate,
+        // a high surrogate at the end and an odd byte out
+        {CHARSET_UTF_16LE, "\x3d\xd8a\x00", "�a"},
+        {CHARSET_UTF_16LE, "\x00\xdea\x00", "�a"},
+        {CHARSET_UTF_16BE, "\x00a\xd8\x3d", "a�"},
+        {CHARSET_UTF_16BE, "\x00a\x00", "a�"},
+    }
+    for _, tt := range tests {
+        // one byte at a time, so that every character is split across reads
+        r := NewStandardCharsetHandler(tt.charset).CharsetConverter(nil, nil, iotest.OneByteReader(strings.NewReader(tt.in)))
+        out, err := ioutil.ReadAll(r)
+        if err != nil || string(out) != tt.out {
+            t.Errorf("%s: %q decoded as %q, %v, want %q", tt.charset, tt.in, out, err, tt.out)
+        }
+    }
+}
+
+func TestWindows1252RoundTrip(t *testing.T) {
+    in := make([]byte, 256)
+    for i := range in {
+        in[i] = byte(i)
+    }
+    decoded, err := ioutil.ReadAll(NewWindows1252CharsetHandler().CharsetConverter(nil, nil, bytes.NewReader(in)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var buf bytes.Buffer
+    NewWindows1252CharsetHandler().CharsetEncoder(nil, nil, &buf).Write(decoded)
+    if !bytes.Equal(buf.Bytes(), in) {
+        t.Errorf("round trip = %q", buf.Bytes())
+    }
+}
+
+type charsetTestInputHandler struct {
+    contentType string
+    body        string
+}
+
+func (p *charsetTestInputHandler) MediaTypeInput() string {
+    return MIME_TYPE_TEXT_PLAIN
+}
+
+func (p *charsetTestInputHandler) MediaTypeHandleInputFrom(req Request, cxt Context) (int, http.Header, io.WriterTo) {
+    b, _ := ioutil.ReadAll(req.Body())
+    p.contentType, p.body = req.Header().Get("Content-Type"), string(b)
+    return 0, nil, nil
+}
+
+type charsetTestResource struct {
+    DefaultRequestHandler
+    input *charsetTestInputHandler
+}
+
+func (p *charsetTestResource) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    return p
+}
+
+func (p *charsetTestResource) AllowedMethods(req Request, cxt Context) ([]string, Request, Context, int, error) {
+    return []string{PUT}, req, cxt, 0, nil
+}
+
+func (p *charsetTestResource) ContentTypesProvided(req Request, cxt Context) ([]MediaTypeHandler, Request, Context, int, error) {
+    return []MediaTypeHandler{&formatTestMediaTypeHandler{MIME_TYPE_TEXT_PLAIN, "ok"}}, req, cxt, 0, nil
+}
+
+func (p *charsetTestResource) ContentTypesAccepted(req Request, cxt Context) ([]MediaTypeInputHandler, Request, Context, int, error) {
+    return []MediaTypeInputHandler{p.input}, req, cxt, 0, nil
+}
+
+func TestRequestCharsetDecoding(t *testing.T) {
+    tests := []struct {
+        contentType string
+        body        string
+        status      int
+        decoded     string
+        received    string
+    }{
+        {"text/plain; charset=windows-1252", "\x80 caf\xe9", http.StatusNoContent, "€ café", "text/plain; charset=utf-8"},
+        {"text/plain; charset=UTF-16BE", "\x00h\x00i", http.StatusNoContent, "hi", "text/plain; charset=utf-8"},
+        {"text/plain; charset=utf-8", "caf\xc3\xa9", http.StatusNoContent, "café", "text/plain; charset=utf-8"},
+        {"text/plain", "caf\xc3\xa9", http.StatusNoContent, "café", "text/plain"},
+        {"text/plain; charset=x-klingon", "qapla'", http.StatusUnsupportedMediaType, "", ""},
+    }
+    for _, tt := range tests {
+        input := new(charsetTestInputHandler)
+        wm := NewWebMachine()
+        wm.AddRouteHandler(&charsetTestResource{input: input})
+        req := httptest.NewRequest(PUT, "/", strings.NewReader(tt.body))
+        req.Header.Set("Content-Type", tt.contentType)
+        rec := httptest.NewRecorder()
+        wm.ServeHTTP(rec, req)
+        if rec.Code != tt.status || input.body != tt.decoded || input.contentType != tt.received {
+            t.Errorf("%s: status %d, body %q as %q, want %d, %q as %q", tt.contentType, rec.Code, input.body, input.contentType, tt.status, tt.decoded, tt.received)
+        }
+    }
+}
@@ -0,0 +1,230 @@
+package webmachine
+
+import (
+    "bufio"
+    "bytes"
+    "compress/flate"
+    "errors"
+    "io"
+    "net"
+    "net/http"
+    "strings"
+)
+
+const (
+    DEFAULT_COMPRESSION_LEVEL    = flate.DefaultCompression
+    DEFAULT_COMPRESSION_MIN_SIZE = 1024
+)
+
+// CompressionPolicy decides which response bodies the negotiated
+// Content-Encoding is applied to.  Media types are matched without their
+// parameters and may end in "/*" to match a whole type.
+type CompressionPolicy struct {
+    // Level is passed to encoders that take one, see compress/flate.
+    Level int
+    // MinSize is the smallest body worth encoding.  Bodies that are flushed
+    // before reaching it, such as event streams, are encoded regardless.
+    MinSize int
+    // AllowMediaTypes, if not empty, lists the only media types encoded.
+    AllowMediaTypes []string
+    // DenyMediaTypes lists media types never encoded, typically because
+    // they are compressed already.
+    DenyMediaTypes []string
+}
+
+// NewDefaultCompressionPolicy returns the policy a WebMachine starts with:
+// the default level, bodies of at least DEFAULT_COMPRESSION_MIN_SIZE bytes
+// and anything but already compressed images, audio, video and archives, or
+// event streams, which must not wait for MinSize bytes.
+func NewDefaultCompressionPolicy() *CompressionPolicy {
+    return &CompressionPolicy{
+        Level:   DEFAULT_COMPRESSION_LEVEL,
+        MinSize: DEFAULT_COMPRESSION_MIN_SIZE,
+        DenyMediaTypes: []string{
+            "image/*",
+            "audio/*",
+            "video/*",
+            MIME_TYPE_ZIP,
+            MIME_TYPE_GZ,
+            MIME_TYPE_BZIP2,
+            "application/gzip",
+            "application/x-compress",
+            "application/x-7z-compressed",
+            "application/x-rar-compressed",
+            "application/x-xz",
+            "application/zstd",
+            "font/woff",
+            "font/woff2",
+            MIME_TYPE_EVENT_STREAM,
+        },
+    }
+}
+
+// AllowsMediaType reports whether bodies of mediaType may be encoded.
+func (p *CompressionPolicy) AllowsMediaType(mediaType string) bool {
+    if i := strings.Index(mediaType, ";"); i >= 0 {
+        mediaType = mediaType[0:i]
+    }
+    mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+    for _, pattern := range p.DenyMediaTypes {
+        if mediaTypeMatchesPattern(mediaType, pattern) {
+            return false
+        }
+    }
+    if len(p.AllowMediaTypes) == 0 {
+        return true
+    }
+    for _, pattern := range p.AllowMediaTypes {
+        if mediaTypeMatchesPattern(mediaType, pattern) {
+            return true
+        }
+    }
+    return false
+}
+
+func mediaTypeMatchesPattern(mediaType, pattern string) bool {
+    pattern = strings.ToLower(strings.TrimSpace(pattern))
+    if pattern == "*/*" || pattern == "*" {
+        return true
+    }
+    if strings.HasSuffix(pattern, "/*") {
+        return strings.HasPrefix(mediaType, pattern[0:len(pattern)-1])
+    }
+    return mediaType == pattern
+}
+
+// encodingResponseWriter applies a Content-Encoding to a response body.
+// The status line is held back until enough of the body has been written
+// to decide, under the CompressionPolicy, whether to encode it at all.  Close
+// must be called once the body is complete to flush and close the encoder.
+type encodingResponseWriter struct {
+    ResponseWriter
+    req        Request
+    cxt        Context
+    handler    EncodingHandler
+    policy     *CompressionPolicy
+    statusCode int
+    buf        bytes.Buffer
+    decided    bool
+    encoder    io.Writer
+}
+
+func newEncodingResponseWriter(resp ResponseWriter, req Request, cxt Context, handler EncodingHandler, policy *CompressionPolicy) *encodingResponseWriter {
+    return &encodingResponseWriter{ResponseWriter: resp, req: req, cxt: cxt, handler: handler, policy: policy}
+}
+
+func (p *encodingResponseWriter) WriteHeader(status int) {
+    if p.statusCode == 0 {
+        p.statusCode = status
+    }
+}
+
+func (p *encodingResponseWriter) StatusCode() int {
+    if p.statusCode != 0 {
+        return p.statusCode
+    }
+    return p.ResponseWriter.StatusCode()
+}
+
+func (p *encodingResponseWriter) Write(data []byte) (int, error) {
+    if p.statusCode == 0 {
+        p.statusCode = http.StatusOK
+    }
+    if !p.decided {
+        p.buf.Write(data)
+        if p.buf.Len() >= p.policy.MinSize {
+            if err := p.decide(true); err != nil {
+                return 0, err
+            }
+        }
+        return len(data), nil
+    }
+    return p.encoder.Write(data)
+}
+
+// decide writes the status line, with Content-Encoding if the body is to be
+// encoded, and then whatever has been buffered.
+func (p *encodingResponseWriter) decide(bigEnough bool) error {
+    p.decided = true
+    if p.statusCode == 0 {
+        p.statusCode = http.StatusOK
+    }
+    headers := p.ResponseWriter.Header()
+    p.encoder = p.ResponseWriter
+    if bigEnough && p.encodable() {
+        var w io.Writer
+        if leveled, ok := p.handler.(LeveledEncodingHandler); ok {
+            w = leveled.EncoderLevel(p.req, p.cxt, p.ResponseWriter, p.policy.Level)
+        } else {
+            w = p.handler.Encoder(p.req, p.cxt, p.ResponseWriter)
+        }
+        if w != nil {
+            headers.Set("Content-Encoding", p.handler.Encoding())
+            headers.Del("Content-Length")
+            p.encoder = w
+        }
+    }
+    p.ResponseWriter.WriteHeader(p.statusCode)
+    if p.buf.Len() == 0 {
+        return nil
+    }
+    _, err := p.encoder.Write(p.buf.Bytes())
+    p.buf.Reset()
+    return err
+}
+
+func (p *encodingResponseWriter) encodable() bool {
+    headers := p.ResponseWriter.Header()
+    if p.req.Method() == HEAD || len(headers.Get("Content-Encoding")) > 0 || len(headers.Get("Content-Range")) > 0 {
+        return false
+    }
+    switch p.statusCode {
+    case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+        return false
+    }
+    return p.policy.AllowsMediaType(headers.Get("Content-Type"))
+}
+
+// Flush sends what has been buffered so far, committing to encoding the
+// body whatever its eventual size, then flushes the encoder.
+func (p *encodingResponseWriter) Flush() error {
+    if !p.decided {
+        if err := p.decide(true); err != nil {
+            return err
+        }
+    }
+    if p.encoder != io.Writer(p.ResponseWriter) {
+        if f, ok := p.encoder.(Flusher); ok {
+            if err := f.Flush(); err != nil {
+                return err
+            }
+        }
+    }
+    return p.ResponseWriter.Flush()
+}
+
+// Close finishes the body, closing the encoder so that its trailer is
+// written, but leaves the underlying ResponseWriter open.
+func (p *encodingResponseWriter) Close() error {
+    if !p.decided {
+        if p.statusCode == 0 && p.buf.Len() == 0 {
+            return nil
+        }
+        if err := p.decide(p.buf.Len() >= p.policy.MinSize); err != nil {
+            return err
+        }
+    }
+    if p.encoder != io.Writer(p.ResponseWriter) {
+        if closer, ok := p.encoder.(io.Closer); ok {
+            return closer.Close()
+        }
+    }
+    return nil
+}
+
+func (p *encodingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    if hijacker, ok := p.ResponseWriter.(http.Hijacker); ok {
+        return hijacker.Hijack()
+    }
+    return nil, nil, errors.New("webmachine: connection does not support hijacking")
+}
@@ -2,6 +2,7 @@ package webmachine
 
 import (
     "html/template"
+    "strings"
 )
 
 const (
@@ -22,6 +23,10 @@ const (
 var ALL_METHODS []string
 var HTML_DIRECTORY_LISTING_ERROR_TEMPLATE *template.Template
 var HTML_DIRECTORY_LISTING_SUCCESS_TEMPLATE *template.Template
+var HTML_TRACE_LIST_TEMPLATE *template.Template
+var HTML_TRACE_DETAIL_TEMPLATE *template.Template
+var HTML_ERROR_TEMPLATE *template.Template
+var HTML_REPRESENTATIONS_TEMPLATE *template.Template
 
 type WMDecision int
 
@@ -87,7 +92,11 @@ const (
 
 const (
     HTML_DIRECTORY_LISTING_SUCCESS_TEMPLATE_STRING = "<!DOCTYPE html>\n<html lang=\"en_US\">\n  <head>\n    <title>{{.Tail}} - Directory Listing</title>\n  </head>\n  <body>\n    <h1>{{.Tail}}</h1>\n    <h4>{{.Path}}</h4>\n    <p>{{.Message}}</p>\n    <table>\n      <thead>\n        <tr>\n          <th>Filename</th>\n          <th>Size</th>\n          <th>Last Modified</th>\n        </tr>\n      </thead>\n      <tbody>\n        {{range .Result}}\n        <tr class=\"entry\">\n          <td class=\"name\"><a href=\"{{.Path}}\">{{.Filename}}</a></td>\n          <td class=\"size\">{{.Size}}</td>\n          <td class=\"last_modified\">{{.LastModified}}</td>\n        </tr>\n        {{end}}\n      </tbody>\n    </table>\n    <p>Last Modified: {{.LastModified}}</p>\n  </body>\n</html>"
+    HTML_TRACE_LIST_TEMPLATE_STRING                = "<!DOCTYPE html>\n<html lang=\"en_US\">\n  <head>\n    <title>Webmachine Traces</title>\n  </head>\n  <body>\n    <h1>Webmachine Traces</h1>\n    <table>\n      <thead>\n        <tr>\n          <th>Started</th>\n          <th>Method</th>\n          <th>Path</th>\n          <th>Status</th>\n          <th>Resource</th>\n          <th>Duration</th>\n        </tr>\n      </thead>\n      <tbody>\n        {{range .}}\n        <tr class=\"trace\">\n          <td class=\"started\"><a href=\"{{.URL}}\">{{.StartTime}}</a></td>\n          <td class=\"method\">{{.Method}}</td>\n          <td class=\"path\">{{.Path}}</td>\n          <td class=\"status\">{{.StatusCode}}</td>\n          <td class=\"resource\">{{.Resource}}</td>\n          <td class=\"duration\">{{.Duration}}</td>\n        </tr>\n        {{else}}\n        <tr><td colspan=\"6\">No requests have been traced yet.</td></tr>\n        {{end}}\n      </tbody>\n    </table>\n  </body>\n</html>"
+    HTML_TRACE_DETAIL_TEMPLATE_STRING              = "<!DOCTYPE html>\n<html lang=\"en_US\">\n  <head>\n    <title>{{.Record.Method}} {{.Record.Path}} - Webmachine Trace</title>\n  </head>\n  <body>\n    <p><a href=\"{{.ListURL}}\">All traces</a></p>\n    <h1>{{.Record.Method}} {{.Record.Path}}</h1>\n    <p>Status {{.Record.StatusCode}} from {{.Record.Resource}} in {{.Duration}}</p>\n    <object type=\"image/svg+xml\" data=\"{{.SVGURL}}\"></object>\n    <table>\n      <thead>\n        <tr>\n          <th>Decision</th>\n          <th>Callback</th>\n          <th>Results</th>\n        </tr>\n      </thead>\n      <tbody>\n        {{range .Decisions}}\n        <tr class=\"decision\">\n          <td class=\"id\" title=\"{{.Description}}\">{{.Id}} {{.Description}}</td>\n          <td></td>\n          <td></td>\n        </tr>\n        {{range .Callbacks}}\n        <tr class=\"callback\">\n          <td></td>\n          <td class=\"name\">{{.Name}}</td>\n          <td class=\"results\">{{.Results}}</td>\n        </tr>\n        {{end}}\n        {{end}}\n      </tbody>\n    </table>\n  </body>\n</html>"
     HTML_DIRECTORY_LISTING_ERROR_TEMPLATE_STRING   = "<!DOCTYPE html>\n<html lang=\"en_US\">\n  <head>\n    <title>Error in Directory Listing</title>\n  </head>\n  <body>\n    <h1>Error in Directory Listing</h1>\n    <p>While accessing <code>{{.Path}}</code></p>\n    <h4>Error</h4>\n    <p>{{.Message}}</p>\n  </body>\n</html>"
+    HTML_REPRESENTATIONS_TEMPLATE_STRING           = "<!DOCTYPE html>\n<html lang=\"en_US\">\n  <head>\n    <title>{{.StatusCode}} {{.Status}}</title>\n  </head>\n  <body>\n    <h1>{{.StatusCode}} {{.Status}}</h1>\n    {{if .Message}}<p>{{.Message}}</p>{{end}}\n    <table>\n      <thead>\n        <tr>\n          <th>Media Type</th>\n          <th>Language</th>\n          <th>Charset</th>\n          <th>Encoding</th>\n        </tr>\n      </thead>\n      <tbody>\n        {{range .Representations}}\n        <tr class=\"representation\">\n          <td class=\"media_type\">{{if .URL}}<a href=\"{{.URL}}\">{{.MediaType}}</a>{{else}}{{.MediaType}}{{end}}</td>\n          <td class=\"language\">{{.Language}}</td>\n          <td class=\"charset\">{{.Charset}}</td>\n          <td class=\"encoding\">{{.Encoding}}</td>\n        </tr>\n        {{end}}\n      </tbody>\n    </table>\n  </body>\n</html>"
+    HTML_ERROR_TEMPLATE_STRING                     = "<!DOCTYPE html>\n<html lang=\"en_US\">\n  <head>\n    <title>{{.StatusCode}} {{.Status}}</title>\n  </head>\n  <body>\n    <h1>{{.StatusCode}} {{.Status}}</h1>\n    {{if .Message}}<p>{{.Message}}</p>{{end}}\n  </body>\n</html>"
 )
 
 const (
@@ -111,6 +120,7 @@ const (
     MIME_TYPE_SVG            = "image/svg+xml"
     MIME_TYPE_TEXT_PLAIN     = "text/plain"
     MIME_TYPE_CSV            = "text/csv"
+    MIME_TYPE_EVENT_STREAM   = "text/event-stream"
     MIME_TYPE_OCTET_STREAM   = "application/octet-stream"
 )
 
@@ -119,7 +129,18 @@ const (
     ENCODING_COMPRESS = "compress"
     ENCODING_DEFLATE  = "deflate"
     ENCODING_GZIP     = "gzip"
-    ENCODING_CHUNKED  = "chunked"
+    // Deprecated: chunked is a transfer coding, not a content coding, and
+    // is no longer negotiated.
+    ENCODING_CHUNKED = "chunked"
+)
+
+const (
+    CHARSET_UTF_8        = "utf-8"
+    CHARSET_US_ASCII     = "us-ascii"
+    CHARSET_ISO_8859_1   = "iso-8859-1"
+    CHARSET_WINDOWS_1252 = "windows-1252"
+    CHARSET_UTF_16LE     = "utf-16le"
+    CHARSET_UTF_16BE     = "utf-16be"
 )
 
 var (
@@ -160,6 +181,14 @@ func init() {
     template.Must(HTML_DIRECTORY_LISTING_SUCCESS_TEMPLATE, err)
     HTML_DIRECTORY_LISTING_ERROR_TEMPLATE, err = template.New("directory_listing_error").Parse(HTML_DIRECTORY_LISTING_ERROR_TEMPLATE_STRING)
     template.Must(HTML_DIRECTORY_LISTING_ERROR_TEMPLATE, err)
+    HTML_TRACE_LIST_TEMPLATE, err = template.New("trace_list").Parse(HTML_TRACE_LIST_TEMPLATE_STRING)
+    template.Must(HTML_TRACE_LIST_TEMPLATE, err)
+    HTML_TRACE_DETAIL_TEMPLATE, err = template.New("trace_detail").Parse(HTML_TRACE_DETAIL_TEMPLATE_STRING)
+    template.Must(HTML_TRACE_DETAIL_TEMPLATE, err)
+    HTML_ERROR_TEMPLATE, err = template.New("error").Parse(HTML_ERROR_TEMPLATE_STRING)
+    template.Must(HTML_ERROR_TEMPLATE, err)
+    HTML_REPRESENTATIONS_TEMPLATE, err = template.New("representations").Parse(HTML_REPRESENTATIONS_TEMPLATE_STRING)
+    template.Must(HTML_REPRESENTATIONS_TEMPLATE, err)
 }
 
 func (p WMDecision) String() string {
@@ -284,3 +313,12 @@ func (p WMDecision) String() string {
     }
     return s
 }
+
+// Id returns the node name used in the v3 decision diagram, e.g. "v3b13".
+func (p WMDecision) Id() string {
+    s := p.String()
+    if index := strings.Index(s, ":"); index > 0 {
+        return s[:index]
+    }
+    return s
+}
@@ -2,24 +2,28 @@ package webmachine
 
 import (
     "bytes"
-    "compress/flate"
-    "compress/gzip"
-    "compress/lzw"
-    "compress/zlib"
+    "context"
+    "errors"
+    "fmt"
+    "github.com/pomack/webmachine.go/webmachine/negotiation"
     "io"
-    "log"
     "mime"
     "net/http"
-    "strconv"
+    "runtime/debug"
     "strings"
     "time"
 )
 
 type wmDecisionCore struct {
+    wm                     *webMachine
     req                    Request
     resp                   ResponseWriter
     cxt                    Context
     handler                RequestHandler
+    resource               RequestHandler
+    trace                  DecisionTrace
+    logger                 Logger
+    deadlineCode           int
     currentDecisionId      WMDecision
     lastModified           time.Time
     unmodifiedSince        time.Time
@@ -33,31 +37,116 @@ type wmDecisionCore struct {
     charset                string
     language               string
     decisions              []int
+    requestBody            *decodedBody
+    formatOverride         *formatOverride
 }
 
-func handleRequest(handler RequestHandler, req Request, resp ResponseWriter) {
-    d := &wmDecisionCore{req: req, resp: resp, handler: handler, currentDecisionId: v3b13}
-    log.Print("[WM] Handling request for: ", req.Method(), " ", req.URL().Path, "\n")
+func handleRequest(wm *webMachine, handler RequestHandler, req Request, resp ResponseWriter, override *formatOverride) {
+    d := &wmDecisionCore{wm: wm, req: req, resp: resp, handler: handler, resource: handler, formatOverride: override, currentDecisionId: v3b13}
+    if wm != nil && wm.tracer != nil {
+        d.trace = wm.tracer.StartTrace(req, resp, handler)
+        d.handler = newTracingRequestHandler(handler, d.trace)
+    }
+    d.logger = withLogFields(req.Logger(), LogFields{"resource": fmt.Sprintf("%T", handler)})
+    d.log(LOG_LEVEL_DEBUG, "handling request", nil)
+    panicked := !d.run()
+    failed := panicked || resp.StatusCode() >= http.StatusInternalServerError
+    d.finish(failed)
+    if panicked && resp.StatusCode() != http.StatusInternalServerError {
+        // the response was already underway when the panic happened, so
+        // abort the connection rather than let a truncated body look complete
+        panic(http.ErrAbortHandler)
+    }
+}
+
+// run walks the decision graph, turning any panic from a RequestHandler or
+// MediaTypeHandler into a 500 if nothing has been written yet.
+func (p *wmDecisionCore) run() (ok bool) {
     defer func() {
-        log.Print("[WM] Running deferred function for: ", req.Method(), " ", req.URL().Path, "\n")
-        go handler.FinishRequest(d.req, d.cxt)
-        /*
-           if e := recover(); e != nil {
-             resp.WriteHeader(http.StatusInternalServerError)
-           }
-        */
+        if e := recover(); e != nil {
+            p.log(LOG_LEVEL_ERROR, "panic while handling request", LogFields{"panic": e, "stack": string(debug.Stack())})
+            if p.resp.StatusCode() == 0 {
+                p.renderError(http.StatusInternalServerError, errors.New(http.StatusText(http.StatusInternalServerError)))
+            }
+            ok = false
+        }
     }()
-    d.req, d.cxt = handler.StartRequest(d.req, d.cxt)
+    p.req, p.cxt = p.handler.StartRequest(p.req, p.cxt)
+    if deadlineHandler, ok := p.resource.(DeadlineHandler); ok {
+        timeout, httpCode := deadlineHandler.RequestTimeout(p.req, p.cxt)
+        p.traceCallback("RequestTimeout", timeout.String(), httpCode)
+        if timeout > 0 {
+            ctx, cancel := context.WithTimeout(p.req.Context(), timeout)
+            defer cancel()
+            p.req = p.req.WithContext(ctx)
+            p.deadlineCode = httpCode
+            if p.deadlineCode != http.StatusGatewayTimeout {
+                p.deadlineCode = http.StatusServiceUnavailable
+            }
+        }
+    }
     nextDecision := v3b13
-    log.Print("[WM] decision: ", nextDecision, " for ", req.Method(), " ", req.URL().Path, "\n")
     for nextDecision != wmResponded {
-        nextDecision = d.makeDecision(nextDecision)
-        log.Print("[WM] nextDecision: ", nextDecision, " for ", req.Method(), " ", req.URL().Path, "\n")
+        if p.cancelled() {
+            break
+        }
+        nextDecision = p.makeDecision(nextDecision)
+    }
+    return true
+}
+
+// cancelled reports whether the request's context is done, either because
+// the client went away or the resource's deadline passed, and if so sends
+// the deadline status when nothing has been written yet.
+func (p *wmDecisionCore) cancelled() bool {
+    err := p.req.Context().Err()
+    if err == nil {
+        return false
+    }
+    if err == context.DeadlineExceeded && p.deadlineCode > 0 {
+        p.log(LOG_LEVEL_WARN, "request deadline exceeded", LogFields{"status": p.deadlineCode})
+        if p.resp.StatusCode() == 0 {
+            p.renderError(p.deadlineCode, errors.New(http.StatusText(p.deadlineCode)))
+        }
+    } else {
+        p.log(LOG_LEVEL_INFO, "request cancelled", LogFields{"error": err})
+    }
+    return true
+}
+
+// finish runs once the response has been written and tells the handler
+// whether the request failed.
+func (p *wmDecisionCore) finish(failed bool) {
+    p.currentDecisionId = wmResponded
+    p.log(LOG_LEVEL_DEBUG, "finishing request", LogFields{"status": p.resp.StatusCode(), "failed": failed})
+    p.finishEncoding()
+    p.resp.Flush()
+    defer func() {
+        if e := recover(); e != nil {
+            p.log(LOG_LEVEL_ERROR, "panic while finishing request", LogFields{"panic": e, "stack": string(debug.Stack())})
+        }
+        if p.trace != nil {
+            p.trace.FinishTrace(p.resp.StatusCode())
+        }
+    }()
+    if finisher, ok := p.resource.(RequestFinisher); ok {
+        var finished bool
+        var httpCode int
+        var httpError error
+        finished, p.req, p.cxt, httpCode, httpError = finisher.FinishRequestWithResult(p.req, p.cxt, failed)
+        p.traceCallback("FinishRequestWithResult", finished, httpCode, httpError)
+    } else {
+        p.handler.FinishRequest(p.req, p.cxt)
+    }
+}
+
+func (p *wmDecisionCore) traceCallback(name string, results ...interface{}) {
+    if p.trace != nil {
+        p.trace.Callback(name, results...)
     }
 }
 
 func (p *wmDecisionCore) makeDecision(decisionId WMDecision) WMDecision {
-    log.Print("[WM] Running decision: ", decisionId, " for ", p.req.Method(), " ", p.req.URL().Path, "\n")
     if decisionId != wmResponded {
         p.decisions = append(p.decisions, int(decisionId))
     }
@@ -71,14 +160,63 @@ func (p *wmDecisionCore) makeDecision(decisionId WMDecision) WMDecision {
 }
 
 func (p *wmDecisionCore) logDecision(decisionId WMDecision) {
-    // TODO add logging
+    if p.trace != nil {
+        p.trace.Decision(decisionId)
+    }
+    p.log(LOG_LEVEL_DEBUG, "running decision", nil)
+}
+
+func (p *wmDecisionCore) log(level LogLevel, msg string, fields LogFields) {
+    if p.logger == nil || !p.logger.Enabled(level) {
+        return
+    }
+    if fields == nil {
+        fields = make(LogFields)
+    }
+    fields["decision"] = p.currentDecisionId.Id()
+    p.logger.Log(level, msg, fields)
+}
+
+// isHalt reports whether a callback's results stop the request, either
+// with a status code or by returning a Halt.
+func (p *wmDecisionCore) isHalt(httpCode int, httpError error) bool {
+    if httpCode > 0 {
+        return true
+    }
+    _, ok := asHalt(httpError)
+    return ok
 }
 
 func (p *wmDecisionCore) writeHaltOrError(httpCode int, httpError error) {
-    p.resp.WriteHeader(httpCode)
-    if httpError != nil {
-        io.WriteString(p.resp, httpError.Error())
+    if halt, ok := asHalt(httpError); ok {
+        if halt.StatusCode > 0 {
+            httpCode = halt.StatusCode
+        }
+        p.updateHttpResponseHeaders(halt.Header)
+        if halt.Body != nil {
+            if len(halt.MediaType) > 0 {
+                p.resp.Header().Set("Content-Type", halt.MediaType)
+            }
+            p.resp.WriteHeader(httpCode)
+            p.resp.Write(halt.Body)
+            return
+        }
     }
+    if httpCode <= 0 {
+        httpCode = http.StatusInternalServerError
+    }
+    p.renderError(httpCode, httpError)
+}
+
+func (p *wmDecisionCore) renderError(httpCode int, httpError error) {
+    var renderer ErrorRenderer
+    if p.wm != nil {
+        renderer = p.wm.errorRenderer
+    }
+    if renderer == nil {
+        renderer = NewNegotiatingErrorRenderer()
+    }
+    renderer.RenderError(p.req, p.resp, httpCode, httpError)
 }
 
 func (p *wmDecisionCore) decision(decisionId WMDecision) WMDecision {
@@ -220,7 +358,7 @@ func (p *wmDecisionCore) doV3b13b() WMDecision {
     var httpError error
     if available, p.req, p.cxt, httpCode, httpError = p.handler.ServiceAvailable(p.req, p.cxt); available {
         return v3b12
-    } else if httpCode > 0 {
+    } else if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -248,7 +386,7 @@ func (p *wmDecisionCore) doV3b11() WMDecision {
     if tooLong, p.req, p.cxt, httpCode, httpError = p.handler.URITooLong(p.req, p.cxt); tooLong {
         p.resp.WriteHeader(http.StatusRequestURITooLong)
         return wmResponded
-    } else if httpCode > 0 {
+    } else if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -262,7 +400,7 @@ func (p *wmDecisionCore) doV3b10() WMDecision {
     var httpError error
     method := p.req.Method()
     allowedMethods, p.req, p.cxt, httpCode, httpError = p.handler.AllowedMethods(p.req, p.cxt)
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -285,7 +423,7 @@ func (p *wmDecisionCore) doV3b9() WMDecision {
     if isMalformed, p.req, p.cxt, httpCode, httpError = p.handler.MalformedRequest(p.req, p.cxt); isMalformed {
         p.resp.WriteHeader(http.StatusBadRequest)
         return wmResponded
-    } else if httpCode > 0 {
+    } else if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -302,7 +440,7 @@ func (p *wmDecisionCore) doV3b8() WMDecision {
         return v3b7
     } else if len(authHeaderString) > 0 {
         p.resp.Header().Set("WWW-Authenticate", authHeaderString)
-    } else if httpCode > 0 {
+    } else if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -318,13 +456,53 @@ func (p *wmDecisionCore) doV3b7() WMDecision {
     if forbidden, p.req, p.cxt, httpCode, httpError = p.handler.Forbidden(p.req, p.cxt); forbidden {
         p.resp.WriteHeader(http.StatusForbidden)
         return wmResponded
-    } else if httpCode > 0 {
+    } else if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
+    if webSocketHandler := p.webSocketHandler(); webSocketHandler != nil && isWebSocketUpgrade(p.req) {
+        p.handleWebSocket(webSocketHandler)
+        return wmResponded
+    }
     return v3b6
 }
 
+// webSocketHandler returns the resource as a WebSocketHandler, or nil if it
+// does not accept WebSocket connections.
+func (p *wmDecisionCore) webSocketHandler() WebSocketHandler {
+    handler, ok := p.resource.(WebSocketHandler)
+    if !ok {
+        return nil
+    }
+    if acceptor, ok := p.resource.(WebSocketAcceptor); ok && !acceptor.AcceptsWebSockets() {
+        return nil
+    }
+    return handler
+}
+
+// handleWebSocket upgrades the connection and hands it to handler, closing
+// it once handler returns.
+func (p *wmDecisionCore) handleWebSocket(handler WebSocketHandler) {
+    var subprotocol string
+    offered := headerTokens(p.req.Header(), "Sec-WebSocket-Protocol")
+    if chooser, ok := p.resource.(WebSocketProtocolChooser); ok && len(offered) > 0 {
+        subprotocol = chooser.ChooseWebSocketProtocol(p.req, p.cxt, offered)
+    }
+    conn, httpCode, httpError := acceptWebSocket(p.req, p.resp, subprotocol)
+    if conn == nil {
+        if p.resp.StatusCode() == 0 {
+            p.writeHaltOrError(httpCode, httpError)
+        } else {
+            p.log(LOG_LEVEL_WARN, "websocket handshake failed", LogFields{"error": httpError})
+        }
+        return
+    }
+    p.log(LOG_LEVEL_DEBUG, "upgraded to websocket", LogFields{"subprotocol": subprotocol})
+    p.traceCallback("HandleWebSocket", subprotocol)
+    defer conn.Close(WEBSOCKET_CLOSE_NORMAL, "")
+    handler.HandleWebSocket(p.req, p.cxt, conn)
+}
+
 // Okay Content-* Headers?
 func (p *wmDecisionCore) doV3b6() WMDecision {
     var isValid bool
@@ -332,7 +510,7 @@ func (p *wmDecisionCore) doV3b6() WMDecision {
     var httpError error
     if isValid, p.req, p.cxt, httpCode, httpError = p.handler.ValidContentHeaders(p.req, p.cxt); isValid {
         return v3b5
-    } else if httpCode > 0 {
+    } else if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -347,7 +525,7 @@ func (p *wmDecisionCore) doV3b5() WMDecision {
     var httpError error
     if isKnown, p.req, p.cxt, httpCode, httpError = p.handler.KnownContentType(p.req, p.cxt); isKnown {
         return v3b4
-    } else if httpCode > 0 {
+    } else if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -361,8 +539,11 @@ func (p *wmDecisionCore) doV3b4() WMDecision {
     var httpCode int
     var httpError error
     if isValid, p.req, p.cxt, httpCode, httpError = p.handler.ValidEntityLength(p.req, p.cxt); isValid {
+        if !p.decodeRequestBody() || !p.decodeRequestCharset() {
+            return wmResponded
+        }
         return v3b3
-    } else if httpCode > 0 {
+    } else if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -377,7 +558,7 @@ func (p *wmDecisionCore) doV3b3() WMDecision {
     var httpError error
     if p.req.Method() == OPTIONS {
         arr, p.req, p.cxt, httpCode, httpError = p.handler.Options(p.req, p.cxt)
-        if httpCode > 0 {
+        if p.isHalt(httpCode, httpError) {
             p.writeHaltOrError(httpCode, httpError)
             return wmResponded
         }
@@ -395,17 +576,16 @@ func (p *wmDecisionCore) doV3c3() WMDecision {
     var provided []MediaTypeHandler
     var httpCode int
     var httpError error
+    p.applyFormatOverride()
     arr, ok := p.req.Header()["Accept"]
     if !ok || len(arr) <= 0 {
         provided, p.req, p.cxt, httpCode, httpError = p.handler.ContentTypesProvided(p.req, p.cxt)
-        if httpCode > 0 {
+        if p.isHalt(httpCode, httpError) {
             p.writeHaltOrError(httpCode, httpError)
             return wmResponded
         }
         if len(provided) >= 1 {
             p.mediaTypeOutputHandler = provided[0]
-            p.resp.Header().Set("TCN", "choice")
-            p.resp.Header().Set("Vary", "negotiate,accept")
         } else {
             // TODO Default is "text/html" and to_html
             p.mediaTypeOutputHandler = provided[0]
@@ -421,6 +601,20 @@ func (p *wmDecisionCore) doV3c3() WMDecision {
     return v3c4
 }
 
+// applyFormatOverride replaces the Accept header with the media type the
+// URL asked for, if FormatOverrides matched it, naming the URL with the
+// extension as the Content-Location.
+func (p *wmDecisionCore) applyFormatOverride() {
+    if p.formatOverride == nil {
+        return
+    }
+    p.log(LOG_LEVEL_DEBUG, "overriding Accept from URL", LogFields{"media_type": p.formatOverride.mediaType, "accept": p.req.Header()["Accept"]})
+    p.req.Header().Set("Accept", p.formatOverride.mediaType)
+    if len(p.formatOverride.contentLocation) > 0 {
+        p.resp.Header().Set("Content-Location", p.formatOverride.contentLocation)
+    }
+}
+
 // Acceptable media type available?
 func (p *wmDecisionCore) doV3c4() WMDecision {
     var provided []MediaTypeHandler
@@ -428,7 +622,7 @@ func (p *wmDecisionCore) doV3c4() WMDecision {
     var httpError error
     arr, _ := p.req.Header()["Accept"]
     provided, p.req, p.cxt, httpCode, httpError = p.handler.ContentTypesProvided(p.req, p.cxt)
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -436,8 +630,8 @@ func (p *wmDecisionCore) doV3c4() WMDecision {
     for i, mth := range provided {
         mediaTypesProvided[i] = mth.MediaTypeOutput()
     }
-    bestMatch := chooseMediaType(mediaTypesProvided, arr[0])
-    log.Print("[WDC]: Chose Media Type \"", bestMatch, "\" with accept ", arr, " and provided ", mediaTypesProvided)
+    bestMatch := negotiation.MediaType(mediaTypesProvided, strings.Join(arr, ","))
+    p.log(LOG_LEVEL_DEBUG, "chose media type", LogFields{"media_type": bestMatch, "accept": arr, "provided": mediaTypesProvided})
     if len(bestMatch) > 0 {
         mediaType := bestMatch
         p.resp.Header().Set("Content-Type", mediaType)
@@ -454,7 +648,7 @@ func (p *wmDecisionCore) doV3c4() WMDecision {
         }
         return v3d4
     }
-    p.resp.WriteHeader(http.StatusNotAcceptable)
+    p.writeRepresentations(http.StatusNotAcceptable, "No available media type is acceptable.")
     return wmResponded
 }
 
@@ -463,6 +657,14 @@ func (p *wmDecisionCore) doV3d4() WMDecision {
     if arr, ok := p.req.Header()["Accept-Language"]; ok && len(arr) > 0 {
         return v3d5
     }
+    languages, httpCode, httpError := p.languagesProvided()
+    if p.isHalt(httpCode, httpError) {
+        p.writeHaltOrError(httpCode, httpError)
+        return wmResponded
+    }
+    if len(languages) > 0 {
+        p.setLanguage(languages[0])
+    }
     return v3e5
 }
 
@@ -472,18 +674,53 @@ func (p *wmDecisionCore) doV3d5() WMDecision {
     var httpCode int
     var httpError error
     arr, _ := p.req.Header()["Accept-Language"]
+    languages, httpCode, httpError := p.languagesProvided()
+    if p.isHalt(httpCode, httpError) {
+        p.writeHaltOrError(httpCode, httpError)
+        return wmResponded
+    }
+    if len(languages) > 0 {
+        language := chooseLanguage(languages, strings.Join(arr, ","))
+        p.log(LOG_LEVEL_DEBUG, "chose language", LogFields{"language": language, "accept_language": arr, "provided": languages})
+        if len(language) == 0 {
+            p.writeRepresentations(http.StatusNotAcceptable, "No available language is acceptable.")
+            return wmResponded
+        }
+        p.setLanguage(language)
+        return v3e5
+    }
     hasLanguage, p.req, p.cxt, httpCode, httpError = p.handler.IsLanguageAvailable(arr, p.req, p.cxt)
     if hasLanguage {
-        p.language = arr[0]
+        p.language = preferredLanguageRange(strings.Join(arr, ","))
         return v3e5
-    } else if httpCode > 0 {
+    } else if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
-    p.resp.WriteHeader(http.StatusNotAcceptable)
+    p.writeRepresentations(http.StatusNotAcceptable, "No available language is acceptable.")
     return wmResponded
 }
 
+// languagesProvided calls LanguagesProvided if the resource is a
+// LanguagesProvider.
+func (p *wmDecisionCore) languagesProvided() ([]string, int, error) {
+    provider, ok := p.resource.(LanguagesProvider)
+    if !ok {
+        return nil, 0, nil
+    }
+    var languages []string
+    var httpCode int
+    var httpError error
+    languages, p.req, p.cxt, httpCode, httpError = provider.LanguagesProvided(p.req, p.cxt)
+    p.traceCallback("LanguagesProvided", languages, httpCode, httpError)
+    return languages, httpCode, httpError
+}
+
+func (p *wmDecisionCore) setLanguage(language string) {
+    p.language = language
+    p.resp.Header().Set("Content-Language", language)
+}
+
 // Accept-Charset exists?
 func (p *wmDecisionCore) doV3e5() WMDecision {
     if arr, ok := p.req.Header()["Accept-Charset"]; ok && len(arr) > 0 {
@@ -495,13 +732,12 @@ func (p *wmDecisionCore) doV3e5() WMDecision {
     arr := make([]string, 1)
     arr[0] = "*"
     handlers, p.req, p.cxt, httpCode, httpError = p.handler.CharsetsProvided(arr, p.req, p.cxt)
-    log.Print("Charsets Provided: ", handlers, " ", httpCode, " ", httpError, "\n")
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
     if len(handlers) == 0 {
-        p.resp.WriteHeader(http.StatusNotAcceptable)
+        p.writeRepresentations(http.StatusNotAcceptable, "No charset is available.")
         return wmResponded
     }
     p.charset = handlers[0].Charset()
@@ -516,16 +752,17 @@ func (p *wmDecisionCore) doV3e6() WMDecision {
     var httpCode int
     var httpError error
     handlers, p.req, p.cxt, httpCode, httpError = p.handler.CharsetsProvided(arr, p.req, p.cxt)
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
-    if len(handlers) == 0 {
-        p.resp.WriteHeader(http.StatusNotAcceptable)
+    handler := chooseCharsetHandler(handlers, strings.Join(arr, ","))
+    if handler == nil {
+        p.writeRepresentations(http.StatusNotAcceptable, "No available charset is acceptable.")
         return wmResponded
     }
-    p.charset = handlers[0].Charset()
-    p.charsetOutputHandler = handlers[0]
+    p.charset = handler.Charset()
+    p.charsetOutputHandler = handler
     return v3f6
 }
 
@@ -545,67 +782,55 @@ func (p *wmDecisionCore) doV3f6() WMDecision {
     if arr, ok := p.req.Header()["Accept-Encoding"]; ok && len(arr) > 0 {
         return v3f7
     }
-    arr := []string{"identity;q=1.0,*;q=0.5"}
-    var handlers []EncodingHandler
-    var httpCode int
-    var httpError error
-    handlers, p.req, p.cxt, httpCode, httpError = p.handler.EncodingsProvided(arr, p.req, p.cxt)
-    if len(handlers) > 0 {
-        p.encodingOutputHandler = handlers[0]
-        p.encoding = handlers[0].Encoding()
-        return v3g7
-    }
-    if httpCode > 0 {
+    // any coding is acceptable but identity is preferred
+    handler, httpCode, httpError := p.chooseEncoding("identity;q=1.0,*;q=0.5")
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
-    p.resp.WriteHeader(http.StatusNotAcceptable)
-    return wmResponded
+    if handler == nil {
+        p.writeRepresentations(http.StatusNotAcceptable, "No available content coding is acceptable.")
+        return wmResponded
+    }
     return v3g7
 }
 
 // Acceptable Encoding available?
 func (p *wmDecisionCore) doV3f7() WMDecision {
-    if len(p.chooseEncoding()) == 0 {
-        p.resp.WriteHeader(http.StatusNotAcceptable)
+    acceptEncoding := strings.Join(p.req.Header()["Accept-Encoding"], ",")
+    if len(strings.TrimSpace(acceptEncoding)) == 0 {
+        // an empty Accept-Encoding asks for no coding at all
+        acceptEncoding = ENCODING_IDENTITY
+    }
+    handler, httpCode, httpError := p.chooseEncoding(acceptEncoding)
+    if p.isHalt(httpCode, httpError) {
+        p.writeHaltOrError(httpCode, httpError)
+        return wmResponded
+    }
+    if handler == nil {
+        p.writeRepresentations(http.StatusNotAcceptable, "No available content coding is acceptable.")
         return wmResponded
     }
     return v3g7
-    /*
-       arr, _ := p.req.Header()["Accept-Encoding"]
-       var handlers []EncodingHandler
-       var httpCode int
-       var httpError os.Error
-       handlers, p.req, p.cxt, httpCode, httpError = p.handler.EncodingsProvided(arr, p.req, p.cxt)
-       log.Print("[WDC]: Accept-Encoding: \"", arr, "\" vs handlers: ", handlers)
-       if len(handlers) > 0 {
-         p.encodingOutputHandler = handlers[0]
-         p.encoding = handlers[0].Encoding()
-         return v3g7
-       }
-       if httpCode > 0 {
-         p.writeHaltOrError(httpCode, httpError)
-         return wmResponded
-       }
-       p.resp.WriteHeader(406)
-       return wmResponded
-    */
 }
 
 // Resource exists?
 func (p *wmDecisionCore) doV3g7() WMDecision {
-    variances := p.variances()
-    if len(variances) > 0 {
-        p.resp.Header().Set("Vary", strings.Join(variances, ", "))
-    }
     var exists bool
+    var variants []Variant
     var httpCode int
     var httpError error
+    variants, httpCode, httpError = p.variantsProvided()
+    if p.isHalt(httpCode, httpError) {
+        p.writeHaltOrError(httpCode, httpError)
+        return wmResponded
+    }
+    p.setVariantHeaders(variants)
     exists, p.req, p.cxt, httpCode, httpError = p.handler.ResourceExists(p.req, p.cxt)
     if exists {
         return v3g8
     }
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -622,30 +847,32 @@ func (p *wmDecisionCore) doV3g8() WMDecision {
 
 // If-Match: * exists
 func (p *wmDecisionCore) doV3g9() WMDecision {
-    if arr, ok := p.req.Header()["If-Match"]; ok && len(arr) > 0 && arr[0] == "*" {
+    if etagListHasAny(p.req.Header()["If-Match"]) {
         return v3h10
     }
     return v3g11
 }
 
 // ETag in If-Match
+// If-Match uses the strong comparison, so a weak ETag never matches.
 func (p *wmDecisionCore) doV3g11() WMDecision {
-    if arr, ok := p.req.Header()["If-Match"]; ok && len(arr) > 0 {
-        etag, err := strconv.Unquote(arr[0])
-        if err != nil {
-            etag = arr[0]
-        }
+    if etags, _ := parseETagList(p.req.Header()["If-Match"]); len(etags) > 0 {
         var generatedEtag string
         var httpCode int
         var httpError error
         generatedEtag, p.req, p.cxt, httpCode, httpError = p.handler.GenerateETag(p.req, p.cxt)
-        if generatedEtag == etag {
-            return v3h10
-        }
-        if httpCode > 0 {
+        if p.isHalt(httpCode, httpError) {
             p.writeHaltOrError(httpCode, httpError)
             return wmResponded
         }
+        if len(generatedEtag) > 0 {
+            current := ParseETag(generatedEtag)
+            for _, etag := range etags {
+                if etag.StrongMatch(current) {
+                    return v3h10
+                }
+            }
+        }
     }
     p.resp.WriteHeader(http.StatusPreconditionFailed)
     return wmResponded
@@ -653,7 +880,7 @@ func (p *wmDecisionCore) doV3g11() WMDecision {
 
 // If-Match: * exists
 func (p *wmDecisionCore) doV3h7() WMDecision {
-    if arr, ok := p.req.Header()["If-Match"]; ok && len(arr) > 0 && arr[0] == "*" {
+    if etagListHasAny(p.req.Header()["If-Match"]) {
         p.resp.WriteHeader(http.StatusPreconditionFailed)
         return wmResponded
     }
@@ -686,14 +913,11 @@ func (p *wmDecisionCore) doV3h12() WMDecision {
     var httpCode int
     var httpError error
     lastModified, p.req, p.cxt, httpCode, httpError = p.handler.LastModified(p.req, p.cxt)
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
     t := p.unmodifiedSince
-    if !t.IsZero() && !lastModified.IsZero() {
-        log.Print("[WMC]: comparing Last-Modified internal: ", t.Unix(), " vs. received from client ", lastModified.Unix())
-    }
     if t != lastModified && !t.IsZero() && !lastModified.IsZero() && lastModified.Unix() > t.Unix() {
         p.resp.WriteHeader(http.StatusPreconditionFailed)
         return wmResponded
@@ -707,7 +931,7 @@ func (p *wmDecisionCore) doV3i4() WMDecision {
     var httpCode int
     var httpError error
     uri, p.req, p.cxt, httpCode, httpError = p.handler.MovedPermanently(p.req, p.cxt)
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -737,7 +961,7 @@ func (p *wmDecisionCore) doV3i12() WMDecision {
 
 // If-None-Match: * exists
 func (p *wmDecisionCore) doV3i13() WMDecision {
-    if arr, ok := p.req.Header()["If-None-Match"]; ok && len(arr) > 0 && arr[0] == "*" {
+    if etagListHasAny(p.req.Header()["If-None-Match"]) {
         return v3j18
     }
     return v3k13
@@ -765,7 +989,7 @@ func (p *wmDecisionCore) doV3k5() WMDecision {
         p.resp.WriteHeader(http.StatusMovedPermanently)
         return wmResponded
     }
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -781,7 +1005,7 @@ func (p *wmDecisionCore) doV3k7() WMDecision {
     if previouslyExisted {
         return v3k5
     }
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -789,23 +1013,25 @@ func (p *wmDecisionCore) doV3k7() WMDecision {
 }
 
 // ETag in If-None-Match
+// If-None-Match uses the weak comparison.
 func (p *wmDecisionCore) doV3k13() WMDecision {
-    if arr, ok := p.req.Header()["If-None-Match"]; ok && len(arr) > 0 {
-        etag, err := strconv.Unquote(arr[0])
-        if err != nil {
-            etag = arr[0]
-        }
+    if etags, _ := parseETagList(p.req.Header()["If-None-Match"]); len(etags) > 0 {
         var generatedEtag string
         var httpCode int
         var httpError error
         generatedEtag, p.req, p.cxt, httpCode, httpError = p.handler.GenerateETag(p.req, p.cxt)
-        if generatedEtag == etag {
-            return v3j18
-        }
-        if httpCode > 0 {
+        if p.isHalt(httpCode, httpError) {
             p.writeHaltOrError(httpCode, httpError)
             return wmResponded
         }
+        if len(generatedEtag) > 0 {
+            current := ParseETag(generatedEtag)
+            for _, etag := range etags {
+                if etag.WeakMatch(current) {
+                    return v3j18
+                }
+            }
+        }
     }
     return v3l13
 }
@@ -821,7 +1047,7 @@ func (p *wmDecisionCore) doV3l5() WMDecision {
         p.resp.WriteHeader(http.StatusTemporaryRedirect)
         return wmResponded
     }
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -833,9 +1059,7 @@ func (p *wmDecisionCore) doV3l7() WMDecision {
     if p.req.Method() == POST {
         return v3m7
     }
-    log.Print("Writing Header 404\n")
     p.resp.WriteHeader(http.StatusNotFound)
-    log.Print("Done Writing Header 404\n")
     return wmResponded
 }
 
@@ -876,7 +1100,7 @@ func (p *wmDecisionCore) doV3l17() WMDecision {
     var httpCode int
     var httpError error
     lastModified, p.req, p.cxt, httpCode, httpError = p.handler.LastModified(p.req, p.cxt)
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -902,7 +1126,7 @@ func (p *wmDecisionCore) doV3m7() WMDecision {
     var httpCode int
     var httpError error
     allowMissingPost, p.req, p.cxt, httpCode, httpError = p.handler.AllowMissingPost(p.req, p.cxt)
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -928,7 +1152,7 @@ func (p *wmDecisionCore) doV3m20() WMDecision {
     var httpCode int
     var httpError error
     ok, p.req, p.cxt, httpCode, httpError = p.handler.DeleteResource(p.req, p.cxt)
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -945,7 +1169,7 @@ func (p *wmDecisionCore) doV3m20b() WMDecision {
     var httpCode int
     var httpError error
     completed, p.req, p.cxt, httpCode, httpError = p.handler.DeleteCompleted(p.req, p.cxt)
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -962,7 +1186,7 @@ func (p *wmDecisionCore) doV3n5() WMDecision {
     var httpCode int
     var httpError error
     allowed, p.req, p.cxt, httpCode, httpError = p.handler.AllowMissingPost(p.req, p.cxt)
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -981,25 +1205,25 @@ func (p *wmDecisionCore) doV3n11() WMDecision {
     var httpHeaders http.Header
     var writerTo io.WriterTo
     postIsCreate, p.req, p.cxt, httpCode, httpError = p.handler.PostIsCreate(p.req, p.cxt)
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
     if postIsCreate {
-        log.Print("[WM]: v3n11: Creating Path\n")
         _, p.req, p.cxt, httpCode, httpError = p.handler.CreatePath(p.req, p.cxt)
-        if httpCode > 0 {
+        if p.isHalt(httpCode, httpError) {
             p.writeHaltOrError(httpCode, httpError)
             return wmResponded
         }
-        log.Print("[WM]: v3n11: Running Accept Helper\n")
         if p.runAcceptHelper() {
             return wmResponded
         }
     } else {
-        log.Print("[WM]: v3n11: Running Process Post\n")
         p.req, p.cxt, httpCode, httpHeaders, writerTo, httpError = p.handler.ProcessPost(p.req, p.cxt)
-        if httpCode > 0 {
+        if p.requestBodyTooLarge() {
+            return wmResponded
+        }
+        if p.isHalt(httpCode, httpError) {
             p.updateHttpResponseHeaders(httpHeaders)
             if httpError != nil {
                 p.writeHaltOrError(httpCode, httpError)
@@ -1014,12 +1238,10 @@ func (p *wmDecisionCore) doV3n11() WMDecision {
         // TODO Aalok check what should be done here
         //p.resp.WriteHeader(n)
         //log.Print("Wrote Header but may not return wmResponded in doV3n11()\n")
-        //p.encodeBodyIfSet()
     }
-    log.Print("[WM]: v3n11: Running Response is Redirect?\n")
     var respIsRedirect bool
     respIsRedirect, p.req, p.cxt, httpCode, httpError = p.handler.ResponseIsRedirect(p.req, p.cxt)
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -1050,7 +1272,7 @@ func (p *wmDecisionCore) doV3o14() WMDecision {
     var httpError error
     // TODO v3n11
     isConflict, p.req, p.cxt, httpCode, httpError = p.handler.IsConflict(p.req, p.cxt)
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -1087,12 +1309,12 @@ func (p *wmDecisionCore) doV3o18() WMDecision {
         var httpError error
         var lastModified, expires time.Time
         etag, p.req, p.cxt, httpCode, httpError = p.handler.GenerateETag(p.req, p.cxt)
-        if httpCode > 0 {
+        if p.isHalt(httpCode, httpError) {
             p.writeHaltOrError(httpCode, httpError)
             return wmResponded
         }
         if len(etag) > 0 {
-            p.resp.Header().Set("ETag", strconv.Quote(etag))
+            p.resp.Header().Set("ETag", ParseETag(etag).String())
         }
         lastModified, p.req, p.cxt, httpCode, httpError = p.handler.LastModified(p.req, p.cxt)
         if !lastModified.IsZero() {
@@ -1102,37 +1324,168 @@ func (p *wmDecisionCore) doV3o18() WMDecision {
         if !expires.IsZero() {
             p.resp.Header().Set("Expires", expires.Format(http.TimeFormat))
         }
+        if method == GET {
+            p.evaluateIfRange(etag, lastModified)
+        }
+        if p.cancelled() {
+            return wmResponded
+        }
         if p.mediaTypeOutputHandler != nil {
-            p.mediaTypeOutputHandler.MediaTypeHandleOutputTo(p.req, p.cxt, p.resp, p.resp)
+            p.writeBody(p.mediaTypeOutputHandler)
             p.resp.Flush()
             return wmResponded
         } else {
             var provided []MediaTypeHandler
             provided, p.req, p.cxt, httpCode, httpError = p.handler.ContentTypesProvided(p.req, p.cxt)
-            if httpCode > 0 {
+            if p.isHalt(httpCode, httpError) {
                 p.writeHaltOrError(httpCode, httpError)
                 return wmResponded
             }
             if len(provided) > 0 && len(provided) == 1 {
-                provided[0].MediaTypeHandleOutputTo(p.req, p.cxt, p.resp, p.resp)
+                p.writeBody(provided[0])
                 return wmResponded
             }
         }
     }
     multipleChoices, httpHeaders, p.req, p.cxt, httpCode, httpError = p.handler.MultipleChoices(p.req, p.cxt)
     p.updateHttpResponseHeaders(httpHeaders)
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
     if multipleChoices {
-        p.resp.WriteHeader(http.StatusMultipleChoices)
+        p.writeRepresentations(http.StatusMultipleChoices, "Multiple representations are available.")
         return wmResponded
     }
     p.resp.WriteHeader(http.StatusOK)
     return wmResponded
 }
 
+// bufferedMediaTypeHandler is implemented by MediaTypeHandlers that produce
+// the whole body up front, so that an error can still be rendered.
+type bufferedMediaTypeHandler interface {
+    mediaTypeOutputBody(req Request, cxt Context) ([]byte, error)
+}
+
+// writeBody writes the representation produced by handler, in the
+// negotiated charset, serving ranges itself when handler is a
+// SeekableMediaTypeHandler.
+func (p *wmDecisionCore) writeBody(handler MediaTypeHandler) {
+    buffered, isBuffered := handler.(bufferedMediaTypeHandler)
+    var body []byte
+    if isBuffered {
+        var err error
+        if body, err = buffered.mediaTypeOutputBody(p.req, p.cxt); err != nil {
+            p.resp.Header().Del("ETag")
+            p.resp.Header().Del("Last-Modified")
+            p.writeHaltOrError(builderErrorCode(err), err)
+            return
+        }
+    }
+    var content io.ReadSeeker
+    size := int64(-1)
+    if isBuffered {
+        size = int64(len(body))
+    } else if seekable, ok := handler.(SeekableMediaTypeHandler); ok {
+        var err error
+        if content, size, err = seekable.MediaTypeOutputContent(p.req, p.cxt); err != nil {
+            p.writeHaltOrError(0, err)
+            return
+        }
+        if closer, ok := content.(io.Closer); ok {
+            defer closer.Close()
+        }
+        if content == nil {
+            size = -1
+        }
+    }
+    p.startEncoding(size)
+    defer p.finishEncoding()
+    writer := io.Writer(p.resp)
+    if encoder, ok := p.charsetOutputHandler.(CharsetEncodingHandler); ok {
+        if w := encoder.CharsetEncoder(p.req, p.cxt, p.resp); w != nil {
+            writer = w
+        }
+    }
+    if writer != io.Writer(p.resp) {
+        if closer, ok := writer.(io.Closer); ok {
+            defer closer.Close()
+        }
+    }
+    if content != nil {
+        serveContent(p.req, p.resp, writer, content, size, http.StatusOK)
+        return
+    }
+    if isBuffered {
+        if p.resp.StatusCode() == 0 {
+            p.resp.WriteHeader(http.StatusOK)
+        }
+        writer.Write(body)
+        return
+    }
+    handler.MediaTypeHandleOutputTo(p.req, p.cxt, writer, p.resp)
+}
+
+// startEncoding puts the negotiated encoder, if any, between the body and
+// the response.  size is the length of the body, or -1 if it is not known.
+// The encoder is left out if the CompressionPolicy rules it out already, so
+// that a body served without one can still honour Range; with one, whether
+// a short streamed body is encoded is decided once MinSize bytes are written.
+func (p *wmDecisionCore) startEncoding(size int64) {
+    if p.encodingOutputHandler == nil || len(p.encoding) == 0 || p.encoding == ENCODING_IDENTITY {
+        return
+    }
+    if _, ok := p.resp.(*encodingResponseWriter); ok {
+        return
+    }
+    policy := NewDefaultCompressionPolicy()
+    if p.wm != nil && p.wm.compressionPolicy != nil {
+        policy = p.wm.compressionPolicy
+    }
+    headers := p.resp.Header()
+    if len(headers.Get("Content-Encoding")) > 0 || !policy.AllowsMediaType(headers.Get("Content-Type")) {
+        return
+    }
+    if size >= 0 && size < int64(policy.MinSize) {
+        return
+    }
+    p.resp = newEncodingResponseWriter(p.resp, p.req, p.cxt, p.encodingOutputHandler, policy)
+}
+
+// finishEncoding flushes and closes the encoder started by startEncoding.
+func (p *wmDecisionCore) finishEncoding() {
+    if w, ok := p.resp.(*encodingResponseWriter); ok {
+        if err := w.Close(); err != nil {
+            p.log(LOG_LEVEL_WARN, "error closing encoder", LogFields{"encoding": p.encoding, "error": err})
+        }
+        p.resp = w.ResponseWriter
+    }
+}
+
+// evaluateIfRange drops the Range header unless the If-Range validator
+// matches the current representation, so the full representation is sent
+// instead of a range of one that has changed.  An entity tag must match
+// strongly and a date must equal Last-Modified exactly.
+func (p *wmDecisionCore) evaluateIfRange(etag string, lastModified time.Time) {
+    headers := p.req.Header()
+    ifRange := strings.TrimSpace(headers.Get("If-Range"))
+    if len(ifRange) == 0 || len(headers.Get("Range")) == 0 {
+        return
+    }
+    matched := false
+    if strings.HasSuffix(ifRange, "\"") {
+        if len(etag) > 0 {
+            matched = ParseETag(ifRange).StrongMatch(ParseETag(etag))
+        }
+    } else if date, err := http.ParseTime(ifRange); err == nil && !lastModified.IsZero() {
+        matched = date.Equal(lastModified.Truncate(time.Second))
+    }
+    if !matched {
+        p.log(LOG_LEVEL_DEBUG, "If-Range did not match, sending full representation", LogFields{"if_range": ifRange})
+        headers.Del("Range")
+    }
+}
+
 // Redirect
 func (p *wmDecisionCore) doV3o20() WMDecision {
     if p.handler.HasRespBody(p.req, p.cxt) {
@@ -1149,8 +1502,7 @@ func (p *wmDecisionCore) doV3p3() WMDecision {
     var httpError error
     // TOOD v3n11
     isConflict, p.req, p.cxt, httpCode, httpError = p.handler.IsConflict(p.req, p.cxt)
-    log.Print("[WDC]: V3P3: isConflict", isConflict, ", code: ", httpCode, ", error: ", httpError)
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         p.writeHaltOrError(httpCode, httpError)
         return wmResponded
     }
@@ -1190,8 +1542,132 @@ func (p *wmDecisionCore) updateHttpResponseHeaders(httpHeaders http.Header) {
     }
 }
 
+// decodeRequestBody undoes the request's Content-Encoding, once the encoded
+// length has been validated, so that every handler reads the body as it was
+// before encoding.  It responds 415 with the codings understood if one is
+// not, and returns false if it has responded.
+func (p *wmDecisionCore) decodeRequestBody() bool {
+    codings := headerTokens(p.req.Header(), "Content-Encoding")
+    if len(codings) == 0 || p.req.Body() == nil || p.req.ContentLength() == 0 {
+        return true
+    }
+    limits := NewDefaultDecompressionLimits()
+    if p.wm != nil && p.wm.decompressionLimits != nil {
+        limits = p.wm.decompressionLimits
+    }
+    body := &decodedBody{raw: &countingReader{reader: p.req.Body()}, body: p.req.Body(), limits: limits}
+    body.reader = body.raw
+    registry := DefaultEncodingRegistry()
+    // codings are listed in the order they were applied
+    for i := len(codings) - 1; i >= 0; i-- {
+        if canonicalEncoding(codings[i]) == ENCODING_IDENTITY {
+            continue
+        }
+        handler, ok := registry.Lookup(codings[i])
+        if !ok {
+            p.log(LOG_LEVEL_INFO, "unsupported request Content-Encoding", LogFields{"encoding": codings[i]})
+            var accepted []string
+            for _, h := range registry.Handlers() {
+                accepted = append(accepted, h.Encoding())
+            }
+            halt := NewHalt(http.StatusUnsupportedMediaType, errors.New("unsupported Content-Encoding: "+codings[i]))
+            p.writeHaltOrError(0, halt.WithHeader("Accept-Encoding", strings.Join(accepted, ", ")))
+            return false
+        }
+        reader := handler.Decoder(p.req, p.cxt, body.reader)
+        if reader == nil {
+            p.writeHaltOrError(http.StatusBadRequest, errors.New("request body is not valid "+handler.Encoding()))
+            return false
+        }
+        if closer, ok := reader.(io.Closer); ok {
+            body.closers = append(body.closers, closer)
+        }
+        body.reader = reader
+    }
+    if body.reader == io.Reader(body.raw) {
+        return true
+    }
+    p.requestBody = body
+    p.req = p.req.WithBody(body)
+    return true
+}
+
+// decodeRequestCharset converts a request body declared with a charset
+// other than UTF-8 to UTF-8, using the resource's CharsetHandler for it if
+// there is one and otherwise a StandardCharsetHandler.  The Content-Type is
+// updated to match.  It responds 415 for a charset neither can decode and
+// returns false if it has responded.
+func (p *wmDecisionCore) decodeRequestCharset() bool {
+    if p.req.Body() == nil || p.req.ContentLength() == 0 {
+        return true
+    }
+    mediaType, params, err := mime.ParseMediaType(p.req.Header().Get("Content-Type"))
+    if err != nil {
+        return true
+    }
+    charset, ok := params["charset"]
+    if !ok || canonicalCharset(charset) == CHARSET_UTF_8 {
+        return true
+    }
+    var provided []CharsetHandler
+    var httpCode int
+    var httpError error
+    provided, p.req, p.cxt, httpCode, httpError = p.handler.CharsetsProvided([]string{charset}, p.req, p.cxt)
+    if p.isHalt(httpCode, httpError) {
+        p.writeHaltOrError(httpCode, httpError)
+        return false
+    }
+    var handler CharsetHandler
+    for _, h := range provided {
+        if canonicalCharset(h.Charset()) == canonicalCharset(charset) {
+            handler = h
+            break
+        }
+    }
+    if handler == nil && IsSupportedCharset(charset) {
+        handler = NewStandardCharsetHandler(charset)
+    }
+    if handler == nil {
+        p.log(LOG_LEVEL_INFO, "unsupported request charset", LogFields{"charset": charset})
+        p.writeHaltOrError(http.StatusUnsupportedMediaType, errors.New("unsupported charset: "+charset))
+        return false
+    }
+    p.charsetInputHandler = handler
+    body := p.req.Body()
+    reader := handler.CharsetConverter(p.req, p.cxt, body)
+    if reader == nil || reader == io.Reader(body) {
+        return true
+    }
+    rc, ok := reader.(io.ReadCloser)
+    if !ok {
+        rc = readCloser{Reader: reader, Closer: body}
+    }
+    params["charset"] = CHARSET_UTF_8
+    p.req = p.req.WithBody(rc)
+    p.req.Header().Set("Content-Type", mime.FormatMediaType(mediaType, params))
+    return true
+}
+
+// requestBodyTooLarge responds 413 if reading the decoded request body broke
+// the DecompressionLimits, whatever the handler made of the error.
+func (p *wmDecisionCore) requestBodyTooLarge() bool {
+    if p.requestBody == nil || p.requestBody.err == nil {
+        return false
+    }
+    p.log(LOG_LEVEL_INFO, "decoded request body too large", LogFields{"decoded": p.requestBody.n, "encoded": p.requestBody.raw.n})
+    p.writeHaltOrError(0, p.requestBody.err)
+    return true
+}
+
 func (p *wmDecisionCore) runAcceptHelper() (haveResponded bool) {
-    httpCode, httpHeaders, writerTo := p.acceptHelper()
+    httpCode, httpHeaders, writerTo, httpError := p.acceptHelper()
+    if p.requestBodyTooLarge() {
+        return true
+    }
+    if httpError != nil {
+        p.writeHaltOrError(httpCode, httpError)
+        return true
+    }
     if httpCode > 0 {
         p.updateHttpResponseHeaders(httpHeaders)
         p.resp.WriteHeader(httpCode)
@@ -1204,7 +1680,13 @@ func (p *wmDecisionCore) runAcceptHelper() (haveResponded bool) {
     return
 }
 
-func (p *wmDecisionCore) acceptHelper() (int, http.Header, io.WriterTo) {
+// bufferedMediaTypeInputHandler is implemented by MediaTypeInputHandlers
+// that report failure as an error, so that it can be rendered.
+type bufferedMediaTypeInputHandler interface {
+    mediaTypeInputFrom(req Request, cxt Context) error
+}
+
+func (p *wmDecisionCore) acceptHelper() (int, http.Header, io.WriterTo, error) {
     ct := p.req.Header().Get("Content-Type")
     if len(ct) == 0 {
         ct = MIME_TYPE_OCTET_STREAM
@@ -1215,120 +1697,65 @@ func (p *wmDecisionCore) acceptHelper() (int, http.Header, io.WriterTo) {
     var httpError error
     var writerTo io.WriterTo
     ctAccepted, p.req, p.cxt, httpCode, httpError = p.handler.ContentTypesAccepted(p.req, p.cxt)
-    if httpCode > 0 {
+    if p.isHalt(httpCode, httpError) {
         if httpError != nil {
-            return httpCode, nil, bytes.NewBufferString(httpError.Error())
+            return httpCode, nil, bytes.NewBufferString(httpError.Error()), nil
         } else {
-            return httpCode, nil, nil
+            return httpCode, nil, nil, nil
         }
     }
-    arrLen := len(ctAccepted)
-    arr := make([]string, arrLen)
-    for i := 0; i < arrLen; i++ {
-        arr[i] = ctAccepted[i].MediaTypeInput()
-    }
-    mt := chooseMediaType(arr, ct)
-    acceptArr := splitAcceptString(mt)
-    if len(acceptArr) == 0 {
-        return http.StatusUnsupportedMediaType, nil, nil
-    }
-    for i := 0; i < arrLen; i++ {
-        if arr[i] == mt {
-            log.Print("[AH]: Capturing accepted value of type ", mt)
-            httpCode, httpHeaders, writerTo = ctAccepted[i].MediaTypeHandleInputFrom(p.req, p.cxt)
-            break
+    // the most specific accepted media range wins
+    var handler MediaTypeInputHandler
+    mt := ""
+    specificity := -1
+    for _, h := range ctAccepted {
+        if matches, s := negotiation.MediaRangeMatches(h.MediaTypeInput(), ct); matches && s > specificity {
+            handler, mt, specificity = h, h.MediaTypeInput(), s
         }
     }
-    log.Print("[AH]: Done capturing input stream of type ", mt)
-    return httpCode, httpHeaders, writerTo
-}
-
-func (p *wmDecisionCore) encodeBodyIfSet() bool {
-    if !p.handler.HasRespBody(p.req, p.cxt) {
-        return false
+    if handler == nil {
+        return http.StatusUnsupportedMediaType, nil, nil, nil
     }
-    bodyWriter, _ := p.bodyEncoder(p.resp)
-    p.mediaTypeOutputHandler.MediaTypeHandleOutputTo(p.req, p.cxt, bodyWriter, p.resp)
-    return true
+    if buffered, ok := handler.(bufferedMediaTypeInputHandler); ok {
+        httpError = buffered.mediaTypeInputFrom(p.req, p.cxt)
+        httpCode = builderErrorCode(httpError)
+    } else {
+        httpCode, httpHeaders, writerTo = handler.MediaTypeHandleInputFrom(p.req, p.cxt)
+    }
+    p.log(LOG_LEVEL_DEBUG, "accepted request body", LogFields{"media_type": mt, "status": httpCode})
+    return httpCode, httpHeaders, writerTo, httpError
 }
 
-func (p *wmDecisionCore) bodyEncoder(w io.Writer) (io.Writer, error) {
-    var outW io.Writer
-    var err error
-    switch p.encoding {
-    default:
-        outW = w
-    case "identity":
-        outW = w
-    case "deflate":
-        outW, err = flate.NewWriter(w, 6)
-    case "gzip":
-        outW = gzip.NewWriter(w)
-    case "lzw":
-        outW = lzw.NewWriter(w, lzw.LSB, 8)
-    case "zlib":
-        outW = zlib.NewWriter(w)
-    }
-    return outW, err
-}
-
-func (p *wmDecisionCore) chooseEncoding() string {
+// chooseEncoding negotiates the Content-Encoding against acceptEncoding,
+// returning nil if none of the provided encodings is acceptable, along with
+// any halt from EncodingsProvided.
+func (p *wmDecisionCore) chooseEncoding(acceptEncoding string) (EncodingHandler, int, error) {
     var encodingHandlers []EncodingHandler
-    arr := make([]string, 1)
-    arr[0] = "*"
-    encodingHandlers, p.req, p.cxt, _, _ = p.handler.EncodingsProvided(arr, p.req, p.cxt)
-    log.Print("[WDC]: chooseEncoding: ", encodingHandlers)
-    if len(encodingHandlers) == 0 {
-        return ""
+    var httpCode int
+    var httpError error
+    encodingHandlers, p.req, p.cxt, httpCode, httpError = p.handler.EncodingsProvided([]string{acceptEncoding}, p.req, p.cxt)
+    if p.isHalt(httpCode, httpError) {
+        return nil, httpCode, httpError
     }
-    encodingMap := make(map[string]EncodingHandler)
+    handler := chooseEncodingHandler(encodingHandlers, acceptEncoding, DefaultEncodingRegistry())
     encodings := make([]string, len(encodingHandlers))
     for i, encodingHandler := range encodingHandlers {
         encodings[i] = encodingHandler.Encoding()
-        encodingMap[encodingHandler.Encoding()] = encodingHandler
-    }
-    s := p.req.Header().Get("Accept-Encoding")
-    encoding := chooseEncodingWithDefaultString(encodings, s)
-    log.Print("[WDC]: Accept-Encoding: \"", s, "\", we supply ", encodings, " and choosing encoding \"", encoding, "\"")
-    if len(encoding) > 0 {
-        p.resp.Header().Set("Content-Encoding", encoding)
-        p.resp.AddEncoding(encodingMap[encoding], p.req, p.cxt)
-        p.encodingOutputHandler = encodingMap[encoding]
-    }
-    return encoding
-}
-
-func (p *wmDecisionCore) chooseCharset() string {
-    var charsetHandlers []CharsetHandler
-    var httpCode int
-    var httpError error
-    arr := make([]string, 1)
-    arr[0] = "*"
-    charsetHandlers, p.req, p.cxt, httpCode, httpError = p.handler.CharsetsProvided(arr, p.req, p.cxt)
-    if httpCode > 0 {
-        p.writeHaltOrError(httpCode, httpError)
-        return ""
-    }
-    if len(charsetHandlers) <= 0 {
-        return ""
     }
-    charsetMap := make(map[string]CharsetHandler)
-    charsets := make([]string, len(charsetHandlers))
-    for i, charsetHandler := range charsetHandlers {
-        charsets[i] = charsetHandler.Charset()
-        charsetMap[charsetHandler.Charset()] = charsetHandler
+    encoding := ""
+    if handler != nil {
+        encoding = handler.Encoding()
+        p.encoding = encoding
+        p.encodingOutputHandler = handler
     }
-    s := p.req.Header().Get("Accept-Charset")
-    charset := chooseCharsetWithDefaultString(charsets, s)
-    if len(charset) > 0 {
-        // TODO append to Content-Type header response if not already specified
-        p.charset = charset
-        p.charsetOutputHandler = charsetMap[charset]
-    }
-    return charset
+    p.log(LOG_LEVEL_DEBUG, "chose encoding", LogFields{"encoding": encoding, "accept_encoding": acceptEncoding, "provided": encodings})
+    return handler, 0, nil
 }
 
-func (p *wmDecisionCore) variances() []string {
+// variances lists the request headers the response varies on: each
+// dimension with more than one choice in the resource's provided lists or
+// variants, followed by the resource's own Variances.
+func (p *wmDecisionCore) variances(variants []Variant) []string {
     v := make([]string, 0, 8)
     var ctp []MediaTypeHandler
     var ep []EncodingHandler
@@ -1338,22 +1765,60 @@ func (p *wmDecisionCore) variances() []string {
     ctp, p.req, p.cxt, _, _ = p.handler.ContentTypesProvided(p.req, p.cxt)
     ep, p.req, p.cxt, _, _ = p.handler.EncodingsProvided(arr, p.req, p.cxt)
     cp, p.req, p.cxt, _, _ = p.handler.CharsetsProvided(arr, p.req, p.cxt)
-    if len(ctp) > 1 {
+    languages, _, _ := p.languagesProvided()
+    // a media type chosen by the URL does not depend on Accept
+    if p.formatOverride == nil && (len(ctp) > 1 || variantsDiffer(variants, func(v *Variant) string { return v.baseMediaType() })) {
         v = append(v, "Accept")
     }
-    if len(ep) > 1 {
+    if len(ep) > 1 || variantsDiffer(variants, func(v *Variant) string { return canonicalEncoding(v.Encoding) }) {
         v = append(v, "Accept-Encoding")
     }
-    if len(cp) > 1 {
+    if len(cp) > 1 || variantsDiffer(variants, func(v *Variant) string { return canonicalCharset(v.Charset) }) {
         v = append(v, "Accept-Charset")
     }
+    if len(languages) > 1 || variantsDiffer(variants, func(v *Variant) string { return v.Language }) {
+        v = append(v, "Accept-Language")
+    }
     var headers []string
     headers, p.req, p.cxt, _, _ = p.handler.Variances(p.req, p.cxt)
-    if cap(v) < len(v)+len(headers) {
-        tmp := make([]string, 0, len(v)+len(headers))
-        copy(tmp, v)
-        v = tmp
+    return appendVary(v, headers...)
+}
+
+// variantsProvided calls VariantsProvided if the resource is a
+// VariantsProvider.
+func (p *wmDecisionCore) variantsProvided() ([]Variant, int, error) {
+    provider, ok := p.resource.(VariantsProvider)
+    if !ok {
+        return nil, 0, nil
+    }
+    var variants []Variant
+    var httpCode int
+    var httpError error
+    variants, p.req, p.cxt, httpCode, httpError = provider.VariantsProvided(p.req, p.cxt)
+    p.traceCallback("VariantsProvided", variants, httpCode, httpError)
+    return variants, httpCode, httpError
+}
+
+// setVariantHeaders sets Vary, merged with any already set, and when the
+// resource lists variants with URLs of their own, Alternates and TCN as in
+// RFC 2295 and Content-Location for the variant negotiated.
+func (p *wmDecisionCore) setVariantHeaders(variants []Variant) {
+    headers := p.resp.Header()
+    vary := p.variances(variants)
+    if alternates := alternatesHeader(variants); len(alternates) > 0 {
+        headers.Set("Alternates", alternates)
+        headers.Set("TCN", "choice")
+        vary = append([]string{"negotiate"}, vary...)
+        if len(headers.Get("Content-Location")) == 0 {
+            for i := range variants {
+                if len(variants[i].URL) > 0 && variants[i].matches(p.mediaType, p.charset, p.language, p.encoding) {
+                    headers.Set("Content-Location", variants[i].URL)
+                    break
+                }
+            }
+        }
+    }
+    if vary = appendVary(headerTokens(headers, "Vary"), vary...); len(vary) > 0 {
+        headers.Set("Vary", strings.Join(vary, ", "))
     }
-    copy(v[len(v):], headers)
-    return v
 }
@@ -0,0 +1,249 @@
+package webmachine
+
+import (
+    "context"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// panicTestResource panics in ResourceExists or, after writing partial, in
+// its MediaTypeHandler, and records what FinishRequestWithResult was told.
+type panicTestResource struct {
+    DefaultRequestHandler
+    panicIn  string
+    partial  string
+    status   int
+    finished bool
+    failed   bool
+}
+
+func (p *panicTestResource) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    return p
+}
+
+func (p *panicTestResource) ResourceExists(req Request, cxt Context) (bool, Request, Context, int, error) {
+    if p.panicIn == "ResourceExists" {
+        panic("resource exists")
+    }
+    return p.status == 0, req, cxt, p.status, nil
+}
+
+func (p *panicTestResource) ContentTypesProvided(req Request, cxt Context) ([]MediaTypeHandler, Request, Context, int, error) {
+    return []MediaTypeHandler{p}, req, cxt, 0, nil
+}
+
+func (p *panicTestResource) MediaTypeOutput() string {
+    return MIME_TYPE_TEXT_PLAIN
+}
+
+func (p *panicTestResource) MediaTypeHandleOutputTo(req Request, cxt Context, writer io.Writer, resp ResponseWriter) {
+    if p.panicIn == "MediaTypeHandler" {
+        if len(p.partial) > 0 {
+            io.WriteString(writer, p.partial)
+        }
+        panic("media type handler")
+    }
+    resp.WriteHeader(http.StatusOK)
+    io.WriteString(writer, "complete")
+}
+
+func (p *panicTestResource) FinishRequestWithResult(req Request, cxt Context, failed bool) (bool, Request, Context, int, error) {
+    p.finished, p.failed = true, failed
+    return true, req, cxt, 0, nil
+}
+
+// servePanicTest serves a GET and returns the response along with whatever
+// ServeHTTP panicked with.
+func servePanicTest(resource *panicTestResource, header map[string]string) (rec *httptest.ResponseRecorder, renderer *recordingErrorRenderer, panicked interface{}) {
+    renderer = new(recordingErrorRenderer)
+    wm := NewWebMachine()
+    wm.SetErrorRenderer(renderer)
+    wm.AddRouteHandler(resource)
+    req := httptest.NewRequest(GET, "/", nil)
+    for k, v := range header {
+        req.Header.Set(k, v)
+    }
+    rec = httptest.NewRecorder()
+    defer func() {
+        panicked = recover()
+    }()
+    wm.ServeHTTP(rec, req)
+    return
+}
+
+func TestPanicBecomes500(t *testing.T) {
+    for _, panicIn := range []string{"ResourceExists", "MediaTypeHandler"} {
+        resource := &panicTestResource{panicIn: panicIn}
+        rec, renderer, panicked := servePanicTest(resource, nil)
+        if panicked != nil {
+            t.Errorf("%s: ServeHTTP panicked with %v", panicIn, panicked)
+        }
+        if rec.Code != http.StatusInternalServerError || renderer.statusCode != http.StatusInternalServerError || rec.Body.String() != "rendered" {
+            t.Errorf("%s: status %d, rendered %d, body %q", panicIn, rec.Code, renderer.statusCode, rec.Body.String())
+        }
+        if !resource.finished || !resource.failed {
+            t.Errorf("%s: finished %v, failed %v", panicIn, resource.finished, resource.failed)
+        }
+    }
+}
+
+func TestPanicAfterPartialWriteAborts(t *testing.T) {
+    tests := []struct {
+        header   map[string]string
+        partial  string
+        encoding string
+    }{
+        {nil, "partial", ""},
+        // buffered by the gzip encoder until finishEncoding commits the 200,
+        // unencoded as it is so short, while the panic unwinds
+        {map[string]string{"Accept-Encoding": "gzip"}, "partial", ""},
+        {map[string]string{"Accept-Encoding": "gzip"}, strings.Repeat("partial", 200), "gzip"},
+    }
+    for _, tt := range tests {
+        resource := &panicTestResource{panicIn: "MediaTypeHandler", partial: tt.partial}
+        rec, renderer, panicked := servePanicTest(resource, tt.header)
+        if panicked != http.ErrAbortHandler {
+            t.Errorf("%v, %d bytes: ServeHTTP panicked with %v, want http.ErrAbortHandler", tt.header, len(tt.partial), panicked)
+        }
+        if rec.Code != http.StatusOK || renderer.statusCode != 0 || rec.Header().Get("Content-Encoding") != tt.encoding {
+            t.Errorf("%v, %d bytes: status %d, rendered %d, Content-Encoding %q", tt.header, len(tt.partial), rec.Code, renderer.statusCode, rec.Header().Get("Content-Encoding"))
+        }
+        if !resource.finished || !resource.failed {
+            t.Errorf("%v, %d bytes: finished %v, failed %v", tt.header, len(tt.partial), resource.finished, resource.failed)
+        }
+    }
+}
+
+func TestRequestFinisher(t *testing.T) {
+    tests := []struct {
+        status int
+        failed bool
+    }{
+        {0, false},
+        {http.StatusNotFound, false},
+        {http.StatusServiceUnavailable, true},
+    }
+    for _, tt := range tests {
+        resource := &panicTestResource{status: tt.status}
+        servePanicTest(resource, nil)
+        if !resource.finished || resource.failed != tt.failed {
+            t.Errorf("status %d: finished %v, failed %v, want failed %v", tt.status, resource.finished, resource.failed, tt.failed)
+        }
+    }
+}
+
+func TestRequestContext(t *testing.T) {
+    httpReq := httptest.NewRequest(GET, "http://example.com/a/b", nil)
+    req := NewRequestFromHttpRequest(httpReq)
+    if req.Context() != httpReq.Context() {
+        t.Error("Context is not the http.Request's")
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    withContext := req.WithContext(ctx)
+    cancel()
+    if withContext.Context() != ctx || withContext.UnderlyingRequest().Context() != ctx {
+        t.Error("WithContext did not replace the context")
+    }
+    if req.Context().Err() != nil {
+        t.Error("WithContext changed the original request")
+    }
+    if withContext.URLParts()[1] != "a" || withContext.Host() != req.Host() {
+        t.Errorf("WithContext lost the request: %v %q", withContext.URLParts(), withContext.Host())
+    }
+}
+
+// deadlineTestResource waits in ResourceExists or its MediaTypeHandler
+// until the request's context is done, cancelling it first if cancel is set.
+type deadlineTestResource struct {
+    DefaultRequestHandler
+    timeout     time.Duration
+    code        int
+    waitIn      string
+    cancel      context.CancelFunc
+    bodyWritten bool
+}
+
+func (p *deadlineTestResource) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    return p
+}
+
+func (p *deadlineTestResource) RequestTimeout(req Request, cxt Context) (time.Duration, int) {
+    return p.timeout, p.code
+}
+
+func (p *deadlineTestResource) ResourceExists(req Request, cxt Context) (bool, Request, Context, int, error) {
+    if p.waitIn == "ResourceExists" {
+        if p.cancel != nil {
+            p.cancel()
+        }
+        <-req.Context().Done()
+    }
+    return true, req, cxt, 0, nil
+}
+
+func (p *deadlineTestResource) ContentTypesProvided(req Request, cxt Context) ([]MediaTypeHandler, Request, Context, int, error) {
+    return []MediaTypeHandler{p}, req, cxt, 0, nil
+}
+
+func (p *deadlineTestResource) MediaTypeOutput() string {
+    return MIME_TYPE_TEXT_PLAIN
+}
+
+func (p *deadlineTestResource) MediaTypeHandleOutputTo(req Request, cxt Context, writer io.Writer, resp ResponseWriter) {
+    if p.waitIn == "body" {
+        <-req.Context().Done()
+    }
+    p.bodyWritten = true
+    io.WriteString(writer, "body")
+}
+
+func TestRequestTimeout(t *testing.T) {
+    tests := []struct {
+        code   int
+        waitIn string
+        status int
+        body   bool
+    }{
+        {0, "", http.StatusOK, true},
+        {0, "ResourceExists", http.StatusServiceUnavailable, false},
+        {http.StatusServiceUnavailable, "ResourceExists", http.StatusServiceUnavailable, false},
+        {http.StatusGatewayTimeout, "ResourceExists", http.StatusGatewayTimeout, false},
+        {http.StatusTeapot, "ResourceExists", http.StatusServiceUnavailable, false},
+        // the deadline is only checked between decisions
+        {http.StatusGatewayTimeout, "body", http.StatusOK, true},
+    }
+    for _, tt := range tests {
+        resource := &deadlineTestResource{timeout: 10 * time.Millisecond, code: tt.code, waitIn: tt.waitIn}
+        wm := NewWebMachine()
+        renderer := new(recordingErrorRenderer)
+        wm.SetErrorRenderer(renderer)
+        wm.AddRouteHandler(resource)
+        rec := httptest.NewRecorder()
+        wm.ServeHTTP(rec, httptest.NewRequest(GET, "/", nil))
+        if rec.Code != tt.status || resource.bodyWritten != tt.body {
+            t.Errorf("code %d waiting in %q: %d, body written %v, want %d, %v", tt.code, tt.waitIn, rec.Code, resource.bodyWritten, tt.status, tt.body)
+        }
+        if tt.status != http.StatusOK && renderer.statusCode != tt.status {
+            t.Errorf("code %d waiting in %q: rendered %d", tt.code, tt.waitIn, renderer.statusCode)
+        }
+    }
+}
+
+func TestCancelledRequestSkipsBody(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    resource := &deadlineTestResource{waitIn: "ResourceExists", cancel: cancel}
+    wm := NewWebMachine()
+    renderer := new(recordingErrorRenderer)
+    wm.SetErrorRenderer(renderer)
+    wm.AddRouteHandler(resource)
+    rec := httptest.NewRecorder()
+    wm.ServeHTTP(rec, httptest.NewRequest(GET, "/", nil).WithContext(ctx))
+    // nobody is listening, so nothing is rendered either
+    if resource.bodyWritten || rec.Body.Len() > 0 || renderer.statusCode != 0 {
+        t.Errorf("body written %v, body %q, rendered %d", resource.bodyWritten, rec.Body.String(), renderer.statusCode)
+    }
+}
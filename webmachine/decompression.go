@@ -0,0 +1,81 @@
+package webmachine
+
+import (
+    "errors"
+    "io"
+    "net/http"
+)
+
+const (
+    DEFAULT_DECOMPRESSION_MAX_SIZE  = 32 << 20
+    DEFAULT_DECOMPRESSION_MAX_RATIO = 100
+)
+
+// the ratio is only checked past this many decoded bytes so that small,
+// highly repetitive bodies are not refused
+const decompressionRatioFloor = 64 << 10
+
+// ErrRequestBodyTooLarge is wrapped in a 413 Halt and returned from Read
+// once a decoded request body breaks the DecompressionLimits.
+var ErrRequestBodyTooLarge = errors.New("decoded request body is too large")
+
+// DecompressionLimits bounds request bodies sent with a Content-Encoding so
+// that a small upload cannot expand into an unbounded amount of data.  A
+// limit of 0 is not enforced.
+type DecompressionLimits struct {
+    // MaxSize is the largest decoded body accepted, in bytes.
+    MaxSize int64
+    // MaxRatio is the largest accepted ratio of decoded to encoded bytes.
+    MaxRatio int64
+}
+
+func NewDefaultDecompressionLimits() *DecompressionLimits {
+    return &DecompressionLimits{MaxSize: DEFAULT_DECOMPRESSION_MAX_SIZE, MaxRatio: DEFAULT_DECOMPRESSION_MAX_RATIO}
+}
+
+type countingReader struct {
+    reader io.Reader
+    n      int64
+}
+
+func (p *countingReader) Read(b []byte) (int, error) {
+    n, err := p.reader.Read(b)
+    p.n += int64(n)
+    return n, err
+}
+
+// decodedBody reads a request body through its content decoders, failing
+// with a 413 Halt once the decoded bytes break the limits.
+type decodedBody struct {
+    reader  io.Reader
+    raw     *countingReader
+    body    io.Closer
+    closers []io.Closer
+    limits  *DecompressionLimits
+    n       int64
+    err     error
+}
+
+func (p *decodedBody) Read(b []byte) (int, error) {
+    if p.err != nil {
+        return 0, p.err
+    }
+    n, err := p.reader.Read(b)
+    p.n += int64(n)
+    if p.limits.MaxSize > 0 && p.n > p.limits.MaxSize {
+        p.err = NewHalt(http.StatusRequestEntityTooLarge, ErrRequestBodyTooLarge)
+    } else if p.limits.MaxRatio > 0 && p.n > decompressionRatioFloor && p.n > p.raw.n*p.limits.MaxRatio {
+        p.err = NewHalt(http.StatusRequestEntityTooLarge, ErrRequestBodyTooLarge)
+    }
+    if p.err != nil {
+        return n, p.err
+    }
+    return n, err
+}
+
+func (p *decodedBody) Close() error {
+    for i := len(p.closers) - 1; i >= 0; i-- {
+        p.closers[i].Close()
+    }
+    return p.body.Close()
+}
@@ -0,0 +1,76 @@
+package webmachine
+
+import (
+    "bytes"
+    "compress/gzip"
+    "compress/zlib"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func gzipTestBody(s string) string {
+    var buf bytes.Buffer
+    w := gzip.NewWriter(&buf)
+    io.WriteString(w, s)
+    w.Close()
+    return buf.String()
+}
+
+func zlibTestBody(s string) string {
+    var buf bytes.Buffer
+    w := zlib.NewWriter(&buf)
+    io.WriteString(w, s)
+    w.Close()
+    return buf.String()
+}
+
+func TestRequestBodyDecoding(t *testing.T) {
+    zeros := func(n int) string { return strings.Repeat("\x00", n) }
+    tests := []struct {
+        name     string
+        encoding string
+        body     string
+        limits   *DecompressionLimits
+        status   int
+        decoded  string
+    }{
+        {"gzip", "gzip", gzipTestBody("hello"), nil, http.StatusNoContent, "hello"},
+        {"x-gzip", "x-gzip", gzipTestBody("hello"), nil, http.StatusNoContent, "hello"},
+        {"identity", "identity", "hello", nil, http.StatusNoContent, "hello"},
+        // codings are listed in the order applied, so decoded last to first
+        {"stacked", "deflate, gzip", gzipTestBody(zlibTestBody("hello")), nil, http.StatusNoContent, "hello"},
+        {"under MaxSize", "gzip", gzipTestBody(zeros(100)), &DecompressionLimits{MaxSize: 100}, http.StatusNoContent, zeros(100)},
+        {"over MaxSize", "gzip", gzipTestBody(zeros(101)), &DecompressionLimits{MaxSize: 100}, http.StatusRequestEntityTooLarge, ""},
+        // highly compressible, but within the 64KiB allowed whatever the ratio
+        {"ratio grace", "gzip", gzipTestBody(zeros(60 << 10)), nil, http.StatusNoContent, zeros(60 << 10)},
+        {"over MaxRatio", "gzip", gzipTestBody(zeros(1 << 20)), nil, http.StatusRequestEntityTooLarge, ""},
+        {"ratio off", "gzip", gzipTestBody(zeros(1 << 20)), &DecompressionLimits{}, http.StatusNoContent, zeros(1 << 20)},
+        {"corrupt gzip", "gzip", "not gzip at all", nil, http.StatusBadRequest, ""},
+        {"unknown coding", "x-unknown", "hello", nil, http.StatusUnsupportedMediaType, ""},
+    }
+    for _, tt := range tests {
+        input := new(charsetTestInputHandler)
+        wm := NewWebMachine()
+        if tt.limits != nil {
+            wm.SetDecompressionLimits(tt.limits)
+        }
+        wm.AddRouteHandler(&charsetTestResource{input: input})
+        req := httptest.NewRequest(PUT, "/", strings.NewReader(tt.body))
+        req.Header.Set("Content-Type", MIME_TYPE_TEXT_PLAIN)
+        req.Header.Set("Content-Encoding", tt.encoding)
+        rec := httptest.NewRecorder()
+        wm.ServeHTTP(rec, req)
+        if rec.Code != tt.status {
+            t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+        }
+        if tt.status == http.StatusNoContent && input.body != tt.decoded {
+            t.Errorf("%s: decoded %d bytes, want %d", tt.name, len(input.body), len(tt.decoded))
+        }
+        if tt.status == http.StatusUnsupportedMediaType && !strings.Contains(rec.Header().Get("Accept-Encoding"), "gzip") {
+            t.Errorf("%s: Accept-Encoding %q", tt.name, rec.Header().Get("Accept-Encoding"))
+        }
+    }
+}
@@ -3,7 +3,6 @@ package webmachine
 import (
     "encoding/json"
     "io"
-    "log"
     "os"
     "path"
     "time"
@@ -170,7 +169,7 @@ func (p *HtmlDirectoryListing) MediaTypeHandleOutputTo(req Request, cxt Context,
     result.Status = "success"
     result.Message = ""
     result.Result = entries
-    log.Printf("Executing Success with result\n  %#v", result)
+    req.Logger().Log(LOG_LEVEL_DEBUG, "rendering directory listing", LogFields{"full_path": p.fullPath, "entries": len(entries)})
     HTML_DIRECTORY_LISTING_SUCCESS_TEMPLATE.ExecuteTemplate(writer, "directory_listing_success", result)
     return
 }
@@ -0,0 +1,324 @@
+package webmachine
+
+import (
+    "errors"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+)
+
+// Dispatcher is a RouteHandler that picks a RequestHandler by matching the
+// request path against patterns, as Erlang webmachine's dispatch table does,
+// e.g.
+//
+//     d := NewDispatcher()
+//     d.AddRoute("/users/:id", users)
+//     d.AddRoute("/users/:id/files/*", files, MethodGuard(GET, HEAD))
+//     wm.AddRouteHandler(d)
+//
+// Each "/"-separated segment of a pattern is a literal, a ":name" binding
+// matching any one non-empty segment, or, as the last segment only, "*"
+// matching the rest of the path, which may be empty.  The matched route's
+// bindings, the path matched by "*", still escaped, and the pattern itself
+// are given to Request.SetDispatchMatch and so are available from
+// Request.PathBindings, Request.PathInfo and Request.DispatchPath.
+//
+// Routes are kept in a tree of segments, so finding one does not depend on
+// how many there are.  A literal segment is preferred to a binding and a
+// binding to "*"; routes with equivalent patterns are tried in the order they
+// were added.  A route only matches if all of its guards pass.
+//
+// AddHostRoute restricts a route to matching hosts, so that one WebMachine
+// can serve several virtual hosts or tenants.  A host pattern is matched
+// label by label like a path, e.g. ":tenant.example.com", except that "*" may
+// only be its first label and matches one or more labels, e.g.
+// "*.api.example.com".  Routes for a host name without bindings are tried
+// first, then those for host patterns in the order added, then those added
+// with AddRoute for any host.  The host's bindings and the labels matched by
+// "*" are available from Request.HostBindings and Request.HostTokens.
+type Dispatcher struct {
+    root         dispatchNode
+    hosts        map[string]*dispatchNode
+    hostPatterns []*dispatchHost
+}
+
+type dispatchHost struct {
+    pattern string
+    labels  []string
+    root    dispatchNode
+}
+
+// RouteGuard decides whether a Dispatcher route applies to a request.
+type RouteGuard func(req Request) bool
+
+type dispatchRoute struct {
+    pattern string
+    names   []string // binding name of each segment before "*", "" for literals
+    handler RequestHandler
+    guards  []RouteGuard
+}
+
+type dispatchNode struct {
+    literals map[string]*dispatchNode
+    binding  *dispatchNode
+    routes   []*dispatchRoute // patterns ending at this node
+    wildcard []*dispatchRoute // patterns ending in "*" at this node
+}
+
+func NewDispatcher() *Dispatcher {
+    return new(Dispatcher)
+}
+
+// MethodGuard passes requests using one of methods.
+func MethodGuard(methods ...string) RouteGuard {
+    return func(req Request) bool {
+        for _, method := range methods {
+            if req.Method() == method {
+                return true
+            }
+        }
+        return false
+    }
+}
+
+// HeaderGuard passes requests with the header name, or, if value is not "",
+// with value as one of its comma-separated values, ignoring case.
+func HeaderGuard(name, value string) RouteGuard {
+    return func(req Request) bool {
+        if len(value) == 0 {
+            return len(req.Header()[http.CanonicalHeaderKey(name)]) > 0
+        }
+        return headerHasToken(req.Header(), name, value)
+    }
+}
+
+// AddRoute dispatches requests for any host whose path matches pattern to
+// handler.
+func (p *Dispatcher) AddRoute(pattern string, handler RequestHandler, guards ...RouteGuard) error {
+    return p.root.add(pattern, handler, guards)
+}
+
+// AddHostRoute dispatches requests whose host matches hostPattern and whose
+// path matches pattern to handler.
+func (p *Dispatcher) AddHostRoute(hostPattern, pattern string, handler RequestHandler, guards ...RouteGuard) error {
+    labels := splitHost(hostPattern)
+    literal := true
+    seen := make(map[string]bool)
+    for i, label := range labels {
+        switch {
+        case label == "*":
+            if i != 0 {
+                return errors.New("webmachine: \"*\" must be the first label of host pattern " + hostPattern)
+            }
+            literal = false
+        case strings.HasPrefix(label, ":"):
+            if len(label) == 1 || seen[label] {
+                return errors.New("webmachine: missing or repeated binding name in host pattern " + hostPattern)
+            }
+            seen[label] = true
+            literal = false
+        }
+    }
+    if literal {
+        host := strings.Join(labels, ".")
+        if p.hosts == nil {
+            p.hosts = make(map[string]*dispatchNode)
+        }
+        if _, ok := p.hosts[host]; !ok {
+            p.hosts[host] = new(dispatchNode)
+        }
+        return p.hosts[host].add(pattern, handler, guards)
+    }
+    hostPattern = strings.Join(labels, ".")
+    for _, h := range p.hostPatterns {
+        if h.pattern == hostPattern {
+            return h.root.add(pattern, handler, guards)
+        }
+    }
+    h := &dispatchHost{pattern: hostPattern, labels: labels}
+    p.hostPatterns = append(p.hostPatterns, h)
+    return h.root.add(pattern, handler, guards)
+}
+
+// add adds the route for pattern below the node.
+func (p *dispatchNode) add(pattern string, handler RequestHandler, guards []RouteGuard) error {
+    route := &dispatchRoute{pattern: pattern, handler: handler, guards: guards}
+    segments := splitDispatchPath(pattern)
+    node := p
+    seen := make(map[string]bool)
+    for i, segment := range segments {
+        switch {
+        case len(segment) == 0:
+            return errors.New("webmachine: empty segment in dispatch pattern " + pattern)
+        case segment == "*":
+            if i != len(segments)-1 {
+                return errors.New("webmachine: \"*\" must be the last segment of dispatch pattern " + pattern)
+            }
+            node.wildcard = append(node.wildcard, route)
+            return nil
+        case strings.HasPrefix(segment, ":"):
+            name := segment[1:]
+            if len(name) == 0 || seen[name] {
+                return errors.New("webmachine: missing or repeated binding name in dispatch pattern " + pattern)
+            }
+            seen[name] = true
+            if node.binding == nil {
+                node.binding = new(dispatchNode)
+            }
+            node = node.binding
+            route.names = append(route.names, name)
+        default:
+            if node.literals == nil {
+                node.literals = make(map[string]*dispatchNode)
+            }
+            child, ok := node.literals[segment]
+            if !ok {
+                child = new(dispatchNode)
+                node.literals[segment] = child
+            }
+            node = child
+            route.names = append(route.names, "")
+        }
+    }
+    node.routes = append(node.routes, route)
+    return nil
+}
+
+func (p *Dispatcher) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    escaped := splitDispatchPath(req.URL().EscapedPath())
+    segments := make([]string, len(escaped))
+    for i, segment := range escaped {
+        segments[i] = segment
+        if s, err := url.PathUnescape(segment); err == nil {
+            segments[i] = s
+        }
+    }
+    var hostBindings map[string]string
+    var hostTokens []string
+    var route *dispatchRoute
+    labels := splitHost(stripPort(req.Host()))
+    if node, ok := p.hosts[strings.Join(labels, ".")]; ok {
+        route = node.match(req, segments, 0)
+    }
+    for i := 0; route == nil && i < len(p.hostPatterns); i++ {
+        h := p.hostPatterns[i]
+        if bindings, tokens, ok := h.match(labels); ok {
+            if route = h.root.match(req, segments, 0); route != nil {
+                hostBindings, hostTokens = bindings, tokens
+            }
+        }
+    }
+    if route == nil {
+        route = p.root.match(req, segments, 0)
+    }
+    if route == nil {
+        return nil
+    }
+    match := &DispatchMatch{
+        HostBindings: hostBindings,
+        HostTokens:   hostTokens,
+        PathBindings: make(map[string]string),
+        PathInfo:     strings.Join(escaped[len(route.names):], "/"),
+        DispatchPath: route.pattern,
+    }
+    for i, name := range route.names {
+        if len(name) > 0 {
+            match.PathBindings[name] = segments[i]
+        }
+    }
+    req.SetDispatchMatch(match)
+    return route.handler
+}
+
+// match reports whether the host labels match the pattern, returning its
+// bindings and the labels matched by "*".
+func (p *dispatchHost) match(labels []string) (map[string]string, []string, bool) {
+    var tokens []string
+    pattern := p.labels
+    if len(pattern) > 0 && pattern[0] == "*" {
+        pattern = pattern[1:]
+        if len(labels) <= len(pattern) {
+            return nil, nil, false
+        }
+        tokens = labels[0 : len(labels)-len(pattern)]
+        labels = labels[len(tokens):]
+    }
+    if len(labels) != len(pattern) {
+        return nil, nil, false
+    }
+    bindings := make(map[string]string)
+    for i, label := range pattern {
+        if strings.HasPrefix(label, ":") {
+            bindings[label[1:]] = labels[i]
+        } else if label != labels[i] {
+            return nil, nil, false
+        }
+    }
+    return bindings, tokens, true
+}
+
+// match finds the route for segments[depth:] below the node.
+func (p *dispatchNode) match(req Request, segments []string, depth int) *dispatchRoute {
+    if depth == len(segments) {
+        if route := firstPassing(req, p.routes); route != nil {
+            return route
+        }
+        return firstPassing(req, p.wildcard)
+    }
+    if child, ok := p.literals[segments[depth]]; ok {
+        if route := child.match(req, segments, depth+1); route != nil {
+            return route
+        }
+    }
+    if p.binding != nil && len(segments[depth]) > 0 {
+        if route := p.binding.match(req, segments, depth+1); route != nil {
+            return route
+        }
+    }
+    return firstPassing(req, p.wildcard)
+}
+
+func firstPassing(req Request, routes []*dispatchRoute) *dispatchRoute {
+    for _, route := range routes {
+        passed := true
+        for _, guard := range route.guards {
+            if !guard(req) {
+                passed = false
+                break
+            }
+        }
+        if passed {
+            return route
+        }
+    }
+    return nil
+}
+
+// stripPort removes any port from a Host header value.
+func stripPort(host string) string {
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        return h
+    }
+    return strings.Trim(host, "[]")
+}
+
+// splitHost splits a host name or host pattern into lowercase labels,
+// ignoring any trailing ".".
+func splitHost(host string) []string {
+    host = strings.TrimSuffix(strings.ToLower(host), ".")
+    if len(host) == 0 {
+        return []string{}
+    }
+    return strings.Split(host, ".")
+}
+
+// splitDispatchPath splits a path or pattern into segments, ignoring leading
+// and trailing slashes.
+func splitDispatchPath(path string) []string {
+    path = strings.Trim(path, "/")
+    if len(path) == 0 {
+        return []string{}
+    }
+    return strings.Split(path, "/")
+}
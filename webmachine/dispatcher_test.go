@@ -0,0 +1,198 @@
+package webmachine
+
+import (
+    "net/http/httptest"
+    "reflect"
+    "testing"
+)
+
+type dispatchTestResource struct {
+    DefaultRequestHandler
+    name string
+}
+
+func dispatchTestRequest(method, url string, header map[string]string) Request {
+    req := httptest.NewRequest(method, url, nil)
+    for k, v := range header {
+        req.Header.Set(k, v)
+    }
+    return NewRequestFromHttpRequest(req)
+}
+
+func dispatchedName(d *Dispatcher, req Request) string {
+    handler := d.HandlerFor(req, nil)
+    if handler == nil {
+        return ""
+    }
+    return handler.(*dispatchTestResource).name
+}
+
+func TestDispatcherAddRouteErrors(t *testing.T) {
+    for _, pattern := range []string{"/a/*/b", "/a/:x/:x", "/a/:/b", "/a//b"} {
+        if err := NewDispatcher().AddRoute(pattern, new(dispatchTestResource)); err == nil {
+            t.Errorf("AddRoute(%q) succeeded, want an error", pattern)
+        }
+    }
+}
+
+func TestDispatcher(t *testing.T) {
+    d := NewDispatcher()
+    routes := []struct {
+        pattern string
+        name    string
+        guards  []RouteGuard
+    }{
+        {"/users/:id", "user", nil},
+        {"/users/me", "me", nil},
+        {"/users/:id/files/*", "files", []RouteGuard{MethodGuard(GET, HEAD)}},
+        {"/users/:id/files/*", "files-json", []RouteGuard{HeaderGuard("Accept", "application/json")}},
+        {"/a/b/d", "abd", nil},
+        {"/a/:x/c", "axc", nil},
+        {"/feed", "feed-header", []RouteGuard{HeaderGuard("X-Feed", "")}},
+        {"/", "root", nil},
+        {"/*", "fallback", nil},
+    }
+    for _, r := range routes {
+        if err := d.AddRoute(r.pattern, &dispatchTestResource{name: r.name}, r.guards...); err != nil {
+            t.Fatal(err)
+        }
+    }
+    tests := []struct {
+        method   string
+        url      string
+        header   map[string]string
+        name     string
+        bindings map[string]string
+        pathInfo string
+    }{
+        {GET, "/users/42", nil, "user", map[string]string{"id": "42"}, ""},
+        {GET, "/users/42/", nil, "user", map[string]string{"id": "42"}, ""},
+        // a literal is preferred to a binding
+        {GET, "/users/me", nil, "me", map[string]string{}, ""},
+        {GET, "/users/a%2Fb/files/x/y", nil, "files", map[string]string{"id": "a/b"}, "x/y"},
+        {GET, "/users/42/files/dir%2Fname", nil, "files", map[string]string{"id": "42"}, "dir%2Fname"},
+        {GET, "/users/42/files", nil, "files", map[string]string{"id": "42"}, ""},
+        // guards that fail fall through to the next route
+        {PUT, "/users/42/files/x", map[string]string{"Accept": "application/json"}, "files-json", map[string]string{"id": "42"}, "x"},
+        {PUT, "/users/42/files/x", nil, "fallback", map[string]string{}, "users/42/files/x"},
+        {GET, "/feed", map[string]string{"X-Feed": "1"}, "feed-header", map[string]string{}, ""},
+        {GET, "/feed", nil, "fallback", map[string]string{}, "feed"},
+        // the literal branch fails at its last segment, so the binding is tried
+        {GET, "/a/b/c", nil, "axc", map[string]string{"x": "b"}, ""},
+        {GET, "/a/b/d", nil, "abd", map[string]string{}, ""},
+        // an empty segment does not bind
+        {GET, "/users//files/x", nil, "fallback", map[string]string{}, "users//files/x"},
+        {GET, "/", nil, "root", map[string]string{}, ""},
+    }
+    for _, tt := range tests {
+        req := dispatchTestRequest(tt.method, tt.url, tt.header)
+        if name := dispatchedName(d, req); name != tt.name {
+            t.Errorf("%s %s dispatched to %q, want %q", tt.method, tt.url, name, tt.name)
+            continue
+        }
+        if !reflect.DeepEqual(req.PathBindings(), tt.bindings) || req.PathInfo() != tt.pathInfo {
+            t.Errorf("%s %s: bindings %v, path info %q, want %v, %q", tt.method, tt.url, req.PathBindings(), req.PathInfo(), tt.bindings, tt.pathInfo)
+        }
+    }
+    req := dispatchTestRequest(GET, "/users/42/files/x", nil)
+    d.HandlerFor(req, nil)
+    if req.DispatchPath() != "/users/:id/files/*" {
+        t.Errorf("DispatchPath() = %q", req.DispatchPath())
+    }
+}
+
+func TestDispatcherNoMatch(t *testing.T) {
+    d := NewDispatcher()
+    d.AddRoute("/users/:id", &dispatchTestResource{name: "user"})
+    d.AddRoute("/posts", &dispatchTestResource{name: "posts"}, MethodGuard(GET))
+    for _, url := range []string{"/users", "/users/1/2", "/other"} {
+        if name := dispatchedName(d, dispatchTestRequest(GET, url, nil)); len(name) > 0 {
+            t.Errorf("GET %s dispatched to %q", url, name)
+        }
+    }
+    if name := dispatchedName(d, dispatchTestRequest(POST, "/posts", nil)); len(name) > 0 {
+        t.Errorf("POST /posts dispatched to %q despite its guard", name)
+    }
+}
+
+func TestDispatcherHosts(t *testing.T) {
+    d := NewDispatcher()
+    routes := []struct {
+        host    string
+        pattern string
+        name    string
+    }{
+        {"www.example.com", "/*", "www"},
+        {":tenant.example.com", "/users/:id", "tenant"},
+        {"*.example.com", "/*", "wildcard"},
+        {"*.api.example.com", "/*", "api"},
+        {"", "/*", "any"},
+    }
+    for _, r := range routes {
+        var err error
+        if len(r.host) == 0 {
+            err = d.AddRoute(r.pattern, &dispatchTestResource{name: r.name})
+        } else {
+            err = d.AddHostRoute(r.host, r.pattern, &dispatchTestResource{name: r.name})
+        }
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    for _, pattern := range []string{"a.*.com", ":.example.com", ":a.:a.com"} {
+        if err := d.AddHostRoute(pattern, "/", new(dispatchTestResource)); err == nil {
+            t.Errorf("AddHostRoute(%q) succeeded, want an error", pattern)
+        }
+    }
+    tests := []struct {
+        host     string
+        url      string
+        name     string
+        bindings map[string]string
+        tokens   []string
+    }{
+        // a literal host shadows the patterns that also match it
+        {"www.example.com", "/users/1", "www", nil, nil},
+        {"WWW.Example.com:8080", "/x", "www", nil, nil},
+        {"www.example.com.", "/x", "www", nil, nil},
+        {"acme.example.com", "/users/7", "tenant", map[string]string{"tenant": "acme"}, nil},
+        {"acme.example.com:8443", "/users/7", "tenant", map[string]string{"tenant": "acme"}, nil},
+        // patterns are tried in the order added when the path does not match
+        {"acme.example.com", "/other", "wildcard", map[string]string{}, []string{"acme"}},
+        {"v1.eu.api.example.com", "/a", "wildcard", map[string]string{}, []string{"v1", "eu", "api"}},
+        // "*" needs at least one label
+        {"example.com", "/a", "any", nil, nil},
+        {"other.org:80", "/a", "any", nil, nil},
+        {"[::1]:8080", "/a", "any", nil, nil},
+    }
+    for _, tt := range tests {
+        req := httptest.NewRequest(GET, tt.url, nil)
+        req.Host = tt.host
+        r := NewRequestFromHttpRequest(req)
+        if name := dispatchedName(d, r); name != tt.name {
+            t.Errorf("%s%s dispatched to %q, want %q", tt.host, tt.url, name, tt.name)
+            continue
+        }
+        if !reflect.DeepEqual(r.HostBindings(), tt.bindings) || !reflect.DeepEqual(r.HostTokens(), tt.tokens) {
+            t.Errorf("%s%s: host bindings %v, tokens %v, want %v, %v", tt.host, tt.url, r.HostBindings(), r.HostTokens(), tt.bindings, tt.tokens)
+        }
+    }
+}
+
+func TestHostParts(t *testing.T) {
+    tests := []struct {
+        host  string
+        parts []string
+    }{
+        {"example.com", []string{"example", "com"}},
+        {"example.com:8080", []string{"example", "com"}},
+        {"[::1]:80", []string{"::1"}},
+    }
+    for _, tt := range tests {
+        req := httptest.NewRequest(GET, "/", nil)
+        req.Host = tt.host
+        if parts := NewRequestFromHttpRequest(req).HostParts(); !reflect.DeepEqual(parts, tt.parts) {
+            t.Errorf("HostParts() for %q = %v, want %v", tt.host, parts, tt.parts)
+        }
+    }
+}
@@ -1,11 +1,10 @@
 package webmachine
 
 import (
-    "compress/flate"
     "compress/gzip"
     "compress/lzw"
+    "compress/zlib"
     "io"
-    "net/http/httputil"
 )
 
 type identityEncoding struct{}
@@ -38,6 +37,9 @@ func (p *identityEncoding) String() string {
     return ENCODING_IDENTITY
 }
 
+// NewCompressEncoder returns an encoder for Go's LZW stream, which is not the
+// Unix compress (.Z) format that HTTP clients expect of "compress", so it is
+// not registered by default.
 func NewCompressEncoder() EncodingHandler {
     return new(compressEncoding)
 }
@@ -71,8 +73,19 @@ func (p *gzipEncoding) Encoder(req Request, cxt Context, writer io.Writer) io.Wr
     return w
 }
 
+func (p *gzipEncoding) EncoderLevel(req Request, cxt Context, writer io.Writer, level int) io.Writer {
+    w, err := gzip.NewWriterLevel(writer, level)
+    if err != nil {
+        return gzip.NewWriter(writer)
+    }
+    return w
+}
+
 func (p *gzipEncoding) Decoder(req Request, cxt Context, reader io.Reader) io.Reader {
-    r, _ := gzip.NewReader(reader)
+    r, err := gzip.NewReader(reader)
+    if err != nil {
+        return nil
+    }
     return r
 }
 
@@ -80,6 +93,8 @@ func (p *gzipEncoding) String() string {
     return ENCODING_GZIP
 }
 
+// NewDeflateEncoder returns an encoder for the HTTP "deflate" coding, which
+// is a zlib (RFC 1950) stream rather than raw deflate data.
 func NewDeflateEncoder() EncodingHandler {
     return new(deflateEncoding)
 }
@@ -89,18 +104,31 @@ func (p *deflateEncoding) Encoding() string {
 }
 
 func (p *deflateEncoding) Encoder(req Request, cxt Context, writer io.Writer) io.Writer {
-    w, _ := flate.NewWriter(writer, flate.DefaultCompression)
+    return zlib.NewWriter(writer)
+}
+
+func (p *deflateEncoding) EncoderLevel(req Request, cxt Context, writer io.Writer, level int) io.Writer {
+    w, err := zlib.NewWriterLevel(writer, level)
+    if err != nil {
+        return zlib.NewWriter(writer)
+    }
     return w
 }
 
 func (p *deflateEncoding) Decoder(req Request, cxt Context, reader io.Reader) io.Reader {
-    return flate.NewReader(reader)
+    r, err := zlib.NewReader(reader)
+    if err != nil {
+        return nil
+    }
+    return r
 }
 
 func (p *deflateEncoding) String() string {
     return ENCODING_DEFLATE
 }
 
+// Deprecated: chunked is a transfer coding, which net/http applies itself,
+// not a content coding, and is no longer negotiated.
 func NewChunkedEncoder() EncodingHandler {
     return new(chunkedEncoding)
 }
@@ -110,11 +138,11 @@ func (p *chunkedEncoding) Encoding() string {
 }
 
 func (p *chunkedEncoding) Encoder(req Request, cxt Context, writer io.Writer) io.Writer {
-    return httputil.NewChunkedWriter(writer)
+    return NewChunkedWriter(writer)
 }
 
 func (p *chunkedEncoding) Decoder(req Request, cxt Context, reader io.Reader) io.Reader {
-    return flate.NewReader(reader)
+    return NewChunkedReader(reader)
 }
 
 func (p *chunkedEncoding) String() string {
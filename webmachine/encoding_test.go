@@ -0,0 +1,90 @@
+package webmachine
+
+import (
+    "bytes"
+    "compress/zlib"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+type haltingEncodingsResource struct {
+    DefaultRequestHandler
+}
+
+func (p *haltingEncodingsResource) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    return p
+}
+
+func (p *haltingEncodingsResource) ContentTypesProvided(req Request, cxt Context) ([]MediaTypeHandler, Request, Context, int, error) {
+    return []MediaTypeHandler{&formatTestMediaTypeHandler{MIME_TYPE_TEXT_PLAIN, "hello"}}, req, cxt, 0, nil
+}
+
+func (p *haltingEncodingsResource) EncodingsProvided(encodings []string, req Request, cxt Context) ([]EncodingHandler, Request, Context, int, error) {
+    return nil, req, cxt, http.StatusServiceUnavailable, nil
+}
+
+func TestEncodingsProvidedHalt(t *testing.T) {
+    for _, acceptEncoding := range []string{"", "gzip"} {
+        wm := NewWebMachine()
+        wm.AddRouteHandler(new(haltingEncodingsResource))
+        req := httptest.NewRequest("GET", "/", nil)
+        if len(acceptEncoding) > 0 {
+            req.Header.Set("Accept-Encoding", acceptEncoding)
+        }
+        rec := httptest.NewRecorder()
+        wm.ServeHTTP(rec, req)
+        if rec.Code != http.StatusServiceUnavailable {
+            t.Errorf("Accept-Encoding %q: status %d, want 503: %s", acceptEncoding, rec.Code, rec.Body.String())
+        }
+    }
+}
+
+func TestDeflateIsZlib(t *testing.T) {
+    const body = "hello, hello, hello, deflate"
+    var encoded bytes.Buffer
+    w := NewDeflateEncoder().Encoder(nil, nil, &encoded)
+    io.WriteString(w, body)
+    w.(io.Closer).Close()
+    r, err := zlib.NewReader(&encoded)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if b, _ := io.ReadAll(r); string(b) != body {
+        t.Errorf("zlib decoded %q, want %q", b, body)
+    }
+
+    encoded.Reset()
+    zw := zlib.NewWriter(&encoded)
+    io.WriteString(zw, body)
+    zw.Close()
+    if b, _ := io.ReadAll(NewDeflateEncoder().Decoder(nil, nil, &encoded)); string(b) != body {
+        t.Errorf("decoded %q, want %q", b, body)
+    }
+    if NewDeflateEncoder().Decoder(nil, nil, bytes.NewReader([]byte("not zlib"))) != nil {
+        t.Error("expected nil decoder for invalid zlib data")
+    }
+}
+
+func TestDefaultEncodings(t *testing.T) {
+    registry := DefaultEncodingRegistry()
+    if _, ok := registry.Lookup(ENCODING_COMPRESS); ok {
+        t.Error("compress should not be registered by default")
+    }
+    tests := []struct {
+        acceptEncoding string
+        encoding       string
+    }{
+        {"gzip, deflate", ENCODING_GZIP},
+        {"deflate", ENCODING_DEFLATE},
+        {"compress", ENCODING_IDENTITY},
+        {"x-compress, gzip;q=0.5", ENCODING_GZIP},
+    }
+    for _, tt := range tests {
+        handler := chooseEncodingHandler(registry.Handlers(), tt.acceptEncoding, registry)
+        if handler == nil || handler.Encoding() != tt.encoding {
+            t.Errorf("Accept-Encoding %q: chose %v, want %s", tt.acceptEncoding, handler, tt.encoding)
+        }
+    }
+}
@@ -0,0 +1,128 @@
+package webmachine
+
+import (
+    "github.com/pomack/webmachine.go/webmachine/negotiation"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// EncodingRegistry holds the content codings known to the application by
+// name.  When a client gives several codings the same q-value the one with
+// the highest rank is chosen.
+type EncodingRegistry struct {
+    mutex     sync.RWMutex
+    encodings map[string]registeredEncoding
+}
+
+type registeredEncoding struct {
+    handler EncodingHandler
+    rank    int
+}
+
+var defaultEncodingRegistry = newDefaultEncodingRegistry()
+
+func NewEncodingRegistry() *EncodingRegistry {
+    return &EncodingRegistry{encodings: make(map[string]registeredEncoding)}
+}
+
+func newDefaultEncodingRegistry() *EncodingRegistry {
+    registry := NewEncodingRegistry()
+    registry.Register(NewGZipEncoder(), 30)
+    registry.Register(NewDeflateEncoder(), 20)
+    registry.Register(NewIdentityEncoder(), 0)
+    return registry
+}
+
+// DefaultEncodingRegistry returns the registry that DefaultRequestHandler
+// offers encodings from and that request bodies are decoded with.
+func DefaultEncodingRegistry() *EncodingRegistry {
+    return defaultEncodingRegistry
+}
+
+// RegisterEncoding adds handler to the default registry, replacing any
+// handler of the same name.
+func RegisterEncoding(handler EncodingHandler, rank int) {
+    defaultEncodingRegistry.Register(handler, rank)
+}
+
+func (p *EncodingRegistry) Register(handler EncodingHandler, rank int) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    p.encodings[strings.ToLower(handler.Encoding())] = registeredEncoding{handler: handler, rank: rank}
+}
+
+func (p *EncodingRegistry) Unregister(name string) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    delete(p.encodings, strings.ToLower(name))
+}
+
+// Lookup returns the handler registered for name, accepting the x-gzip and
+// x-compress aliases.
+func (p *EncodingRegistry) Lookup(name string) (EncodingHandler, bool) {
+    p.mutex.RLock()
+    defer p.mutex.RUnlock()
+    e, ok := p.encodings[canonicalEncoding(name)]
+    return e.handler, ok
+}
+
+// Rank returns the rank name was registered with, or 0.
+func (p *EncodingRegistry) Rank(name string) int {
+    p.mutex.RLock()
+    defer p.mutex.RUnlock()
+    return p.encodings[canonicalEncoding(name)].rank
+}
+
+// Handlers returns every registered handler, highest rank first.
+func (p *EncodingRegistry) Handlers() []EncodingHandler {
+    p.mutex.RLock()
+    encodings := make([]registeredEncoding, 0, len(p.encodings))
+    for _, e := range p.encodings {
+        encodings = append(encodings, e)
+    }
+    p.mutex.RUnlock()
+    sort.SliceStable(encodings, func(i, j int) bool {
+        if encodings[i].rank != encodings[j].rank {
+            return encodings[i].rank > encodings[j].rank
+        }
+        return encodings[i].handler.Encoding() < encodings[j].handler.Encoding()
+    })
+    handlers := make([]EncodingHandler, len(encodings))
+    for i, e := range encodings {
+        handlers[i] = e.handler
+    }
+    return handlers
+}
+
+func canonicalEncoding(name string) string {
+    name = strings.ToLower(strings.TrimSpace(name))
+    switch name {
+    case "x-gzip":
+        return ENCODING_GZIP
+    case "x-compress":
+        return ENCODING_COMPRESS
+    }
+    return name
+}
+
+// chooseEncodingHandler picks from provided the coding with the highest
+// q-value in the Accept-Encoding header, breaking ties by registry rank and
+// then by the order provided.  It returns nil if none is acceptable.
+func chooseEncodingHandler(provided []EncodingHandler, header string, registry *EncodingRegistry) EncodingHandler {
+    prefs := negotiation.ParseAcceptEncoding(header)
+    var best EncodingHandler
+    bestQ := 0.0
+    bestRank := 0
+    for _, handler := range provided {
+        q := negotiation.EncodingQuality(handler.Encoding(), prefs)
+        if q <= 0 {
+            continue
+        }
+        rank := registry.Rank(handler.Encoding())
+        if best == nil || q > bestQ || (q == bestQ && rank > bestRank) {
+            best, bestQ, bestRank = handler, q, rank
+        }
+    }
+    return best
+}
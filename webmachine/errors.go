@@ -0,0 +1,128 @@
+package webmachine
+
+import (
+    "encoding/json"
+    "errors"
+    "github.com/pomack/webmachine.go/webmachine/negotiation"
+    "io"
+    "net/http"
+    "strings"
+)
+
+// Halt can be returned as the error from any RequestHandler callback to stop
+// processing the request.  Its StatusCode, if set, takes precedence over the
+// int returned alongside it, and Header is added to the response.  If Body
+// is nil the ErrorRenderer writes the body from Err.
+type Halt struct {
+    StatusCode int
+    Header     http.Header
+    MediaType  string
+    Body       []byte
+    Err        error
+}
+
+func NewHalt(statusCode int, err error) *Halt {
+    return &Halt{StatusCode: statusCode, Header: make(http.Header), Err: err}
+}
+
+// WithHeader adds a header to send with the response, e.g. Retry-After or
+// Location.
+func (p *Halt) WithHeader(key, value string) *Halt {
+    if p.Header == nil {
+        p.Header = make(http.Header)
+    }
+    p.Header.Add(key, value)
+    return p
+}
+
+// WithBody sends body as is instead of rendering Err.
+func (p *Halt) WithBody(mediaType string, body []byte) *Halt {
+    p.MediaType = mediaType
+    p.Body = body
+    return p
+}
+
+func (p *Halt) Error() string {
+    if p.Err != nil {
+        return p.Err.Error()
+    }
+    return http.StatusText(p.StatusCode)
+}
+
+func (p *Halt) Unwrap() error {
+    return p.Err
+}
+
+// asHalt returns the Halt in err's chain, if any.
+func asHalt(err error) (*Halt, bool) {
+    var halt *Halt
+    if err != nil && errors.As(err, &halt) && halt != nil {
+        return halt, true
+    }
+    return nil, false
+}
+
+// errorBodyAllowed reports whether a response with statusCode may carry a
+// body.
+func errorBodyAllowed(statusCode int) bool {
+    return statusCode >= 200 && statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
+}
+
+type plainTextErrorRenderer struct{}
+
+// NewPlainTextErrorRenderer writes the status code followed by the error
+// message, if any, as the body.
+func NewPlainTextErrorRenderer() ErrorRenderer {
+    return plainTextErrorRenderer{}
+}
+
+func (p plainTextErrorRenderer) RenderError(req Request, resp ResponseWriter, statusCode int, err error) {
+    if err != nil && errorBodyAllowed(statusCode) {
+        resp.Header().Set("Content-Type", MIME_TYPE_TEXT_PLAIN+"; charset=utf-8")
+        resp.WriteHeader(statusCode)
+        io.WriteString(resp, err.Error())
+        return
+    }
+    resp.WriteHeader(statusCode)
+}
+
+type negotiatingErrorRenderer struct{}
+
+// NewNegotiatingErrorRenderer writes the error as plain text, JSON or HTML
+// depending on the request's Accept header, falling back to plain text.  It
+// is the default for a WebMachine.
+func NewNegotiatingErrorRenderer() ErrorRenderer {
+    return negotiatingErrorRenderer{}
+}
+
+type errorBody struct {
+    StatusCode int    `json:"status"`
+    Status     string `json:"error"`
+    Message    string `json:"message,omitempty"`
+}
+
+func (p negotiatingErrorRenderer) RenderError(req Request, resp ResponseWriter, statusCode int, err error) {
+    if err == nil || !errorBodyAllowed(statusCode) {
+        resp.WriteHeader(statusCode)
+        return
+    }
+    body := &errorBody{StatusCode: statusCode, Status: http.StatusText(statusCode), Message: err.Error()}
+    provided := []string{MIME_TYPE_TEXT_PLAIN, MIME_TYPE_JSON, MIME_TYPE_HTML}
+    mediaType := MIME_TYPE_TEXT_PLAIN
+    if accept := req.Header().Get("Accept"); len(accept) > 0 {
+        if mt := negotiation.MediaType(provided, accept); len(mt) > 0 {
+            mediaType = mt
+        }
+    }
+    resp.Header().Set("Content-Type", mediaType+"; charset=utf-8")
+    resp.Header().Set("Vary", strings.Join(appendVary(headerTokens(resp.Header(), "Vary"), "Accept"), ", "))
+    resp.WriteHeader(statusCode)
+    switch mediaType {
+    case MIME_TYPE_JSON:
+        json.NewEncoder(resp).Encode(body)
+    case MIME_TYPE_HTML:
+        HTML_ERROR_TEMPLATE.Execute(resp, body)
+    default:
+        io.WriteString(resp, body.Message)
+    }
+}
@@ -0,0 +1,98 @@
+package webmachine
+
+import (
+    "strings"
+)
+
+// ETag is an entity tag as sent in the ETag, If-Match and If-None-Match
+// headers.
+type ETag struct {
+    Tag  string
+    Weak bool
+}
+
+// WeakETag formats tag as a weak entity tag.  Return it from GenerateETag to
+// declare that the resource's representations are only semantically
+// equivalent, not byte-for-byte identical.
+func WeakETag(tag string) string {
+    return ETag{Tag: tag, Weak: true}.String()
+}
+
+// ParseETag parses a quoted, optionally weak, entity tag.  A bare string,
+// such as the plain value returned by most GenerateETag implementations, is
+// taken as a strong tag.
+func ParseETag(s string) ETag {
+    s = strings.TrimSpace(s)
+    var etag ETag
+    if strings.HasPrefix(s, "W/") {
+        etag.Weak = true
+        s = s[2:]
+    }
+    if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+        s = s[1 : len(s)-1]
+    }
+    etag.Tag = s
+    return etag
+}
+
+func (p ETag) String() string {
+    if p.Weak {
+        return "W/\"" + p.Tag + "\""
+    }
+    return "\"" + p.Tag + "\""
+}
+
+// StrongMatch uses the strong comparison of RFC 7232 section 2.3.2: both
+// tags must be strong and identical.
+func (p ETag) StrongMatch(other ETag) bool {
+    return !p.Weak && !other.Weak && p.Tag == other.Tag
+}
+
+// WeakMatch uses the weak comparison: the tags must be identical, whether
+// or not either is weak.
+func (p ETag) WeakMatch(other ETag) bool {
+    return p.Tag == other.Tag
+}
+
+// parseETagList parses the values of an If-Match or If-None-Match header,
+// each of which may hold a comma separated list.  any is true if "*" was
+// given.
+func parseETagList(values []string) (etags []ETag, any bool) {
+    for _, value := range values {
+        for len(value) > 0 {
+            value = strings.TrimLeft(value, " \t,")
+            if len(value) == 0 {
+                break
+            }
+            end := 0
+            if strings.HasPrefix(value, "W/") {
+                end = 2
+            }
+            if end < len(value) && value[end] == '"' {
+                if i := strings.IndexByte(value[end+1:], '"'); i >= 0 {
+                    end += i + 2
+                } else {
+                    end = len(value)
+                }
+            } else if i := strings.IndexByte(value, ','); i >= 0 {
+                end = i
+            } else {
+                end = len(value)
+            }
+            item := strings.TrimSpace(value[:end])
+            value = value[end:]
+            if item == "*" {
+                any = true
+            } else if len(item) > 0 {
+                etags = append(etags, ParseETag(item))
+            }
+        }
+    }
+    return
+}
+
+// etagListHasAny reports whether header is present and contains "*".
+func etagListHasAny(header []string) bool {
+    _, any := parseETagList(header)
+    return any
+}
@@ -0,0 +1,127 @@
+package webmachine
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "testing"
+)
+
+func TestParseETagList(t *testing.T) {
+    tests := []struct {
+        values []string
+        etags  []ETag
+        any    bool
+    }{
+        {nil, nil, false},
+        {[]string{`"a"`}, []ETag{{"a", false}}, false},
+        // what a caching proxy sends after storing several responses
+        {[]string{`W/"a", "b"`}, []ETag{{"a", true}, {"b", false}}, false},
+        {[]string{`W/"a"`, `"b", "c"`}, []ETag{{"a", true}, {"b", false}, {"c", false}}, false},
+        // the weak indicator is case-sensitive
+        {[]string{`"b", w/"c"`}, []ETag{{"b", false}, {`w/"c"`, false}}, false},
+        {[]string{`"a,b", "c"`}, []ETag{{"a,b", false}, {"c", false}}, false},
+        {[]string{`*`}, nil, true},
+        {[]string{` * `}, nil, true},
+        {[]string{`"a", *`}, []ETag{{"a", false}}, true},
+        {[]string{`abc, def`}, []ETag{{"abc", false}, {"def", false}}, false},
+        // an unterminated quote runs to the end and never matches a tag
+        {[]string{`"a`}, []ETag{{`"a`, false}}, false},
+        {[]string{`"b", W/"a`}, []ETag{{"b", false}, {`"a`, true}}, false},
+        {[]string{` , ,`}, nil, false},
+    }
+    for _, tt := range tests {
+        etags, any := parseETagList(tt.values)
+        if !reflect.DeepEqual(etags, tt.etags) || any != tt.any {
+            t.Errorf("parseETagList(%q) = %v, %v, want %v, %v", tt.values, etags, any, tt.etags, tt.any)
+        }
+    }
+}
+
+func TestETagComparison(t *testing.T) {
+    tests := []struct {
+        a, b   string
+        strong bool
+        weak   bool
+    }{
+        {`"1"`, `"1"`, true, true},
+        {`W/"1"`, `W/"1"`, false, true},
+        {`W/"1"`, `"1"`, false, true},
+        {`"1"`, `"2"`, false, false},
+        {`W/"1"`, `W/"2"`, false, false},
+        {`1`, `"1"`, true, true},
+        {`w/"1"`, `W/"1"`, false, false},
+    }
+    for _, tt := range tests {
+        a, b := ParseETag(tt.a), ParseETag(tt.b)
+        if a.StrongMatch(b) != tt.strong || a.WeakMatch(b) != tt.weak {
+            t.Errorf("%s vs %s: strong %v weak %v, want %v %v", tt.a, tt.b, a.StrongMatch(b), a.WeakMatch(b), tt.strong, tt.weak)
+        }
+    }
+}
+
+type etagTestResource struct {
+    DefaultRequestHandler
+    etag string
+}
+
+func (p *etagTestResource) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    return p
+}
+
+func (p *etagTestResource) AllowedMethods(req Request, cxt Context) ([]string, Request, Context, int, error) {
+    return []string{GET, HEAD, PUT}, req, cxt, 0, nil
+}
+
+func (p *etagTestResource) ContentTypesProvided(req Request, cxt Context) ([]MediaTypeHandler, Request, Context, int, error) {
+    return []MediaTypeHandler{&formatTestMediaTypeHandler{MIME_TYPE_TEXT_PLAIN, "hello"}}, req, cxt, 0, nil
+}
+
+func (p *etagTestResource) ContentTypesAccepted(req Request, cxt Context) ([]MediaTypeInputHandler, Request, Context, int, error) {
+    return []MediaTypeInputHandler{NewPassThroughMediaTypeInputHandler(MIME_TYPE_TEXT_PLAIN, "", "", "", "", false, -1, req.Body())}, req, cxt, 0, nil
+}
+
+func (p *etagTestResource) GenerateETag(req Request, cxt Context) (string, Request, Context, int, error) {
+    return p.etag, req, cxt, 0, nil
+}
+
+func TestConditionalRequests(t *testing.T) {
+    tests := []struct {
+        method string
+        etag   string
+        header string
+        value  string
+        status int
+    }{
+        {GET, "b", "If-None-Match", `W/"a", "b"`, http.StatusNotModified},
+        {GET, WeakETag("a"), "If-None-Match", `W/"a", "b"`, http.StatusNotModified},
+        {GET, "a", "If-None-Match", `W/"a", "b"`, http.StatusNotModified},
+        {GET, "c", "If-None-Match", `W/"a", "b"`, http.StatusOK},
+        {GET, "a", "If-None-Match", `w/"a"`, http.StatusOK},
+        {GET, "c", "If-None-Match", `*`, http.StatusNotModified},
+        {PUT, "c", "If-None-Match", `*`, http.StatusPreconditionFailed},
+        {PUT, "c", "If-None-Match", `"c"`, http.StatusPreconditionFailed},
+        {GET, "a", "If-None-Match", `"a`, http.StatusOK},
+        // If-Match only matches strong tags
+        {GET, "a", "If-Match", `"b", "a"`, http.StatusOK},
+        {GET, "a", "If-Match", `W/"a"`, http.StatusPreconditionFailed},
+        {GET, WeakETag("a"), "If-Match", `W/"a", "a"`, http.StatusPreconditionFailed},
+        {GET, "a", "If-Match", `"b"`, http.StatusPreconditionFailed},
+        {GET, "a", "If-Match", `*`, http.StatusOK},
+        {GET, "a", "If-Match", `"a`, http.StatusPreconditionFailed},
+    }
+    for _, tt := range tests {
+        wm := NewWebMachine()
+        wm.AddRouteHandler(&etagTestResource{etag: tt.etag})
+        req := httptest.NewRequest(tt.method, "/", nil)
+        req.Header.Set(tt.header, tt.value)
+        if tt.method == PUT {
+            req.Header.Set("Content-Type", MIME_TYPE_TEXT_PLAIN)
+        }
+        rec := httptest.NewRecorder()
+        wm.ServeHTTP(rec, req)
+        if rec.Code != tt.status {
+            t.Errorf("%s with ETag %s and %s: %s: status %d, want %d", tt.method, tt.etag, tt.header, tt.value, rec.Code, tt.status)
+        }
+    }
+}
@@ -0,0 +1,118 @@
+package webmachine
+
+import (
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const DEFAULT_EVENT_STREAM_KEEP_ALIVE = 15 * time.Second
+
+// ServerSentEvent is one event in a text/event-stream.  Empty fields are
+// left out of the frame.
+type ServerSentEvent struct {
+    Id    string
+    Event string
+    Data  string
+    Retry time.Duration
+}
+
+// EventSource returns the events to stream for a request.  lastEventId is
+// the Last-Event-ID header sent by a reconnecting client, or "" on the first
+// connection, so the source can resume after it.  The stream ends when the
+// channel is closed or the client goes away.
+type EventSource func(req Request, cxt Context, lastEventId string) <-chan *ServerSentEvent
+
+// EventStreamMediaTypeHandler streams Server-Sent Events.  Return it from
+// ContentTypesProvided so that the request still goes through the usual
+// decisions before streaming starts.
+type EventStreamMediaTypeHandler struct {
+    source    EventSource
+    keepAlive time.Duration
+}
+
+func NewEventStreamMediaTypeHandler(source EventSource) *EventStreamMediaTypeHandler {
+    return &EventStreamMediaTypeHandler{source: source, keepAlive: DEFAULT_EVENT_STREAM_KEEP_ALIVE}
+}
+
+// SetKeepAlive sets how often a comment is sent while no events are, to
+// stop proxies timing out the connection.  0 turns keep-alives off.
+func (p *EventStreamMediaTypeHandler) SetKeepAlive(keepAlive time.Duration) {
+    p.keepAlive = keepAlive
+}
+
+func (p *EventStreamMediaTypeHandler) MediaTypeOutput() string {
+    return MIME_TYPE_EVENT_STREAM
+}
+
+// MediaTypeHandleOutputTo streams the events.  A text/event-stream is always
+// UTF-8, so they are written straight to resp rather than through a charset
+// encoder that could hold them back.
+func (p *EventStreamMediaTypeHandler) MediaTypeHandleOutputTo(req Request, cxt Context, writer io.Writer, resp ResponseWriter) {
+    resp.Header().Set("Content-Type", MIME_TYPE_EVENT_STREAM)
+    resp.Header().Set("Cache-Control", "no-cache")
+    resp.Header().Del("Content-Length")
+    resp.WriteHeader(http.StatusOK)
+    if req.Method() == HEAD {
+        return
+    }
+    resp.Flush()
+    events := p.source(req, cxt, strings.TrimSpace(req.Header().Get("Last-Event-ID")))
+    var keepAlive <-chan time.Time
+    if p.keepAlive > 0 {
+        ticker := time.NewTicker(p.keepAlive)
+        defer ticker.Stop()
+        keepAlive = ticker.C
+    }
+    done := req.Context().Done()
+    for {
+        select {
+        case <-done:
+            return
+        case event, ok := <-events:
+            if !ok {
+                return
+            }
+            if event == nil {
+                continue
+            }
+            if _, err := io.WriteString(resp, event.frame()); err != nil {
+                return
+            }
+        case <-keepAlive:
+            if _, err := io.WriteString(resp, ": keep-alive\n\n"); err != nil {
+                return
+            }
+        }
+        if err := resp.Flush(); err != nil {
+            return
+        }
+    }
+}
+
+// frame formats the event, splitting multi-line data over several data
+// fields.
+func (p *ServerSentEvent) frame() string {
+    var b strings.Builder
+    if len(p.Id) > 0 {
+        b.WriteString("id: " + sanitizeEventField(p.Id) + "\n")
+    }
+    if len(p.Event) > 0 {
+        b.WriteString("event: " + sanitizeEventField(p.Event) + "\n")
+    }
+    if p.Retry > 0 {
+        b.WriteString("retry: " + strconv.FormatInt(int64(p.Retry/time.Millisecond), 10) + "\n")
+    }
+    data := strings.ReplaceAll(strings.ReplaceAll(p.Data, "\r\n", "\n"), "\r", "\n")
+    for _, line := range strings.Split(data, "\n") {
+        b.WriteString("data: " + line + "\n")
+    }
+    b.WriteString("\n")
+    return b.String()
+}
+
+func sanitizeEventField(s string) string {
+    return strings.NewReplacer("\r", "", "\n", "", "\x00", "").Replace(s)
+}
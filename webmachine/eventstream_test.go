@@ -0,0 +1,132 @@
+package webmachine
+
+import (
+    "bytes"
+    "io"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// streamRecorder is an httptest.ResponseRecorder whose body may be read
+// while the response is still being written.
+type streamRecorder struct {
+    *httptest.ResponseRecorder
+    mutex sync.Mutex
+}
+
+func (p *streamRecorder) Write(b []byte) (int, error) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    return p.ResponseRecorder.Write(b)
+}
+
+func (p *streamRecorder) body() string {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    return p.ResponseRecorder.Body.String()
+}
+
+// heldCharsetHandler encodes nothing until its writer is closed.
+type heldCharsetHandler struct{}
+
+func (p heldCharsetHandler) Charset() string {
+    return "x-held"
+}
+
+func (p heldCharsetHandler) CharsetConverter(req Request, cxt Context, reader io.Reader) io.Reader {
+    return reader
+}
+
+func (p heldCharsetHandler) CharsetEncoder(req Request, cxt Context, writer io.Writer) io.Writer {
+    return &heldWriter{writer: writer}
+}
+
+type heldWriter struct {
+    writer io.Writer
+    buf    bytes.Buffer
+}
+
+func (p *heldWriter) Write(b []byte) (int, error) {
+    return p.buf.Write(b)
+}
+
+func (p *heldWriter) Close() error {
+    _, err := p.buf.WriteTo(p.writer)
+    return err
+}
+
+type eventStreamTestResource struct {
+    DefaultRequestHandler
+    source EventSource
+}
+
+func (p *eventStreamTestResource) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    return p
+}
+
+func (p *eventStreamTestResource) ContentTypesProvided(req Request, cxt Context) ([]MediaTypeHandler, Request, Context, int, error) {
+    handler := NewEventStreamMediaTypeHandler(p.source)
+    handler.SetKeepAlive(0)
+    return []MediaTypeHandler{handler}, req, cxt, 0, nil
+}
+
+func (p *eventStreamTestResource) CharsetsProvided(charsets []string, req Request, cxt Context) ([]CharsetHandler, Request, Context, int, error) {
+    return []CharsetHandler{heldCharsetHandler{}}, req, cxt, 0, nil
+}
+
+func TestEventStreamIsNotHeldBack(t *testing.T) {
+    rec := &streamRecorder{ResponseRecorder: httptest.NewRecorder()}
+    delivered := make(chan bool, 1)
+    source := func(req Request, cxt Context, lastEventId string) <-chan *ServerSentEvent {
+        events := make(chan *ServerSentEvent)
+        go func() {
+            defer close(events)
+            events <- &ServerSentEvent{Id: lastEventId + "1", Data: "first"}
+            deadline := time.Now().Add(2 * time.Second)
+            for !strings.Contains(rec.body(), "data: first\n\n") && time.Now().Before(deadline) {
+                time.Sleep(time.Millisecond)
+            }
+            delivered <- strings.Contains(rec.body(), "data: first\n\n")
+        }()
+        return events
+    }
+    wm := NewWebMachine()
+    wm.AddRouteHandler(&eventStreamTestResource{source: source})
+    req := httptest.NewRequest(GET, "/", nil)
+    req.Header.Set("Accept", MIME_TYPE_EVENT_STREAM)
+    req.Header.Set("Accept-Charset", "x-held")
+    req.Header.Set("Accept-Encoding", "gzip")
+    req.Header.Set("Last-Event-ID", "7")
+    wm.ServeHTTP(rec, req)
+    if !<-delivered {
+        t.Error("the first event was not sent until the stream ended")
+    }
+    if ct := rec.Header().Get("Content-Type"); ct != MIME_TYPE_EVENT_STREAM {
+        t.Errorf("Content-Type %q", ct)
+    }
+    if ce := rec.Header().Get("Content-Encoding"); len(ce) > 0 {
+        t.Errorf("Content-Encoding %q", ce)
+    }
+    if body := rec.body(); body != "id: 71\ndata: first\n\n" {
+        t.Errorf("body %q", body)
+    }
+}
+
+func TestServerSentEventFrame(t *testing.T) {
+    tests := []struct {
+        event *ServerSentEvent
+        frame string
+    }{
+        {&ServerSentEvent{Data: "a"}, "data: a\n\n"},
+        {&ServerSentEvent{Data: "a\r\nb\rc\nd"}, "data: a\ndata: b\ndata: c\ndata: d\n\n"},
+        {&ServerSentEvent{Id: "1\n2", Event: "tick", Retry: 1500 * time.Millisecond}, "id: 12\nevent: tick\nretry: 1500\ndata: \n\n"},
+    }
+    for _, tt := range tests {
+        if frame := tt.event.frame(); frame != tt.frame {
+            t.Errorf("frame() = %q, want %q", frame, tt.frame)
+        }
+    }
+}
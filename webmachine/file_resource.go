@@ -2,8 +2,8 @@ package webmachine
 
 import (
     "container/list"
+    "github.com/pomack/webmachine.go/webmachine/negotiation"
     "io"
-    "log"
     "math/rand"
     "mime"
     "net/http"
@@ -11,6 +11,7 @@ import (
     "path"
     "path/filepath"
     "strconv"
+    "strings"
     "time"
 )
 
@@ -143,7 +144,6 @@ func (p *fileResourceContext) Close() error {
 
 func (p *fileResourceContext) Read(data []byte) (int, error) {
     if p.reader == nil {
-        log.Print("[FRC]: Trying to open file ", p.FullPath(), " for reading\n")
         var err error
         p.reader, err = os.Open(p.FullPath())
         if err != nil {
@@ -153,20 +153,31 @@ func (p *fileResourceContext) Read(data []byte) (int, error) {
             return 0, io.EOF
         }
     }
-    log.Print("[FRC]: Going to read ", len(data), " bytes\n")
     return p.reader.Read(data)
 }
 
+func (p *fileResourceContext) Seek(offset int64, whence int) (int64, error) {
+    if p.reader == nil {
+        var err error
+        p.reader, err = os.Open(p.FullPath())
+        if err != nil {
+            return 0, err
+        }
+    }
+    if seeker, ok := p.reader.(io.Seeker); ok {
+        return seeker.Seek(offset, whence)
+    }
+    return 0, os.ErrInvalid
+}
+
 func (p *fileResourceContext) Write(data []byte) (int, error) {
     if p.writer == nil {
-        log.Print("[FRC]: Trying to open file ", p.FullPath(), " for appending\n")
         var err error
         p.writer, err = os.OpenFile(p.FullPath(), os.O_APPEND, 0644)
         if err != nil {
             return 0, err
         }
     }
-    log.Print("[FRC]: Going to write ", len(data), " bytes\n")
     return p.writer.Write(data)
 }
 
@@ -229,7 +240,11 @@ func (p *FileResource) GenerateContext(req Request, cxt Context) FileResourceCon
 
 func (p *FileResource) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
     path := req.URL().Path
-    if path >= p.urlPathPrefix && path[0:len(p.urlPathPrefix)] == p.urlPathPrefix {
+    if !strings.HasPrefix(path, p.urlPathPrefix) {
+        return nil
+    }
+    // match whole segments only, so /static does not serve /staticfoo
+    if len(path) == len(p.urlPathPrefix) || strings.HasSuffix(p.urlPathPrefix, "/") || path[len(p.urlPathPrefix)] == '/' {
         return p
     }
     return nil
@@ -352,7 +367,7 @@ func (p *FileResource) CreatePath(req Request, cxt Context) (string, Request, Co
             }
         }
     }
-    log.Print("[FileResource]: Will use path ", frc.FullPath())
+    req.Logger().Log(LOG_LEVEL_DEBUG, "created path", LogFields{"full_path": frc.FullPath()})
     return frc.FullPath(), req, frc, 0, nil
 }
 
@@ -468,7 +483,10 @@ func (p *FileResource) MultipleChoices(req Request, cxt Context) (bool, http.Hea
             contentTypeToFilename[mediaType] = filename
             contentTypes[i] = mediaType
         }
-        finalContentType := chooseMediaTypeDefault(contentTypes, req.Header().Get("Accept"), contentTypes[0])
+        finalContentType := negotiation.MediaType(contentTypes, strings.Join(req.Header()["Accept"], ","))
+        if len(finalContentType) == 0 {
+            finalContentType = contentTypes[0]
+        }
         finalFilename := contentTypeToFilename[finalContentType]
         headers.Set("Content-Type", finalContentType)
         headers.Set("Content-Location", finalFilename)
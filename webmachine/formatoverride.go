@@ -0,0 +1,98 @@
+package webmachine
+
+import (
+    "net/http"
+    "path"
+    "strings"
+)
+
+// FormatOverrides lets a request choose its media type with an extension
+// on the last path segment, e.g. /report.csv, or a query parameter, e.g.
+// /report?format=csv, for clients that cannot easily set Accept.  Once set
+// with WebMachine.SetFormatOverrides, a request with a known extension is
+// routed without it, and if that finds a FormatOverridable resource allowing
+// overrides the resource sees /report, the Accept header is replaced with the
+// media type before content negotiation and the response's Content-Location
+// is the URL with the extension.  Otherwise, e.g. for a FileResource, the
+// request is routed as it is.  An extension takes precedence over the query
+// parameter.
+type FormatOverrides struct {
+    queryParameter string
+    extensions     map[string]string
+}
+
+// formatOverride is the media type a request asked for by URL.
+type formatOverride struct {
+    mediaType       string
+    contentLocation string
+}
+
+func NewFormatOverrides() *FormatOverrides {
+    return &FormatOverrides{extensions: make(map[string]string)}
+}
+
+// NewDefaultFormatOverrides maps the html, json, xml, csv and txt extensions
+// and the format query parameter.
+func NewDefaultFormatOverrides() *FormatOverrides {
+    return NewFormatOverrides().
+        Add("html", MIME_TYPE_HTML).
+        Add("json", MIME_TYPE_JSON).
+        Add("xml", MIME_TYPE_XML).
+        Add("csv", MIME_TYPE_CSV).
+        Add("txt", MIME_TYPE_TEXT_PLAIN).
+        SetQueryParameter("format")
+}
+
+// Add maps extension, with or without its leading ".", to mediaType.
+func (p *FormatOverrides) Add(extension, mediaType string) *FormatOverrides {
+    p.extensions[strings.ToLower(strings.TrimPrefix(extension, "."))] = mediaType
+    return p
+}
+
+// SetQueryParameter names the query parameter whose value is looked up as
+// an extension, or "" for none.
+func (p *FormatOverrides) SetQueryParameter(name string) *FormatOverrides {
+    p.queryParameter = name
+    return p
+}
+
+// MediaType returns the media type mapped to extension.
+func (p *FormatOverrides) MediaType(extension string) (string, bool) {
+    mediaType, ok := p.extensions[strings.ToLower(strings.TrimPrefix(extension, "."))]
+    return mediaType, ok
+}
+
+// match returns the override req asks for, if any, and req with any
+// extension removed from its path.
+func (p *FormatOverrides) match(req *http.Request) (*http.Request, *formatOverride) {
+    urlPath := req.URL.Path
+    if ext := path.Ext(urlPath); len(ext) > 1 && !strings.HasSuffix(urlPath, "/") {
+        if mediaType, ok := p.MediaType(ext); ok {
+            r := *req
+            u := *req.URL
+            u.Path = urlPath[0 : len(urlPath)-len(ext)]
+            u.RawPath = ""
+            r.URL = &u
+            return &r, &formatOverride{mediaType: mediaType, contentLocation: req.URL.RequestURI()}
+        }
+    }
+    if len(p.queryParameter) == 0 {
+        return req, nil
+    }
+    query := req.URL.Query()
+    format := strings.ToLower(strings.TrimPrefix(query.Get(p.queryParameter), "."))
+    mediaType, ok := p.MediaType(format)
+    if !ok {
+        return req, nil
+    }
+    override := &formatOverride{mediaType: mediaType}
+    if !strings.HasSuffix(urlPath, "/") {
+        query.Del(p.queryParameter)
+        u := *req.URL
+        u.Path = urlPath + "." + format
+        u.RawPath = ""
+        u.RawQuery = query.Encode()
+        override.contentLocation = u.RequestURI()
+    }
+    return req, override
+}
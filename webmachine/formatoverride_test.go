@@ -0,0 +1,88 @@
+package webmachine
+
+import (
+    "io"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+type formatTestMediaTypeHandler struct {
+    mediaType string
+    body      string
+}
+
+func (p *formatTestMediaTypeHandler) MediaTypeOutput() string {
+    return p.mediaType
+}
+
+func (p *formatTestMediaTypeHandler) MediaTypeHandleOutputTo(req Request, cxt Context, writer io.Writer, resp ResponseWriter) {
+    io.WriteString(writer, p.body)
+}
+
+type formatTestResource struct {
+    DefaultRequestHandler
+    allow bool
+}
+
+func (p *formatTestResource) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    if req.URL().Path == "/report" {
+        return p
+    }
+    return nil
+}
+
+func (p *formatTestResource) ContentTypesProvided(req Request, cxt Context) ([]MediaTypeHandler, Request, Context, int, error) {
+    return []MediaTypeHandler{&formatTestMediaTypeHandler{MIME_TYPE_JSON, `{"a":1}`}, &formatTestMediaTypeHandler{MIME_TYPE_CSV, "a\n1\n"}}, req, cxt, 0, nil
+}
+
+func (p *formatTestResource) AllowFormatOverrides() bool {
+    return p.allow
+}
+
+func TestFormatOverrides(t *testing.T) {
+    dir := t.TempDir()
+    if err := os.WriteFile(filepath.Join(dir, "data.json"), []byte(`{"file":true}`), 0644); err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        allow           bool
+        url             string
+        status          int
+        contentType     string
+        contentLocation string
+        varyAccept      bool
+    }{
+        {true, "/report.csv", 200, "text/csv; charset=utf-8", "/report.csv", false},
+        {true, "/report?format=csv&x=1", 200, "text/csv; charset=utf-8", "/report.csv?x=1", false},
+        {true, "/report", 200, "application/json; charset=utf-8", "", true},
+        {true, "/report.xml", 406, "", "", true},
+        {false, "/report.csv", 400, "", "", false},
+        {false, "/report?format=csv", 200, "application/json; charset=utf-8", "", true},
+        {true, "/static/data.json", 200, "application/json; charset=utf-8", "", false},
+    }
+    for _, tt := range tests {
+        wm := NewWebMachine()
+        wm.SetFormatOverrides(NewDefaultFormatOverrides())
+        wm.AddRouteHandler(&formatTestResource{allow: tt.allow})
+        wm.AddRouteHandler(NewFileResource(dir, "/static", false, false))
+        req := httptest.NewRequest("GET", tt.url, nil)
+        req.Header.Set("Accept", "application/json")
+        rec := httptest.NewRecorder()
+        wm.ServeHTTP(rec, req)
+        if rec.Code != tt.status {
+            t.Errorf("allow=%v %s: status %d, want %d", tt.allow, tt.url, rec.Code, tt.status)
+            continue
+        }
+        if len(tt.contentType) > 0 && rec.Header().Get("Content-Type") != tt.contentType {
+            t.Errorf("allow=%v %s: Content-Type %q, want %q", tt.allow, tt.url, rec.Header().Get("Content-Type"), tt.contentType)
+        }
+        if tt.status == 200 && rec.Header().Get("Content-Location") != tt.contentLocation {
+            t.Errorf("allow=%v %s: Content-Location %q, want %q", tt.allow, tt.url, rec.Header().Get("Content-Location"), tt.contentLocation)
+        }
+        if tt.status == 200 && headerHasToken(rec.Header(), "Vary", "Accept") != tt.varyAccept {
+            t.Errorf("allow=%v %s: Vary %q", tt.allow, tt.url, rec.Header().Get("Vary"))
+        }
+    }
+}
@@ -0,0 +1,30 @@
+package webmachine
+
+import (
+    "github.com/pomack/webmachine.go/webmachine/negotiation"
+)
+
+// chooseLanguage picks the provided language tag best matching an
+// Accept-Language header, as negotiation.Language does, except that if none
+// matches the first tag provided is the default unless the header gives it a
+// q-value of 0.  It returns "" if no tag is acceptable.
+func chooseLanguage(provided []string, header string) string {
+    if language := negotiation.Language(provided, header); len(language) > 0 || len(provided) == 0 {
+        return language
+    }
+    if q, _ := negotiation.LanguageQuality(provided[0], negotiation.ParseAcceptLanguage(header)); q == 0 {
+        return ""
+    }
+    return provided[0]
+}
+
+// preferredLanguageRange returns the most preferred range in an
+// Accept-Language header other than "*", or "".
+func preferredLanguageRange(header string) string {
+    for _, pref := range negotiation.ParseAcceptLanguage(header) {
+        if pref.Value != "*" && pref.Q > 0 {
+            return pref.Value
+        }
+    }
+    return ""
+}
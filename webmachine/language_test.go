@@ -0,0 +1,76 @@
+package webmachine
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestChooseLanguage(t *testing.T) {
+    provided := []string{"en-US", "fr", "de-CH"}
+    tests := []struct {
+        header   string
+        language string
+    }{
+        {"", "en-US"},
+        {"fr", "fr"},
+        {"de", "de-CH"},
+        {"fr;q=0.5, de-CH", "de-CH"},
+        // nothing matches, so the first tag is the default
+        {"ja", "en-US"},
+        {"ja, en;q=0", ""},
+        {"ja, en-US;q=0", ""},
+        {"ja, *;q=0", ""},
+        {"*;q=0, fr", "fr"},
+    }
+    for _, tt := range tests {
+        if language := chooseLanguage(provided, tt.header); language != tt.language {
+            t.Errorf("chooseLanguage(%q) = %q, want %q", tt.header, language, tt.language)
+        }
+    }
+    if language := chooseLanguage(nil, "en"); len(language) > 0 {
+        t.Errorf("chooseLanguage(nil) = %q", language)
+    }
+}
+
+type languageTestResource struct {
+    DefaultRequestHandler
+}
+
+func (p *languageTestResource) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    return p
+}
+
+func (p *languageTestResource) ContentTypesProvided(req Request, cxt Context) ([]MediaTypeHandler, Request, Context, int, error) {
+    return []MediaTypeHandler{&formatTestMediaTypeHandler{MIME_TYPE_TEXT_PLAIN, "hello"}}, req, cxt, 0, nil
+}
+
+func (p *languageTestResource) LanguagesProvided(req Request, cxt Context) ([]string, Request, Context, int, error) {
+    return []string{"en", "fr"}, req, cxt, 0, nil
+}
+
+func TestLanguagesProvided(t *testing.T) {
+    tests := []struct {
+        header   string
+        status   int
+        language string
+    }{
+        {"", http.StatusOK, "en"},
+        {"fr-CA, en;q=0.5", http.StatusOK, "fr"},
+        {"ja", http.StatusOK, "en"},
+        {"ja, en;q=0", http.StatusNotAcceptable, ""},
+    }
+    for _, tt := range tests {
+        wm := NewWebMachine()
+        wm.AddRouteHandler(new(languageTestResource))
+        req := httptest.NewRequest(GET, "/", nil)
+        if len(tt.header) > 0 {
+            req.Header.Set("Accept-Language", tt.header)
+        }
+        rec := httptest.NewRecorder()
+        wm.ServeHTTP(rec, req)
+        if rec.Code != tt.status || rec.Header().Get("Content-Language") != tt.language {
+            t.Errorf("Accept-Language %q: status %d, Content-Language %q, want %d, %q", tt.header, rec.Code, rec.Header().Get("Content-Language"), tt.status, tt.language)
+        }
+    }
+}
@@ -0,0 +1,138 @@
+package webmachine
+
+import (
+    "fmt"
+    "log"
+    "sort"
+    "strings"
+)
+
+type LogLevel int
+
+const (
+    LOG_LEVEL_DEBUG LogLevel = iota
+    LOG_LEVEL_INFO
+    LOG_LEVEL_WARN
+    LOG_LEVEL_ERROR
+)
+
+// LogFields are the structured key/value pairs attached to a log entry, e.g.
+// "method", "path", "decision" and "resource".
+type LogFields map[string]interface{}
+
+// Logger receives log entries from the WebMachine.  Enabled lets callers
+// skip building entries nobody will see.
+type Logger interface {
+    Enabled(level LogLevel) bool
+    Log(level LogLevel, msg string, fields LogFields)
+}
+
+func (p LogLevel) String() string {
+    switch p {
+    case LOG_LEVEL_DEBUG:
+        return "DEBUG"
+    case LOG_LEVEL_INFO:
+        return "INFO"
+    case LOG_LEVEL_WARN:
+        return "WARN"
+    case LOG_LEVEL_ERROR:
+        return "ERROR"
+    }
+    return "UNKNOWN"
+}
+
+type noopLogger struct{}
+
+// NewNoopLogger returns a Logger that discards everything.  It is the
+// default for a WebMachine.
+func NewNoopLogger() Logger {
+    return noopLogger{}
+}
+
+func (p noopLogger) Enabled(level LogLevel) bool {
+    return false
+}
+
+func (p noopLogger) Log(level LogLevel, msg string, fields LogFields) {
+}
+
+type standardLogger struct {
+    logger   *log.Logger
+    minLevel LogLevel
+}
+
+// NewStandardLogger writes entries at or above minLevel to logger, or to the
+// standard log package if logger is nil.
+func NewStandardLogger(logger *log.Logger, minLevel LogLevel) Logger {
+    return &standardLogger{logger: logger, minLevel: minLevel}
+}
+
+func (p *standardLogger) Enabled(level LogLevel) bool {
+    return level >= p.minLevel
+}
+
+func (p *standardLogger) Log(level LogLevel, msg string, fields LogFields) {
+    if !p.Enabled(level) {
+        return
+    }
+    keys := make([]string, 0, len(fields))
+    for k := range fields {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    parts := make([]string, 0, len(keys)+2)
+    parts = append(parts, "[WM] "+level.String(), msg)
+    for _, k := range keys {
+        parts = append(parts, k+"="+fmt.Sprint(fields[k]))
+    }
+    s := strings.Join(parts, " ")
+    if p.logger != nil {
+        p.logger.Print(s)
+    } else {
+        log.Print(s)
+    }
+}
+
+// fieldLogger adds a fixed set of fields to every entry it passes on.
+type fieldLogger struct {
+    logger Logger
+    fields LogFields
+}
+
+func withLogFields(logger Logger, fields LogFields) Logger {
+    if logger == nil {
+        return NewNoopLogger()
+    }
+    if _, ok := logger.(noopLogger); ok {
+        return logger
+    }
+    if fl, ok := logger.(*fieldLogger); ok {
+        merged := make(LogFields, len(fl.fields)+len(fields))
+        for k, v := range fl.fields {
+            merged[k] = v
+        }
+        for k, v := range fields {
+            merged[k] = v
+        }
+        return &fieldLogger{logger: fl.logger, fields: merged}
+    }
+    return &fieldLogger{logger: logger, fields: fields}
+}
+
+func (p *fieldLogger) Enabled(level LogLevel) bool {
+    return p.logger.Enabled(level)
+}
+
+func (p *fieldLogger) Log(level LogLevel, msg string, fields LogFields) {
+    if !p.logger.Enabled(level) {
+        return
+    }
+    merged := make(LogFields, len(p.fields)+len(fields))
+    for k, v := range p.fields {
+        merged[k] = v
+    }
+    for k, v := range fields {
+        merged[k] = v
+    }
+    p.logger.Log(level, msg, merged)
+}
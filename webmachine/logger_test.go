@@ -0,0 +1,94 @@
+package webmachine
+
+import (
+    "bytes"
+    "log"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestStandardLoggerLevels(t *testing.T) {
+    var buf bytes.Buffer
+    logger := NewStandardLogger(log.New(&buf, "", 0), LOG_LEVEL_WARN)
+    for level, enabled := range map[LogLevel]bool{LOG_LEVEL_DEBUG: false, LOG_LEVEL_INFO: false, LOG_LEVEL_WARN: true, LOG_LEVEL_ERROR: true} {
+        if logger.Enabled(level) != enabled {
+            t.Errorf("Enabled(%v) = %v", level, !enabled)
+        }
+    }
+    logger.Log(LOG_LEVEL_DEBUG, "debug", nil)
+    logger.Log(LOG_LEVEL_INFO, "info", LogFields{"a": 1})
+    logger.Log(LOG_LEVEL_WARN, "warn", nil)
+    logger.Log(LOG_LEVEL_ERROR, "error", LogFields{"b": "x", "a": 1})
+    if want := "[WM] WARN warn\n[WM] ERROR error a=1 b=x\n"; buf.String() != want {
+        t.Errorf("logged %q, want %q", buf.String(), want)
+    }
+    if NewNoopLogger().Enabled(LOG_LEVEL_ERROR) {
+        t.Error("the no-op logger is enabled")
+    }
+}
+
+func TestLogFields(t *testing.T) {
+    var buf bytes.Buffer
+    logger := withLogFields(NewStandardLogger(log.New(&buf, "", 0), LOG_LEVEL_INFO), LogFields{"method": GET, "path": "/a"})
+    logger = withLogFields(logger, LogFields{"resource": "r"})
+    logger.Log(LOG_LEVEL_DEBUG, "hidden", nil)
+    logger.Log(LOG_LEVEL_INFO, "shown", LogFields{"path": "/b", "status": 200})
+    if want := "[WM] INFO shown method=GET path=/b resource=r status=200\n"; buf.String() != want {
+        t.Errorf("logged %q, want %q", buf.String(), want)
+    }
+    if _, ok := withLogFields(NewNoopLogger(), LogFields{"a": 1}).(noopLogger); !ok {
+        t.Error("fields were added to the no-op logger")
+    }
+}
+
+func TestRequestLogging(t *testing.T) {
+    const secret = "secret body text"
+    var buf bytes.Buffer
+    wm := NewWebMachine()
+    wm.SetLogger(NewStandardLogger(log.New(&buf, "", 0), LOG_LEVEL_DEBUG))
+    wm.AddRouteHandler(&secretTestResource{secret})
+    rec := httptest.NewRecorder()
+    wm.ServeHTTP(rec, httptest.NewRequest(GET, "/thing?q=1", nil))
+    if rec.Code != http.StatusOK || rec.Body.String() != secret {
+        t.Fatalf("%d %q", rec.Code, rec.Body.String())
+    }
+    lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+    decisions := 0
+    for _, line := range lines {
+        if !strings.Contains(line, " method=GET ") || !strings.Contains(line, " path=/thing") {
+            t.Errorf("entry without the request's fields: %q", line)
+        }
+        if strings.Contains(line, " decision=") {
+            decisions++
+            if !strings.Contains(line, " resource=*webmachine.secretTestHandler") {
+                t.Errorf("decision entry without the resource: %q", line)
+            }
+        }
+    }
+    if decisions == 0 {
+        t.Errorf("no decisions logged: %q", lines)
+    }
+    // the responseWriter does not log what it writes
+    if strings.Contains(buf.String(), secret) {
+        t.Errorf("response body logged: %q", buf.String())
+    }
+}
+
+type secretTestResource struct {
+    body string
+}
+
+func (p *secretTestResource) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    return &secretTestHandler{body: p.body}
+}
+
+type secretTestHandler struct {
+    DefaultRequestHandler
+    body string
+}
+
+func (p *secretTestHandler) ContentTypesProvided(req Request, cxt Context) ([]MediaTypeHandler, Request, Context, int, error) {
+    return []MediaTypeHandler{&formatTestMediaTypeHandler{MIME_TYPE_TEXT_PLAIN, p.body}}, req, cxt, 0, nil
+}
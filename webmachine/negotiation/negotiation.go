@@ -0,0 +1,368 @@
+// Package negotiation implements the proactive content negotiation of RFC
+// 7231 section 5.3 for the Accept, Accept-Charset, Accept-Encoding and
+// Accept-Language headers.
+package negotiation
+
+import (
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Preference is one entry of an Accept style header.
+type Preference struct {
+    // Value is the lower-cased media range, charset, content coding or
+    // language range.
+    Value string
+    // Params holds the media range parameters other than q, with lower-cased
+    // names.  Accept extensions following q are dropped.
+    Params map[string]string
+    // Q is the quality from 0 to 1, defaulting to 1.  An invalid q is 0.
+    Q float64
+}
+
+// Specificity ranks how narrowly the preference matches: 0 for "*" and
+// "*/*", 1 for "type/*", 2 for "type/subtype" plus one per parameter, and
+// for language ranges the number of subtags.
+func (p Preference) Specificity() int {
+    if p.Value == "*" || p.Value == "*/*" {
+        return 0
+    }
+    if i := strings.Index(p.Value, "/"); i >= 0 {
+        if p.Value[i+1:] == "*" {
+            return 1
+        }
+        return 2 + len(p.Params)
+    }
+    return strings.Count(p.Value, "-") + 1
+}
+
+// ParseAccept parses an Accept header into media ranges, most preferred
+// first: by q-value, then by specificity, then in the order given.
+func ParseAccept(header string) []Preference {
+    prefs := parse(header, true)
+    sort.SliceStable(prefs, func(i, j int) bool {
+        if prefs[i].Q != prefs[j].Q {
+            return prefs[i].Q > prefs[j].Q
+        }
+        return prefs[i].Specificity() > prefs[j].Specificity()
+    })
+    return prefs
+}
+
+// ParseAcceptCharset parses an Accept-Charset header, most preferred first.
+func ParseAcceptCharset(header string) []Preference {
+    return byQuality(parse(header, false))
+}
+
+// ParseAcceptEncoding parses an Accept-Encoding header, most preferred
+// first.  The x-gzip and x-compress aliases become gzip and compress.
+func ParseAcceptEncoding(header string) []Preference {
+    prefs := parse(header, false)
+    for i := range prefs {
+        prefs[i].Value = canonicalEncoding(prefs[i].Value)
+    }
+    return byQuality(prefs)
+}
+
+// ParseAcceptLanguage parses an Accept-Language header, most preferred
+// first.
+func ParseAcceptLanguage(header string) []Preference {
+    return byQuality(parse(header, false))
+}
+
+// MediaTypeQuality returns the q-value prefs give mediaType, taken from the
+// most specific media range matching it, and that range's specificity.  A
+// range only matches if mediaType has each of its parameters.  q is -1 if no
+// range matches.
+func MediaTypeQuality(mediaType string, prefs []Preference) (q float64, specificity int) {
+    offer := parseMediaType(mediaType)
+    q, specificity = -1, -1
+    for _, pref := range prefs {
+        if !mediaRangeMatches(pref, offer) {
+            continue
+        }
+        if s := pref.Specificity(); s > specificity {
+            q, specificity = pref.Q, s
+        }
+    }
+    return q, specificity
+}
+
+// MediaRangeMatches reports whether mediaType falls within mediaRange,
+// parameters included, and how specific mediaRange is.
+func MediaRangeMatches(mediaRange, mediaType string) (bool, int) {
+    pref := parseMediaType(mediaRange)
+    return mediaRangeMatches(pref, parseMediaType(mediaType)), pref.Specificity()
+}
+
+// CharsetQuality returns the q-value prefs give charset, or -1 if they do
+// not mention it.
+func CharsetQuality(charset string, prefs []Preference) float64 {
+    return exactOrStarQuality(strings.ToLower(strings.TrimSpace(charset)), prefs)
+}
+
+// EncodingQuality returns the q-value prefs give a content coding, or -1 if
+// they do not mention it.  identity is always acceptable, with the lowest
+// preference, unless excluded by "identity;q=0" or "*;q=0".
+func EncodingQuality(coding string, prefs []Preference) float64 {
+    coding = canonicalEncoding(coding)
+    q := exactOrStarQuality(coding, prefs)
+    if q < 0 && coding == "identity" {
+        return 0.001
+    }
+    return q
+}
+
+// LanguageQuality returns the q-value prefs give a language tag.  As in RFC
+// 4647 basic filtering, the most specific range equal to the tag or to a
+// prefix of it ending before a "-" gives the q-value, so "en, en-gb;q=0"
+// accepts en-US but not en-GB.  Failing that the tag may be found by lookup,
+// truncating the most preferred range it is a prefix of, e.g. "de-ch-1996"
+// finds "de", in which case filtered is false.  q is -1 if neither matches.
+func LanguageQuality(tag string, prefs []Preference) (q float64, filtered bool) {
+    tag = strings.ToLower(strings.TrimSpace(tag))
+    q = -1
+    longest := -1
+    for _, pref := range prefs {
+        if pref.Value == "*" || pref.Value == tag || strings.HasPrefix(tag, pref.Value+"-") {
+            if s := pref.Specificity(); s > longest {
+                q, longest = pref.Q, s
+            }
+        }
+    }
+    if longest >= 0 {
+        return q, true
+    }
+    for _, pref := range prefs {
+        if pref.Q > 0 && strings.HasPrefix(pref.Value, tag+"-") {
+            return pref.Q, false
+        }
+    }
+    return -1, false
+}
+
+// MediaType returns the offer the Accept header prefers, or "" if none is
+// acceptable.  Ties go to the offer matched by the more specific range and
+// then to the earlier offer.  An empty header accepts the first offer.
+func MediaType(offers []string, header string) string {
+    if len(strings.TrimSpace(header)) == 0 {
+        return first(offers)
+    }
+    prefs := ParseAccept(header)
+    best := ""
+    bestQ := 0.0
+    bestSpecificity := -1
+    for _, offer := range offers {
+        q, specificity := MediaTypeQuality(offer, prefs)
+        if q <= 0 {
+            continue
+        }
+        if q > bestQ || (q == bestQ && specificity > bestSpecificity) {
+            best, bestQ, bestSpecificity = offer, q, specificity
+        }
+    }
+    return best
+}
+
+// Charset returns the offer the Accept-Charset header prefers, or "" if none
+// is acceptable.  An empty header accepts the first offer.
+func Charset(offers []string, header string) string {
+    if len(strings.TrimSpace(header)) == 0 {
+        return first(offers)
+    }
+    prefs := ParseAcceptCharset(header)
+    return best(offers, func(offer string) float64 { return CharsetQuality(offer, prefs) })
+}
+
+// Encoding returns the content coding the Accept-Encoding header prefers, or
+// "" if none is acceptable.  An empty header is taken to be missing, so the
+// first offer is accepted; a header present with an empty value should be
+// passed as "identity".
+func Encoding(offers []string, header string) string {
+    if len(strings.TrimSpace(header)) == 0 {
+        return first(offers)
+    }
+    prefs := ParseAcceptEncoding(header)
+    return best(offers, func(offer string) float64 { return EncodingQuality(offer, prefs) })
+}
+
+// Language returns the language tag the Accept-Language header prefers, or
+// "" if none is acceptable.  Tags found by filtering win ties with tags only
+// found by lookup.  An empty header accepts the first offer.
+func Language(offers []string, header string) string {
+    if len(strings.TrimSpace(header)) == 0 {
+        return first(offers)
+    }
+    prefs := ParseAcceptLanguage(header)
+    best := ""
+    bestQ := 0.0
+    bestFiltered := false
+    for _, offer := range offers {
+        q, filtered := LanguageQuality(offer, prefs)
+        if q <= 0 {
+            continue
+        }
+        if q > bestQ || (q == bestQ && filtered && !bestFiltered) {
+            best, bestQ, bestFiltered = offer, q, filtered
+        }
+    }
+    return best
+}
+
+func first(offers []string) string {
+    if len(offers) == 0 {
+        return ""
+    }
+    return offers[0]
+}
+
+func best(offers []string, quality func(string) float64) string {
+    best := ""
+    bestQ := 0.0
+    for _, offer := range offers {
+        if q := quality(offer); q > bestQ {
+            best, bestQ = offer, q
+        }
+    }
+    return best
+}
+
+func byQuality(prefs []Preference) []Preference {
+    sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].Q > prefs[j].Q })
+    return prefs
+}
+
+func exactOrStarQuality(value string, prefs []Preference) float64 {
+    q := -1.0
+    for _, pref := range prefs {
+        if pref.Value == value {
+            return pref.Q
+        }
+        if pref.Value == "*" && q < 0 {
+            q = pref.Q
+        }
+    }
+    return q
+}
+
+func canonicalEncoding(coding string) string {
+    coding = strings.ToLower(strings.TrimSpace(coding))
+    switch coding {
+    case "x-gzip":
+        return "gzip"
+    case "x-compress":
+        return "compress"
+    }
+    return coding
+}
+
+func parseMediaType(mediaType string) Preference {
+    prefs := parse(mediaType, true)
+    if len(prefs) == 0 {
+        return Preference{}
+    }
+    return prefs[0]
+}
+
+func mediaRangeMatches(mediaRange, offer Preference) bool {
+    rangeType, rangeSubtype := splitMediaType(mediaRange.Value)
+    offerType, offerSubtype := splitMediaType(offer.Value)
+    if len(offerType) == 0 {
+        return false
+    }
+    if rangeType != "*" && rangeType != offerType {
+        return false
+    }
+    if rangeSubtype != "*" && rangeSubtype != offerSubtype {
+        return false
+    }
+    for k, v := range mediaRange.Params {
+        if ov, ok := offer.Params[k]; !ok || !strings.EqualFold(ov, v) {
+            return false
+        }
+    }
+    return true
+}
+
+func splitMediaType(mediaType string) (string, string) {
+    if i := strings.Index(mediaType, "/"); i >= 0 {
+        return mediaType[0:i], mediaType[i+1:]
+    }
+    if mediaType == "*" {
+        return "*", "*"
+    }
+    return "", ""
+}
+
+// parse splits a header into its comma separated elements, allowing for
+// quoted parameter values.  With params set the parameters before q are
+// kept.
+func parse(header string, params bool) []Preference {
+    var prefs []Preference
+    for _, element := range splitOutsideQuotes(header, ',') {
+        parts := splitOutsideQuotes(element, ';')
+        value := strings.ToLower(strings.TrimSpace(parts[0]))
+        if len(value) == 0 {
+            continue
+        }
+        pref := Preference{Value: value, Q: 1}
+        for _, part := range parts[1:] {
+            kv := strings.SplitN(part, "=", 2)
+            k := strings.ToLower(strings.TrimSpace(kv[0]))
+            v := ""
+            if len(kv) == 2 {
+                v = unquote(strings.TrimSpace(kv[1]))
+            }
+            if k == "q" {
+                q, err := strconv.ParseFloat(v, 64)
+                if err != nil || q < 0 || q > 1 {
+                    q = 0
+                }
+                pref.Q = q
+                break
+            }
+            if params && len(k) > 0 {
+                if pref.Params == nil {
+                    pref.Params = make(map[string]string)
+                }
+                pref.Params[k] = v
+            }
+        }
+        prefs = append(prefs, pref)
+    }
+    return prefs
+}
+
+func splitOutsideQuotes(s string, sep byte) []string {
+    var parts []string
+    quoted := false
+    start := 0
+    for i := 0; i < len(s); i++ {
+        switch {
+        case s[i] == '\\' && quoted:
+            i++
+        case s[i] == '"':
+            quoted = !quoted
+        case s[i] == sep && !quoted:
+            parts = append(parts, s[start:i])
+            start = i + 1
+        }
+    }
+    return append(parts, s[start:])
+}
+
+func unquote(s string) string {
+    if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+        return s
+    }
+    s = s[1 : len(s)-1]
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        if s[i] == '\\' && i+1 < len(s) {
+            i++
+        }
+        b.WriteByte(s[i])
+    }
+    return b.String()
+}
@@ -0,0 +1,205 @@
+package negotiation
+
+import (
+    "testing"
+)
+
+func TestParseAccept(t *testing.T) {
+    prefs := ParseAccept(`text/*;q=0.5, text/html;level=1, text/html, */*;q=0.1, application/json;q=bogus, text/plain;format="a,b";q=0.5`)
+    want := []struct {
+        value  string
+        q      float64
+        params int
+    }{
+        {"text/html", 1, 1},
+        {"text/html", 1, 0},
+        {"text/plain", 0.5, 1},
+        {"text/*", 0.5, 0},
+        {"*/*", 0.1, 0},
+        {"application/json", 0, 0},
+    }
+    if len(prefs) != len(want) {
+        t.Fatalf("got %d preferences, want %d: %v", len(prefs), len(want), prefs)
+    }
+    for i, w := range want {
+        if prefs[i].Value != w.value || prefs[i].Q != w.q || len(prefs[i].Params) != w.params {
+            t.Errorf("preference %d = %+v, want %+v", i, prefs[i], w)
+        }
+    }
+    if prefs[2].Params["format"] != "a,b" {
+        t.Errorf("quoted parameter = %q, want %q", prefs[2].Params["format"], "a,b")
+    }
+}
+
+func TestMediaType(t *testing.T) {
+    tests := []struct {
+        offers []string
+        header string
+        want   string
+    }{
+        {[]string{"text/html", "application/json"}, "", "text/html"},
+        {[]string{"text/html", "application/json"}, "application/json", "application/json"},
+        {[]string{"text/html", "application/json"}, "application/json;q=0, */*", "text/html"},
+        {[]string{"application/json"}, "application/json;q=0, */*", ""},
+        {[]string{"text/html", "text/plain"}, "text/*;q=0.5, text/plain", "text/plain"},
+        {[]string{"text/html", "text/plain"}, "*/*", "text/html"},
+        // the most specific range decides an offer's q-value
+        {[]string{"text/html", "text/plain"}, "text/*, text/html;q=0.2", "text/plain"},
+        // parameters narrow a range and take precedence
+        {[]string{"text/html;level=1", "text/html"}, "text/html;level=1;q=0.3, text/html", "text/html"},
+        {[]string{"text/html", "text/html;level=1"}, "text/html;level=1, text/html;q=0.3", "text/html;level=1"},
+        // on equal q the more specific match wins
+        {[]string{"text/plain", "application/json"}, "*/*, application/json", "application/json"},
+        {[]string{"text/plain"}, "application/json", ""},
+        {[]string{"text/plain"}, "*/*;q=0", ""},
+    }
+    for _, tt := range tests {
+        if got := MediaType(tt.offers, tt.header); got != tt.want {
+            t.Errorf("MediaType(%v, %q) = %q, want %q", tt.offers, tt.header, got, tt.want)
+        }
+    }
+}
+
+func TestMediaRangeMatches(t *testing.T) {
+    tests := []struct {
+        mediaRange  string
+        mediaType   string
+        matches     bool
+        specificity int
+    }{
+        {"*/*", "text/html", true, 0},
+        {"*", "text/html", true, 0},
+        {"text/*", "text/html", true, 1},
+        {"text/*", "application/json", false, 1},
+        {"text/html", "text/html", true, 2},
+        {"TEXT/HTML", "text/html; charset=utf-8", true, 2},
+        {"text/html;charset=utf-8", "text/html;charset=UTF-8", true, 3},
+        {"text/html;charset=utf-8", "text/html", false, 3},
+        {"text/html;level=1", "text/html;level=2", false, 3},
+        {"text/html", "text/plain", false, 2},
+        {"text/html", "", false, 2},
+    }
+    for _, tt := range tests {
+        matches, specificity := MediaRangeMatches(tt.mediaRange, tt.mediaType)
+        if matches != tt.matches || specificity != tt.specificity {
+            t.Errorf("MediaRangeMatches(%q, %q) = %v, %d, want %v, %d", tt.mediaRange, tt.mediaType, matches, specificity, tt.matches, tt.specificity)
+        }
+    }
+}
+
+func TestCharset(t *testing.T) {
+    tests := []struct {
+        offers []string
+        header string
+        want   string
+    }{
+        {[]string{"utf-8", "iso-8859-1"}, "", "utf-8"},
+        {[]string{"utf-8", "iso-8859-1"}, "iso-8859-1", "iso-8859-1"},
+        {[]string{"utf-8", "iso-8859-1"}, "ISO-8859-1, utf-8;q=0.5", "iso-8859-1"},
+        {[]string{"utf-8", "iso-8859-1"}, "utf-8;q=0, *", "iso-8859-1"},
+        {[]string{"utf-8"}, "*;q=0", ""},
+        {[]string{"utf-8"}, "iso-8859-1", ""},
+    }
+    for _, tt := range tests {
+        if got := Charset(tt.offers, tt.header); got != tt.want {
+            t.Errorf("Charset(%v, %q) = %q, want %q", tt.offers, tt.header, got, tt.want)
+        }
+    }
+}
+
+func TestEncodingQuality(t *testing.T) {
+    tests := []struct {
+        coding string
+        header string
+        want   float64
+    }{
+        {"gzip", "gzip", 1},
+        {"gzip", "x-gzip;q=0.5", 0.5},
+        {"gzip", "deflate", -1},
+        {"gzip", "*;q=0.3", 0.3},
+        {"gzip", "gzip;q=0, *", 0},
+        {"identity", "gzip", 0.001},
+        {"identity", "gzip, identity;q=0", 0},
+        {"identity", "gzip, *;q=0", 0},
+        {"identity", "identity;q=0.5, *;q=0", 0.5},
+    }
+    for _, tt := range tests {
+        if got := EncodingQuality(tt.coding, ParseAcceptEncoding(tt.header)); got != tt.want {
+            t.Errorf("EncodingQuality(%q, %q) = %v, want %v", tt.coding, tt.header, got, tt.want)
+        }
+    }
+}
+
+func TestEncoding(t *testing.T) {
+    tests := []struct {
+        offers []string
+        header string
+        want   string
+    }{
+        {[]string{"gzip", "identity"}, "", "gzip"},
+        {[]string{"gzip", "identity"}, "gzip", "gzip"},
+        {[]string{"gzip", "identity"}, "deflate", "identity"},
+        {[]string{"gzip", "identity"}, "identity", "identity"},
+        {[]string{"gzip", "identity"}, "deflate, identity;q=0", ""},
+        {[]string{"gzip", "identity"}, "deflate, *;q=0", ""},
+        {[]string{"gzip", "identity"}, "gzip;q=0", "identity"},
+    }
+    for _, tt := range tests {
+        if got := Encoding(tt.offers, tt.header); got != tt.want {
+            t.Errorf("Encoding(%v, %q) = %q, want %q", tt.offers, tt.header, got, tt.want)
+        }
+    }
+}
+
+func TestLanguageQuality(t *testing.T) {
+    tests := []struct {
+        tag      string
+        header   string
+        q        float64
+        filtered bool
+    }{
+        // basic filtering: a range matches the tag or a prefix ending at "-"
+        {"en-us", "en", 1, true},
+        {"en", "en", 1, true},
+        {"eng", "en", -1, false},
+        {"en-gb", "en, en-gb;q=0", 0, true},
+        {"en-us", "en, en-gb;q=0", 1, true},
+        {"en-us", "en;q=0.5, en-us;q=0.8", 0.8, true},
+        {"fr", "*;q=0.1, en", 0.1, true},
+        {"fr", "*;q=0", 0, true},
+        // lookup: the tag is a truncation of a range
+        {"de", "de-ch-1996", 1, false},
+        {"de-ch", "de-ch-1996;q=0.7", 0.7, false},
+        {"de", "de-ch;q=0", -1, false},
+        {"fr", "en", -1, false},
+    }
+    for _, tt := range tests {
+        q, filtered := LanguageQuality(tt.tag, ParseAcceptLanguage(tt.header))
+        if q != tt.q || filtered != tt.filtered {
+            t.Errorf("LanguageQuality(%q, %q) = %v, %v, want %v, %v", tt.tag, tt.header, q, filtered, tt.q, tt.filtered)
+        }
+    }
+}
+
+func TestLanguage(t *testing.T) {
+    tests := []struct {
+        offers []string
+        header string
+        want   string
+    }{
+        {[]string{"en", "fr"}, "", "en"},
+        {[]string{"en", "fr"}, "fr", "fr"},
+        {[]string{"en-US", "fr"}, "en", "en-US"},
+        {[]string{"en-GB", "en-US"}, "en, en-gb;q=0", "en-US"},
+        // a filtered match wins a tie with a lookup match
+        {[]string{"de", "de-CH-1996"}, "de-ch-1996", "de-CH-1996"},
+        {[]string{"de", "fr"}, "de-ch-1996, fr;q=0.5", "de"},
+        {[]string{"en", "fr"}, "de", ""},
+        {[]string{"en", "fr"}, "*;q=0", ""},
+    }
+    for _, tt := range tests {
+        if got := Language(tt.offers, tt.header); got != tt.want {
+            t.Errorf("Language(%v, %q) = %q, want %q", tt.offers, tt.header, got, tt.want)
+        }
+    }
+}
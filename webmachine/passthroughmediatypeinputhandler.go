@@ -3,7 +3,6 @@ package webmachine
 import (
     "encoding/json"
     "io"
-    "log"
     "net/http"
     "os"
     "path"
@@ -73,7 +72,7 @@ func (p *PassThroughMediaTypeInputHandler) MediaTypeHandleInputFrom(req Request,
     }()
     if fileInfo == nil {
         if err = os.MkdirAll(dirname, 0644); err != nil {
-            log.Print("[PTMTIH]: Unable to create directory to store file due to error: ", err)
+            req.Logger().Log(LOG_LEVEL_ERROR, "unable to create directory to store file", LogFields{"directory": dirname, "error": err})
             headers := make(http.Header)
             //headers.Set("Content-Type", MIME_TYPE_JSON)
             m["status"] = "error"
@@ -82,7 +81,7 @@ func (p *PassThroughMediaTypeInputHandler) MediaTypeHandleInputFrom(req Request,
             return http.StatusInternalServerError, headers, newJSONWriter(m)
         }
         if file, err = os.OpenFile(p.filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
-            log.Print("[PTMTIH]: Unable to create file named: \"", p.filename, "\" due to error: ", err)
+            req.Logger().Log(LOG_LEVEL_ERROR, "unable to create file", LogFields{"filename": p.filename, "error": err})
             headers := make(http.Header)
             //headers.Set("Content-Type", MIME_TYPE_JSON)
             m["status"] = "error"
@@ -97,7 +96,7 @@ func (p *PassThroughMediaTypeInputHandler) MediaTypeHandleInputFrom(req Request,
             file, err = os.OpenFile(p.filename, os.O_WRONLY|os.O_TRUNC, 0644)
         }
         if err != nil {
-            log.Print("[PTMTIH]: Unable to open file \"", p.filename, "\"for writing due to error: ", err)
+            req.Logger().Log(LOG_LEVEL_ERROR, "unable to open file for writing", LogFields{"filename": p.filename, "error": err})
             headers := make(http.Header)
             //headers.Set("Content-Type", MIME_TYPE_JSON)
             m["status"] = "error"
@@ -112,7 +111,7 @@ func (p *PassThroughMediaTypeInputHandler) MediaTypeHandleInputFrom(req Request,
     } else {
         n, err = io.Copy(file, p.reader)
     }
-    log.Print("[PTMTIH]: Wrote ", n, " bytes to file with error: ", err)
+    req.Logger().Log(LOG_LEVEL_DEBUG, "wrote file", LogFields{"filename": p.filename, "bytes": n, "error": err})
     if err != nil && err != io.EOF {
         headers := make(http.Header)
         //headers.Set("Content-Type", MIME_TYPE_JSON)
@@ -0,0 +1,203 @@
+package webmachine
+
+import (
+    "io"
+    "mime/multipart"
+    "net/http"
+    "net/textproto"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// byteRange is the satisfiable range [start, start+length) of a
+// representation.
+type byteRange struct {
+    start  int64
+    length int64
+}
+
+func (p byteRange) contentRange(size int64) string {
+    return "bytes " + strconv.FormatInt(p.start, 10) + "-" + strconv.FormatInt(p.start+p.length-1, 10) + "/" + strconv.FormatInt(size, 10)
+}
+
+// parseRangeHeader parses a Range header for a representation of size bytes
+// as described in RFC 7233 section 2.1.  ok is false if the header should be
+// ignored because it is missing, is not in bytes or is malformed, including
+// when it has no range specs at all.  Otherwise
+// ranges holds the satisfiable ranges, sorted with overlapping and adjacent
+// ranges coalesced, and is empty if none could be satisfied.
+func parseRangeHeader(header string, size int64) (ranges []byteRange, ok bool) {
+    header = strings.TrimSpace(header)
+    if !strings.HasPrefix(header, "bytes=") {
+        return nil, false
+    }
+    specs := 0
+    for _, spec := range strings.Split(header[len("bytes="):], ",") {
+        spec = strings.TrimSpace(spec)
+        if len(spec) == 0 {
+            continue
+        }
+        specs++
+        dashIndex := strings.Index(spec, "-")
+        if dashIndex < 0 {
+            return nil, false
+        }
+        first := strings.TrimSpace(spec[0:dashIndex])
+        last := strings.TrimSpace(spec[dashIndex+1:])
+        var r byteRange
+        if len(first) == 0 {
+            // suffix range, e.g. -500 for the last 500 bytes
+            n, err := strconv.ParseInt(last, 10, 64)
+            if err != nil || n < 0 {
+                return nil, false
+            }
+            if n == 0 || size == 0 {
+                continue
+            }
+            if n > size {
+                n = size
+            }
+            r.start = size - n
+            r.length = n
+        } else {
+            start, err := strconv.ParseInt(first, 10, 64)
+            if err != nil || start < 0 {
+                return nil, false
+            }
+            end := size - 1
+            if len(last) > 0 {
+                end, err = strconv.ParseInt(last, 10, 64)
+                if err != nil || end < start {
+                    return nil, false
+                }
+                if end >= size {
+                    end = size - 1
+                }
+            }
+            if start >= size {
+                continue
+            }
+            r.start = start
+            r.length = end - start + 1
+        }
+        ranges = append(ranges, r)
+    }
+    if specs == 0 {
+        return nil, false
+    }
+    sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+    coalesced := ranges[:0]
+    for _, r := range ranges {
+        if n := len(coalesced); n > 0 && coalesced[n-1].start+coalesced[n-1].length >= r.start {
+            if end := r.start + r.length; end > coalesced[n-1].start+coalesced[n-1].length {
+                coalesced[n-1].length = end - coalesced[n-1].start
+            }
+            continue
+        }
+        coalesced = append(coalesced, r)
+    }
+    return coalesced, true
+}
+
+// serveContent writes the size bytes read from content to w, honouring the
+// request's Range header for GET requests.  It sends 206 with Content-Range
+// for one range, a multipart/byteranges body for several and 416 if none can
+// be satisfied; otherwise statusCode (200 if not set) and the whole content.
+// Ranges and Content-Length refer to the bytes sent, so when a
+// Content-Encoding applies or may yet be applied by resp, or w transforms
+// the content on its way to resp, the whole content is sent without a length.
+func serveContent(req Request, resp ResponseWriter, w io.Writer, content io.Reader, size int64, statusCode int) {
+    headers := resp.Header()
+    if statusCode <= 0 {
+        statusCode = http.StatusOK
+    }
+    encoding := headers.Get("Content-Encoding")
+    _, encoded := resp.(*encodingResponseWriter)
+    transformed := encoded || (len(encoding) > 0 && encoding != ENCODING_IDENTITY) || w != io.Writer(resp)
+    setLength := !transformed
+    var ranges []byteRange
+    ok := false
+    if transformed {
+        headers.Set("Accept-Ranges", "none")
+    } else {
+        headers.Set("Accept-Ranges", "bytes")
+    }
+    if !transformed && req.Method() == GET && statusCode == http.StatusOK && size >= 0 {
+        ranges, ok = parseRangeHeader(req.Header().Get("Range"), size)
+    }
+    if !ok {
+        if setLength && size >= 0 {
+            headers.Set("Content-Length", strconv.FormatInt(size, 10))
+        }
+        resp.WriteHeader(statusCode)
+        if req.Method() != HEAD {
+            if size >= 0 {
+                io.CopyN(w, content, size)
+            } else {
+                io.Copy(w, content)
+            }
+        }
+        return
+    }
+    if len(ranges) == 0 {
+        headers.Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+        headers.Del("Content-Length")
+        resp.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+        return
+    }
+    offset := int64(0)
+    if len(ranges) == 1 {
+        r := ranges[0]
+        headers.Set("Content-Range", r.contentRange(size))
+        if setLength {
+            headers.Set("Content-Length", strconv.FormatInt(r.length, 10))
+        }
+        resp.WriteHeader(http.StatusPartialContent)
+        if seekTo(content, &offset, r.start) == nil {
+            io.CopyN(w, content, r.length)
+        }
+        return
+    }
+    contentType := headers.Get("Content-Type")
+    mw := multipart.NewWriter(w)
+    headers.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+    headers.Del("Content-Length")
+    resp.WriteHeader(http.StatusPartialContent)
+    for _, r := range ranges {
+        partHeader := make(textproto.MIMEHeader)
+        if len(contentType) > 0 {
+            partHeader.Set("Content-Type", contentType)
+        }
+        partHeader.Set("Content-Range", r.contentRange(size))
+        part, err := mw.CreatePart(partHeader)
+        if err != nil {
+            return
+        }
+        if err = seekTo(content, &offset, r.start); err != nil {
+            return
+        }
+        n, err := io.CopyN(part, content, r.length)
+        offset += n
+        if err != nil {
+            return
+        }
+    }
+    mw.Close()
+}
+
+// seekTo moves content from *offset to target, seeking if it can and
+// otherwise reading and discarding, which only works forwards.
+func seekTo(content io.Reader, offset *int64, target int64) error {
+    if seeker, ok := content.(io.Seeker); ok {
+        n, err := seeker.Seek(target, io.SeekStart)
+        *offset = n
+        return err
+    }
+    if target < *offset {
+        return io.ErrUnexpectedEOF
+    }
+    n, err := io.CopyN(io.Discard, content, target-*offset)
+    *offset += n
+    return err
+}
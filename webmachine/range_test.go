@@ -0,0 +1,289 @@
+package webmachine
+
+import (
+    "io"
+    "mime"
+    "mime/multipart"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestParseRangeHeader(t *testing.T) {
+    tests := []struct {
+        header string
+        size   int64
+        ranges []byteRange
+        ok     bool
+    }{
+        {"", 100, nil, false},
+        {"items=0-1", 100, nil, false},
+        {"bytes=", 100, nil, false},
+        {"bytes= , ", 100, nil, false},
+        {"bytes=abc", 100, nil, false},
+        {"bytes=5-1", 100, nil, false},
+        {"bytes=0-9", 100, []byteRange{{0, 10}}, true},
+        {"bytes=90-", 100, []byteRange{{90, 10}}, true},
+        {"bytes=90-200", 100, []byteRange{{90, 10}}, true},
+        // suffix ranges
+        {"bytes=-10", 100, []byteRange{{90, 10}}, true},
+        {"bytes=-500", 100, []byteRange{{0, 100}}, true},
+        {"bytes=-0", 100, []byteRange{}, true},
+        // a start past the end cannot be satisfied
+        {"bytes=100-", 100, []byteRange{}, true},
+        {"bytes=150-200", 100, []byteRange{}, true},
+        {"bytes=150-200, 0-0", 100, []byteRange{{0, 1}}, true},
+        // overlapping and adjacent ranges are coalesced and sorted
+        {"bytes=0-9, 5-14", 100, []byteRange{{0, 15}}, true},
+        {"bytes=10-19, 0-9", 100, []byteRange{{0, 20}}, true},
+        {"bytes=0-4, 2-3", 100, []byteRange{{0, 5}}, true},
+        {"bytes=50-59, 0-9, -10", 100, []byteRange{{0, 10}, {50, 10}, {90, 10}}, true},
+    }
+    for _, tt := range tests {
+        ranges, ok := parseRangeHeader(tt.header, tt.size)
+        if ok != tt.ok {
+            t.Errorf("parseRangeHeader(%q, %d) ok = %v, want %v", tt.header, tt.size, ok, tt.ok)
+            continue
+        }
+        if len(ranges) == 0 && len(tt.ranges) == 0 {
+            continue
+        }
+        if !reflect.DeepEqual(ranges, tt.ranges) {
+            t.Errorf("parseRangeHeader(%q, %d) = %v, want %v", tt.header, tt.size, ranges, tt.ranges)
+        }
+    }
+}
+
+func serveContentForRange(rangeHeader, content string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest("GET", "/", nil)
+    if len(rangeHeader) > 0 {
+        req.Header.Set("Range", rangeHeader)
+    }
+    rec := httptest.NewRecorder()
+    resp := NewResponseWriter(rec)
+    resp.Header().Set("Content-Type", "text/plain")
+    serveContent(NewRequestFromHttpRequest(req), resp, resp, strings.NewReader(content), int64(len(content)), 0)
+    return rec
+}
+
+func TestServeContentRanges(t *testing.T) {
+    const content = "0123456789abcdefghij"
+
+    rec := serveContentForRange("bytes=", content)
+    if rec.Code != http.StatusOK || rec.Body.String() != content {
+        t.Errorf("empty range set: %d %q, want 200 with the whole content", rec.Code, rec.Body.String())
+    }
+
+    rec = serveContentForRange("bytes=2-4", content)
+    if rec.Code != http.StatusPartialContent || rec.Body.String() != "234" || rec.Header().Get("Content-Range") != "bytes 2-4/20" || rec.Header().Get("Content-Length") != "3" {
+        t.Errorf("single range: %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+    }
+
+    rec = serveContentForRange("bytes=30-40", content)
+    if rec.Code != http.StatusRequestedRangeNotSatisfiable || rec.Header().Get("Content-Range") != "bytes */20" || rec.Body.Len() != 0 {
+        t.Errorf("unsatisfiable range: %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+    }
+
+    rec = serveContentForRange("bytes=-3, 0-1", content)
+    if rec.Code != http.StatusPartialContent {
+        t.Fatalf("multiple ranges: status %d", rec.Code)
+    }
+    mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+    if err != nil || mediaType != "multipart/byteranges" {
+        t.Fatalf("multiple ranges: Content-Type %q", rec.Header().Get("Content-Type"))
+    }
+    want := []struct{ contentRange, body string }{{"bytes 0-1/20", "01"}, {"bytes 17-19/20", "hij"}}
+    mr := multipart.NewReader(rec.Body, params["boundary"])
+    for i, w := range want {
+        part, err := mr.NextPart()
+        if err != nil {
+            t.Fatalf("part %d: %v", i, err)
+        }
+        body, _ := io.ReadAll(part)
+        if part.Header.Get("Content-Range") != w.contentRange || part.Header.Get("Content-Type") != "text/plain" || string(body) != w.body {
+            t.Errorf("part %d: %v %q, want %s %q", i, part.Header, body, w.contentRange, w.body)
+        }
+    }
+    if _, err := mr.NextPart(); err != io.EOF {
+        t.Errorf("expected 2 parts, got more: %v", err)
+    }
+}
+
+// seekableTestHandler serves content through MediaTypeOutputContent.
+type seekableTestHandler struct {
+    content string
+}
+
+func (p *seekableTestHandler) MediaTypeOutput() string {
+    return MIME_TYPE_TEXT_PLAIN
+}
+
+func (p *seekableTestHandler) MediaTypeHandleOutputTo(req Request, cxt Context, writer io.Writer, resp ResponseWriter) {
+    resp.WriteHeader(http.StatusOK)
+    io.WriteString(writer, "unseekable")
+}
+
+func (p *seekableTestHandler) MediaTypeOutputContent(req Request, cxt Context) (io.ReadSeeker, int64, error) {
+    return strings.NewReader(p.content), int64(len(p.content)), nil
+}
+
+type seekableTestResource struct {
+    DefaultRequestHandler
+    content  string
+    charsets []CharsetHandler
+}
+
+func (p *seekableTestResource) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    return p
+}
+
+func (p *seekableTestResource) ContentTypesProvided(req Request, cxt Context) ([]MediaTypeHandler, Request, Context, int, error) {
+    return []MediaTypeHandler{&seekableTestHandler{p.content}}, req, cxt, 0, nil
+}
+
+func (p *seekableTestResource) CharsetsProvided(charsets []string, req Request, cxt Context) ([]CharsetHandler, Request, Context, int, error) {
+    if p.charsets == nil {
+        return p.DefaultRequestHandler.CharsetsProvided(charsets, req, cxt)
+    }
+    return p.charsets, req, cxt, 0, nil
+}
+
+func TestRangesOfEncodedResponses(t *testing.T) {
+    long := strings.Repeat("0123456789", 200)
+    tests := []struct {
+        content      string
+        header       map[string]string
+        status       int
+        encoding     string
+        acceptRanges string
+    }{
+        {long, map[string]string{"Accept-Encoding": "gzip"}, http.StatusOK, "gzip", "none"},
+        // a gzip response has no ranges of its own, so Range is ignored
+        {long, map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-3"}, http.StatusOK, "gzip", "none"},
+        {long, map[string]string{"Range": "bytes=0-3"}, http.StatusPartialContent, "", "bytes"},
+        // too short to encode, so it is served as is
+        {"0123456789", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-3"}, http.StatusPartialContent, "", "bytes"},
+    }
+    for _, tt := range tests {
+        wm := NewWebMachine()
+        wm.AddRouteHandler(&seekableTestResource{content: tt.content})
+        req := httptest.NewRequest(GET, "/", nil)
+        for k, v := range tt.header {
+            req.Header.Set(k, v)
+        }
+        rec := httptest.NewRecorder()
+        wm.ServeHTTP(rec, req)
+        if rec.Code != tt.status || rec.Header().Get("Content-Encoding") != tt.encoding || rec.Header().Get("Accept-Ranges") != tt.acceptRanges {
+            t.Errorf("%d bytes with %v: status %d, Content-Encoding %q, Accept-Ranges %q", len(tt.content), tt.header, rec.Code, rec.Header().Get("Content-Encoding"), rec.Header().Get("Accept-Ranges"))
+        }
+    }
+}
+
+func TestSeekableMediaTypeHandler(t *testing.T) {
+    tests := []struct {
+        method       string
+        content      string
+        charsets     []CharsetHandler
+        rangeHeader  string
+        status       int
+        body         string
+        length       string
+        acceptRanges string
+    }{
+        {GET, "0123456789", nil, "", http.StatusOK, "0123456789", "10", "bytes"},
+        {HEAD, "0123456789", nil, "", http.StatusOK, "", "10", "bytes"},
+        {GET, "0123456789", nil, "bytes=2-4", http.StatusPartialContent, "234", "3", "bytes"},
+        {GET, "0123456789", nil, "bytes=20-", http.StatusRequestedRangeNotSatisfiable, "", "", "bytes"},
+        // a transcoded body has no ranges or length of its own
+        {GET, "café", []CharsetHandler{NewISO88591CharsetHandler()}, "", http.StatusOK, "caf\xe9", "", "none"},
+        {GET, "café", []CharsetHandler{NewISO88591CharsetHandler()}, "bytes=0-1", http.StatusOK, "caf\xe9", "", "none"},
+    }
+    for _, tt := range tests {
+        wm := NewWebMachine()
+        wm.AddRouteHandler(&seekableTestResource{content: tt.content, charsets: tt.charsets})
+        req := httptest.NewRequest(tt.method, "/", nil)
+        if len(tt.rangeHeader) > 0 {
+            req.Header.Set("Range", tt.rangeHeader)
+        }
+        rec := httptest.NewRecorder()
+        wm.ServeHTTP(rec, req)
+        if rec.Code != tt.status || rec.Header().Get("Accept-Ranges") != tt.acceptRanges {
+            t.Errorf("%s %q with Range %q: status %d, Accept-Ranges %q, want %d, %q", tt.method, tt.content, tt.rangeHeader, rec.Code, rec.Header().Get("Accept-Ranges"), tt.status, tt.acceptRanges)
+            continue
+        }
+        if tt.status == http.StatusRequestedRangeNotSatisfiable {
+            continue
+        }
+        if rec.Body.String() != tt.body || rec.Header().Get("Content-Length") != tt.length {
+            t.Errorf("%s %q with Range %q: body %q, Content-Length %q, want %q, %q", tt.method, tt.content, tt.rangeHeader, rec.Body.String(), rec.Header().Get("Content-Length"), tt.body, tt.length)
+        }
+    }
+}
+
+type ifRangeTestResource struct {
+    seekableTestResource
+    etag         string
+    lastModified time.Time
+}
+
+func (p *ifRangeTestResource) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    return p
+}
+
+func (p *ifRangeTestResource) GenerateETag(req Request, cxt Context) (string, Request, Context, int, error) {
+    return p.etag, req, cxt, 0, nil
+}
+
+func (p *ifRangeTestResource) LastModified(req Request, cxt Context) (time.Time, Request, Context, int, error) {
+    return p.lastModified, req, cxt, 0, nil
+}
+
+func TestIfRange(t *testing.T) {
+    // Last-Modified is sent, and compared, to the second
+    lastModified := time.Date(2026, time.January, 2, 3, 4, 5, 500000000, time.UTC)
+    date := lastModified.Format(http.TimeFormat)
+    later := lastModified.Add(time.Second).Format(http.TimeFormat)
+    tests := []struct {
+        etag         string
+        lastModified time.Time
+        ifRange      string
+        rangeHeader  string
+        status       int
+    }{
+        {"v1", time.Time{}, `"v1"`, "bytes=0-3", http.StatusPartialContent},
+        {"v1", time.Time{}, `"v2"`, "bytes=0-3", http.StatusOK},
+        // If-Range entity tags must match strongly
+        {"v1", time.Time{}, `W/"v1"`, "bytes=0-3", http.StatusOK},
+        {WeakETag("v1"), time.Time{}, `W/"v1"`, "bytes=0-3", http.StatusOK},
+        {"", time.Time{}, `"v1"`, "bytes=0-3", http.StatusOK},
+        {"", lastModified, date, "bytes=0-3", http.StatusPartialContent},
+        {"", lastModified, later, "bytes=0-3", http.StatusOK},
+        {"", time.Time{}, date, "bytes=0-3", http.StatusOK},
+        {"v1", lastModified, "yesterday", "bytes=0-3", http.StatusOK},
+        // without Range, If-Range is ignored
+        {"v1", time.Time{}, `"v1"`, "", http.StatusOK},
+        {"v1", time.Time{}, `"v2"`, "", http.StatusOK},
+    }
+    const content = "0123456789"
+    for _, tt := range tests {
+        wm := NewWebMachine()
+        wm.AddRouteHandler(&ifRangeTestResource{seekableTestResource{content: content}, tt.etag, tt.lastModified})
+        req := httptest.NewRequest(GET, "/", nil)
+        req.Header.Set("If-Range", tt.ifRange)
+        if len(tt.rangeHeader) > 0 {
+            req.Header.Set("Range", tt.rangeHeader)
+        }
+        rec := httptest.NewRecorder()
+        wm.ServeHTTP(rec, req)
+        body := content
+        if tt.status == http.StatusPartialContent {
+            body = "0123"
+        }
+        if rec.Code != tt.status || rec.Body.String() != body {
+            t.Errorf("ETag %q, Last-Modified %v, If-Range %q, Range %q: %d %q, want %d %q", tt.etag, tt.lastModified, tt.ifRange, tt.rangeHeader, rec.Code, rec.Body.String(), tt.status, body)
+        }
+    }
+}
@@ -0,0 +1,109 @@
+package webmachine
+
+import (
+    "encoding/json"
+    "github.com/pomack/webmachine.go/webmachine/negotiation"
+    "io"
+    "net/http"
+    "strings"
+)
+
+type representation struct {
+    URL       string `json:"url,omitempty"`
+    MediaType string `json:"media_type,omitempty"`
+    Language  string `json:"language,omitempty"`
+    Charset   string `json:"charset,omitempty"`
+    Encoding  string `json:"encoding,omitempty"`
+}
+
+func (p *representation) String() string {
+    s := p.MediaType
+    if len(p.Language) > 0 {
+        s += "; language=" + p.Language
+    }
+    if len(p.Charset) > 0 {
+        s += "; charset=" + p.Charset
+    }
+    if len(p.Encoding) > 0 {
+        s += "; encoding=" + p.Encoding
+    }
+    if len(p.URL) > 0 {
+        s += " <" + p.URL + ">"
+    }
+    return s
+}
+
+type representationList struct {
+    StatusCode      int              `json:"status"`
+    Status          string           `json:"error"`
+    Message         string           `json:"message,omitempty"`
+    Representations []representation `json:"representations"`
+}
+
+// writeRepresentationList writes list as plain text, JSON or HTML depending
+// on the request's Accept header, falling back to plain text.
+func writeRepresentationList(req Request, resp ResponseWriter, list *representationList) {
+    provided := []string{MIME_TYPE_TEXT_PLAIN, MIME_TYPE_JSON, MIME_TYPE_HTML}
+    mediaType := negotiation.MediaType(provided, strings.Join(req.Header()["Accept"], ","))
+    if len(mediaType) == 0 {
+        mediaType = MIME_TYPE_TEXT_PLAIN
+    }
+    headers := resp.Header()
+    for _, name := range []string{"Content-Language", "Content-Location", "Content-Encoding", "Content-Length"} {
+        headers.Del(name)
+    }
+    headers.Set("Content-Type", mediaType+"; charset=utf-8")
+    headers.Set("Vary", strings.Join(appendVary(headerTokens(headers, "Vary"), "Accept"), ", "))
+    resp.WriteHeader(list.StatusCode)
+    switch mediaType {
+    case MIME_TYPE_JSON:
+        json.NewEncoder(resp).Encode(list)
+    case MIME_TYPE_HTML:
+        HTML_REPRESENTATIONS_TEMPLATE.Execute(resp, list)
+    default:
+        io.WriteString(resp, list.Message+"\n")
+        for i := range list.Representations {
+            io.WriteString(resp, "\n"+list.Representations[i].String())
+        }
+        io.WriteString(resp, "\n")
+    }
+}
+
+// writeRepresentations responds with statusCode, normally 300 or 406, and a
+// body listing the representations the resource has: its variants if it is
+// a VariantsProvider and otherwise each combination of the media types,
+// languages and charsets it provides.
+func (p *wmDecisionCore) writeRepresentations(statusCode int, message string) {
+    list := &representationList{StatusCode: statusCode, Status: http.StatusText(statusCode), Message: message, Representations: []representation{}}
+    variants, _, _ := p.variantsProvided()
+    for i := range variants {
+        v := &variants[i]
+        list.Representations = append(list.Representations, representation{URL: v.URL, MediaType: v.MediaType, Language: v.Language, Charset: v.Charset, Encoding: v.Encoding})
+    }
+    if len(variants) == 0 {
+        var ctp []MediaTypeHandler
+        var cp []CharsetHandler
+        ctp, p.req, p.cxt, _, _ = p.handler.ContentTypesProvided(p.req, p.cxt)
+        cp, p.req, p.cxt, _, _ = p.handler.CharsetsProvided([]string{"*"}, p.req, p.cxt)
+        languages, _, _ := p.languagesProvided()
+        if len(languages) == 0 {
+            languages = []string{""}
+        }
+        charsets := []string{""}
+        if len(cp) > 0 {
+            charsets = make([]string, len(cp))
+            for i, handler := range cp {
+                charsets[i] = handler.Charset()
+            }
+        }
+        for _, mth := range ctp {
+            for _, language := range languages {
+                for _, charset := range charsets {
+                    list.Representations = append(list.Representations, representation{MediaType: mth.MediaTypeOutput(), Language: language, Charset: charset})
+                }
+            }
+        }
+    }
+    p.log(LOG_LEVEL_DEBUG, "listing representations", LogFields{"status": statusCode, "count": len(list.Representations)})
+    writeRepresentationList(p.req, p.resp, list)
+}
@@ -0,0 +1,143 @@
+package webmachine
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// newRepresentationTestResource provides CSV and XML in English and French,
+// as UTF-8 or ISO-8859-1.
+func newRepresentationTestResource() *variantTestResource {
+    resource := newVariantTestResource()
+    resource.mediaTypes = []MediaTypeHandler{&formatTestMediaTypeHandler{MIME_TYPE_CSV, "a,b"}, &formatTestMediaTypeHandler{MIME_TYPE_XML, "<a/>"}}
+    resource.languages = []string{"en", "fr"}
+    resource.charsets = append(resource.charsets, NewISO88591CharsetHandler())
+    return resource
+}
+
+func serveRepresentationTest(handler RouteHandler, accept string) *httptest.ResponseRecorder {
+    wm := NewWebMachine()
+    wm.AddRouteHandler(handler)
+    req := httptest.NewRequest(GET, "/", nil)
+    req.Header.Set("Accept", accept)
+    rec := httptest.NewRecorder()
+    wm.ServeHTTP(rec, req)
+    return rec
+}
+
+func TestNotAcceptableRepresentations(t *testing.T) {
+    var want []representation
+    for _, mediaType := range []string{MIME_TYPE_CSV, MIME_TYPE_XML} {
+        for _, language := range []string{"en", "fr"} {
+            for _, charset := range []string{"utf-8", "iso-8859-1"} {
+                want = append(want, representation{MediaType: mediaType, Language: language, Charset: charset})
+            }
+        }
+    }
+
+    rec := serveRepresentationTest(newRepresentationTestResource(), "image/png")
+    if rec.Code != http.StatusNotAcceptable || rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" || !headerHasToken(rec.Header(), "Vary", "Accept") {
+        t.Fatalf("text: %d, Content-Type %q, Vary %q", rec.Code, rec.Header().Get("Content-Type"), rec.Header().Get("Vary"))
+    }
+    lines := []string{"No available media type is acceptable.", ""}
+    for i := range want {
+        lines = append(lines, want[i].String())
+    }
+    if body := strings.Join(lines, "\n") + "\n"; rec.Body.String() != body {
+        t.Errorf("text body %q, want %q", rec.Body.String(), body)
+    }
+
+    rec = serveRepresentationTest(newRepresentationTestResource(), MIME_TYPE_JSON)
+    var list representationList
+    if rec.Code != http.StatusNotAcceptable || rec.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+        t.Fatalf("JSON: %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+    }
+    if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+        t.Fatalf("JSON body %q: %v", rec.Body.String(), err)
+    }
+    if list.StatusCode != http.StatusNotAcceptable || list.Status != "Not Acceptable" || !reflect.DeepEqual(list.Representations, want) {
+        t.Errorf("JSON body %+v, want %v", list, want)
+    }
+
+    rec = serveRepresentationTest(newRepresentationTestResource(), MIME_TYPE_HTML)
+    body := rec.Body.String()
+    if rec.Code != http.StatusNotAcceptable || rec.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+        t.Fatalf("HTML: %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+    }
+    if !strings.Contains(body, "<h1>406 Not Acceptable</h1>") || strings.Count(body, `<tr class="representation">`) != len(want) || !strings.Contains(body, `<td class="charset">iso-8859-1</td>`) {
+        t.Errorf("HTML body %q", body)
+    }
+}
+
+func TestVariantRepresentations(t *testing.T) {
+    resource := newVariantTestResource()
+    resource.variants = []Variant{
+        {URL: "doc.en.txt", MediaType: MIME_TYPE_TEXT_PLAIN, Language: "en"},
+        {URL: "doc.fr.txt", MediaType: MIME_TYPE_TEXT_PLAIN, Language: "fr", Encoding: "gzip"},
+    }
+    want := []representation{
+        {URL: "doc.en.txt", MediaType: MIME_TYPE_TEXT_PLAIN, Language: "en"},
+        {URL: "doc.fr.txt", MediaType: MIME_TYPE_TEXT_PLAIN, Language: "fr", Encoding: "gzip"},
+    }
+
+    rec := serveRepresentationTest(resource, "image/png")
+    const text = "No available media type is acceptable.\n\ntext/plain; language=en <doc.en.txt>\ntext/plain; language=fr; encoding=gzip <doc.fr.txt>\n"
+    if rec.Code != http.StatusNotAcceptable || rec.Body.String() != text {
+        t.Errorf("text: %d %q, want 406 %q", rec.Code, rec.Body.String(), text)
+    }
+    // the listing is not one of the variants
+    if location := rec.Header().Get("Content-Location"); len(location) > 0 {
+        t.Errorf("text: Content-Location %q", location)
+    }
+
+    rec = serveRepresentationTest(resource, "image/png, "+MIME_TYPE_JSON+";q=0.5")
+    var list representationList
+    if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || rec.Code != http.StatusNotAcceptable {
+        t.Fatalf("JSON: %d %q: %v", rec.Code, rec.Body.String(), err)
+    }
+    if !reflect.DeepEqual(list.Representations, want) {
+        t.Errorf("JSON body %+v, want %v", list, want)
+    }
+
+    rec = serveRepresentationTest(resource, MIME_TYPE_HTML)
+    body := rec.Body.String()
+    if rec.Code != http.StatusNotAcceptable || !strings.Contains(body, `<a href="doc.en.txt">text/plain</a>`) || !strings.Contains(body, `<td class="encoding">gzip</td>`) {
+        t.Errorf("HTML: %d %q", rec.Code, body)
+    }
+}
+
+func TestMultipleChoicesRepresentationList(t *testing.T) {
+    list := &representationList{
+        StatusCode:      http.StatusMultipleChoices,
+        Status:          http.StatusText(http.StatusMultipleChoices),
+        Message:         "Multiple representations are available.",
+        Representations: []representation{{URL: "doc.csv", MediaType: MIME_TYPE_CSV}, {URL: "doc.xml", MediaType: MIME_TYPE_XML}},
+    }
+    tests := []struct {
+        accept      string
+        contentType string
+        body        string
+    }{
+        {"", "text/plain; charset=utf-8", "Multiple representations are available.\n\ntext/csv <doc.csv>\napplication/xml <doc.xml>\n"},
+        {"image/png", "text/plain; charset=utf-8", "Multiple representations are available.\n\ntext/csv <doc.csv>\napplication/xml <doc.xml>\n"},
+        {MIME_TYPE_JSON, "application/json; charset=utf-8", `{"status":300,"error":"Multiple Choices","message":"Multiple representations are available.","representations":[{"url":"doc.csv","media_type":"text/csv"},{"url":"doc.xml","media_type":"application/xml"}]}` + "\n"},
+    }
+    for _, tt := range tests {
+        req := httptest.NewRequest(GET, "/", nil)
+        req.Header.Set("Accept", tt.accept)
+        rec := httptest.NewRecorder()
+        resp := NewResponseWriter(rec)
+        resp.Header().Set("Content-Location", "doc.csv")
+        writeRepresentationList(NewRequestFromHttpRequest(req), resp, list)
+        if rec.Code != http.StatusMultipleChoices || rec.Header().Get("Content-Type") != tt.contentType || rec.Body.String() != tt.body {
+            t.Errorf("Accept %q: %d, Content-Type %q, body %q", tt.accept, rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+        }
+        if location := rec.Header().Get("Content-Location"); len(location) > 0 {
+            t.Errorf("Accept %q: Content-Location %q", tt.accept, location)
+        }
+    }
+}
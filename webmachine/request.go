@@ -1,6 +1,7 @@
 package webmachine
 
 import (
+    "context"
     "io"
     "mime/multipart"
     "net/http"
@@ -11,8 +12,9 @@ import (
 func NewRequestFromHttpRequest(req *http.Request) Request {
     p := new(request)
     p.req = req
-    p.hostParts = strings.Split(req.Host, ".")
+    p.hostParts = strings.Split(stripPort(req.Host), ".")
     p.urlParts = strings.Split(req.URL.Path, "/")
+    p.logger = NewNoopLogger()
     return p
 }
 
@@ -20,6 +22,30 @@ func (p *request) UnderlyingRequest() *http.Request {
     return p.req
 }
 
+func (p *request) Context() context.Context {
+    return p.req.Context()
+}
+
+func (p *request) WithContext(ctx context.Context) Request {
+    r := *p
+    r.req = p.req.WithContext(ctx)
+    return &r
+}
+
+// WithBody returns a copy of the request reading body, without the
+// Content-Encoding and Content-Length that described the original.
+func (p *request) WithBody(body io.ReadCloser) Request {
+    r := *p
+    req := *p.req
+    req.Body = body
+    req.ContentLength = -1
+    req.Header = p.req.Header.Clone()
+    req.Header.Del("Content-Encoding")
+    req.Header.Del("Content-Length")
+    r.req = &req
+    return &r
+}
+
 func (p *request) Method() string {
     return p.req.Method
 }
@@ -120,6 +146,36 @@ func (p *request) HostParts() []string {
     return p.hostParts
 }
 
+func (p *request) HostBindings() map[string]string {
+    return p.dispatch.HostBindings
+}
+
+func (p *request) HostTokens() []string {
+    return p.dispatch.HostTokens
+}
+
 func (p *request) URLParts() []string {
     return p.urlParts
 }
+
+func (p *request) PathBindings() map[string]string {
+    return p.dispatch.PathBindings
+}
+
+func (p *request) PathInfo() string {
+    return p.dispatch.PathInfo
+}
+
+func (p *request) DispatchPath() string {
+    return p.dispatch.DispatchPath
+}
+
+func (p *request) SetDispatchMatch(match *DispatchMatch) {
+    p.dispatch = *match
+}
+
+// Logger returns the logger for this request, which already carries the
+// request's method and path as fields.
+func (p *request) Logger() Logger {
+    return p.logger
+}
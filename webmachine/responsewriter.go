@@ -1,8 +1,10 @@
 package webmachine
 
 import (
+    "bufio"
+    "errors"
     "io"
-    "log"
+    "net"
     "net/http"
 )
 
@@ -11,11 +13,14 @@ type ResponseWriter interface {
     io.Closer
     Flusher
     AddEncoding(h EncodingHandler, req Request, cxt Context) io.Writer
+    StatusCode() int
 }
 
 type responseWriter struct {
-    rw  http.ResponseWriter
-    w   io.Writer
+    rw         http.ResponseWriter
+    w          io.Writer
+    statusCode int
+    hijacked   bool
 }
 
 func NewResponseWriter(rw http.ResponseWriter) ResponseWriter {
@@ -23,18 +28,31 @@ func NewResponseWriter(rw http.ResponseWriter) ResponseWriter {
 }
 
 func (p *responseWriter) WriteHeader(status int) {
-    log.Print("[RW]: Writing Header ", status)
+    if p.hijacked {
+        return
+    }
+    if p.statusCode == 0 {
+        p.statusCode = status
+    }
     p.rw.WriteHeader(status)
 }
 
+// StatusCode returns the status written so far, or 0 if nothing has been
+// written yet.
+func (p *responseWriter) StatusCode() int {
+    return p.statusCode
+}
+
 func (p *responseWriter) Header() http.Header {
     return p.rw.Header()
 }
 
 func (p *responseWriter) Write(data []byte) (int, error) {
-    log.Print("[RW]: Writing data ", len(data), " bytes")
-    if len(data) < 5000 {
-        log.Print("[RW]: Wrote:\n", string(data))
+    if p.hijacked {
+        return 0, http.ErrHijacked
+    }
+    if p.statusCode == 0 {
+        p.statusCode = http.StatusOK
     }
     return p.w.Write(data)
 }
@@ -47,22 +65,32 @@ func (p *responseWriter) AddEncoding(h EncodingHandler, req Request, cxt Context
     return p.w
 }
 
+// Flush flushes the encoder, if any, and then the underlying writer so that
+// streamed output reaches the client.
 func (p *responseWriter) Flush() error {
+    if p.hijacked {
+        return nil
+    }
+    var err error
     if p.rw != p.w {
         if f, ok := p.w.(Flusher); ok {
-            log.Print("[RW]: Flushing Writer")
-            return f.Flush()
+            err = f.Flush()
         }
     }
     if f, ok := p.rw.(Flusher); ok {
-        log.Print("[RW]: Flushing ResponseWriter")
-        return f.Flush()
+        if e := f.Flush(); err == nil {
+            err = e
+        }
+    } else if f, ok := p.rw.(http.Flusher); ok {
+        f.Flush()
     }
-    log.Print("[RW]: Failed to Flush, not flushable")
-    return nil
+    return err
 }
 
 func (p *responseWriter) Close() error {
+    if p.hijacked {
+        return nil
+    }
     if p.rw != p.w {
         if closer, ok := p.w.(io.Closer); ok {
             closer.Close()
@@ -73,3 +101,22 @@ func (p *responseWriter) Close() error {
     }
     return nil
 }
+
+// Hijack takes over the connection from net/http, e.g. to speak WebSocket.
+// The status is recorded as 101 Switching Protocols and later writes
+// through the ResponseWriter are dropped.
+func (p *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    hijacker, ok := p.rw.(http.Hijacker)
+    if !ok {
+        return nil, nil, errors.New("webmachine: connection does not support hijacking")
+    }
+    conn, brw, err := hijacker.Hijack()
+    if err != nil {
+        return nil, nil, err
+    }
+    p.hijacked = true
+    if p.statusCode == 0 {
+        p.statusCode = http.StatusSwitchingProtocols
+    }
+    return conn, brw, nil
+}
@@ -0,0 +1,523 @@
+package webmachine
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    TRACE_HEADER = "X-Webmachine-Trace"
+)
+
+// TraceRecord is everything recorded about a single traced request.
+type TraceRecord struct {
+    Id         string          `json:"id"`
+    Method     string          `json:"method"`
+    Path       string          `json:"path"`
+    Resource   string          `json:"resource"`
+    StartTime  time.Time       `json:"start_time"`
+    EndTime    time.Time       `json:"end_time"`
+    Decisions  []string        `json:"decisions"`
+    Callbacks  []TraceCallback `json:"callbacks"`
+    StatusCode int             `json:"status_code"`
+}
+
+// TraceCallback is a single RequestHandler callback made while the core was
+// at the given decision.
+type TraceCallback struct {
+    Decision string        `json:"decision"`
+    Name     string        `json:"name"`
+    Results  []interface{} `json:"results"`
+}
+
+// CallbacksAt returns the callbacks made while at the given decision node.
+func (p *TraceRecord) CallbacksAt(decision string) []TraceCallback {
+    var callbacks []TraceCallback
+    for _, callback := range p.Callbacks {
+        if callback.Decision == decision {
+            callbacks = append(callbacks, callback)
+        }
+    }
+    return callbacks
+}
+
+// DecisionTraceStore gives access to previously recorded traces, newest first.
+type DecisionTraceStore interface {
+    Traces() []*TraceRecord
+    Trace(id string) *TraceRecord
+}
+
+var traceCounter int64
+
+func newTraceId() string {
+    n := atomic.AddInt64(&traceCounter, 1)
+    return strconv.FormatInt(time.Now().UTC().UnixNano(), 36) + "-" + strconv.FormatInt(n, 36)
+}
+
+type traceRecorder struct {
+    record   *TraceRecord
+    decision string
+    onFinish func(record *TraceRecord)
+}
+
+func newTraceRecorder(req Request, handler RequestHandler, onFinish func(record *TraceRecord)) *traceRecorder {
+    record := &TraceRecord{
+        Id:        newTraceId(),
+        Method:    req.Method(),
+        Path:      req.URL().Path,
+        Resource:  fmt.Sprintf("%T", handler),
+        StartTime: time.Now().UTC(),
+        Decisions: make([]string, 0, 32),
+        Callbacks: make([]TraceCallback, 0, 32),
+    }
+    return &traceRecorder{record: record, onFinish: onFinish}
+}
+
+func (p *traceRecorder) Decision(decisionId WMDecision) {
+    p.decision = decisionId.Id()
+    p.record.Decisions = append(p.record.Decisions, p.decision)
+}
+
+func (p *traceRecorder) Callback(name string, results ...interface{}) {
+    values := make([]interface{}, len(results))
+    for i, result := range results {
+        values[i] = traceValue(result)
+    }
+    p.record.Callbacks = append(p.record.Callbacks, TraceCallback{Decision: p.decision, Name: name, Results: values})
+}
+
+func (p *traceRecorder) FinishTrace(statusCode int) {
+    p.record.StatusCode = statusCode
+    p.record.EndTime = time.Now().UTC()
+    if p.onFinish != nil {
+        p.onFinish(p.record)
+    }
+}
+
+// traceValue converts callback results into something that is meaningful
+// once printed or marshalled to JSON.
+func traceValue(value interface{}) interface{} {
+    switch v := value.(type) {
+    case nil:
+        return nil
+    case error:
+        return v.Error()
+    case time.Time:
+        if v.IsZero() {
+            return nil
+        }
+        return v.Format(http.TimeFormat)
+    case []MediaTypeHandler:
+        arr := make([]string, len(v))
+        for i, h := range v {
+            arr[i] = h.MediaTypeOutput()
+        }
+        return arr
+    case []MediaTypeInputHandler:
+        arr := make([]string, len(v))
+        for i, h := range v {
+            arr[i] = h.MediaTypeInput()
+        }
+        return arr
+    case []CharsetHandler:
+        arr := make([]string, len(v))
+        for i, h := range v {
+            arr[i] = h.Charset()
+        }
+        return arr
+    case []EncodingHandler:
+        arr := make([]string, len(v))
+        for i, h := range v {
+            arr[i] = h.Encoding()
+        }
+        return arr
+    case http.Header:
+        return map[string][]string(v)
+    case io.WriterTo:
+        return fmt.Sprintf("%T", v)
+    }
+    return value
+}
+
+// MemoryDecisionTracer keeps the most recent traces in memory.
+type MemoryDecisionTracer struct {
+    lock     sync.RWMutex
+    capacity int
+    traces   []*TraceRecord
+}
+
+func NewMemoryDecisionTracer(capacity int) *MemoryDecisionTracer {
+    if capacity <= 0 {
+        capacity = 100
+    }
+    return &MemoryDecisionTracer{capacity: capacity, traces: make([]*TraceRecord, 0, capacity)}
+}
+
+func (p *MemoryDecisionTracer) StartTrace(req Request, resp ResponseWriter, handler RequestHandler) DecisionTrace {
+    return newTraceRecorder(req, handler, p.add)
+}
+
+func (p *MemoryDecisionTracer) add(record *TraceRecord) {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    if len(p.traces) >= p.capacity {
+        copy(p.traces, p.traces[1:])
+        p.traces = p.traces[:len(p.traces)-1]
+    }
+    p.traces = append(p.traces, record)
+}
+
+func (p *MemoryDecisionTracer) Traces() []*TraceRecord {
+    p.lock.RLock()
+    defer p.lock.RUnlock()
+    traces := make([]*TraceRecord, len(p.traces))
+    for i, record := range p.traces {
+        traces[len(traces)-1-i] = record
+    }
+    return traces
+}
+
+func (p *MemoryDecisionTracer) Trace(id string) *TraceRecord {
+    p.lock.RLock()
+    defer p.lock.RUnlock()
+    for _, record := range p.traces {
+        if record.Id == id {
+            return record
+        }
+    }
+    return nil
+}
+
+func (p *MemoryDecisionTracer) Clear() {
+    p.lock.Lock()
+    p.traces = p.traces[:0]
+    p.lock.Unlock()
+}
+
+// FileDecisionTracer writes each trace as JSON to <dir>/<id>.json.
+type FileDecisionTracer struct {
+    dirPath string
+}
+
+func NewFileDecisionTracer(dirPath string) *FileDecisionTracer {
+    return &FileDecisionTracer{dirPath: dirPath}
+}
+
+func (p *FileDecisionTracer) StartTrace(req Request, resp ResponseWriter, handler RequestHandler) DecisionTrace {
+    logger := req.Logger()
+    return newTraceRecorder(req, handler, func(record *TraceRecord) {
+        if err := p.write(record); err != nil && logger != nil && logger.Enabled(LOG_LEVEL_WARN) {
+            logger.Log(LOG_LEVEL_WARN, "error writing trace", LogFields{"trace": record.Id, "dir": p.dirPath, "error": err})
+        }
+    })
+}
+
+func (p *FileDecisionTracer) write(record *TraceRecord) error {
+    if err := os.MkdirAll(p.dirPath, 0755); err != nil {
+        return err
+    }
+    b, err := json.MarshalIndent(record, "", "  ")
+    if err != nil {
+        return err
+    }
+    return ioutil.WriteFile(filepath.Join(p.dirPath, record.Id+".json"), b, 0644)
+}
+
+func (p *FileDecisionTracer) Traces() []*TraceRecord {
+    matches, _ := filepath.Glob(filepath.Join(p.dirPath, "*.json"))
+    traces := make([]*TraceRecord, 0, len(matches))
+    for _, match := range matches {
+        if record := p.read(match); record != nil {
+            traces = append(traces, record)
+        }
+    }
+    sort.Sort(tracesNewestFirst(traces))
+    return traces
+}
+
+func (p *FileDecisionTracer) Trace(id string) *TraceRecord {
+    if len(id) == 0 || strings.ContainsAny(id, "/\\.") {
+        return nil
+    }
+    return p.read(filepath.Join(p.dirPath, id+".json"))
+}
+
+func (p *FileDecisionTracer) read(filename string) *TraceRecord {
+    b, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return nil
+    }
+    record := new(TraceRecord)
+    if err = json.Unmarshal(b, record); err != nil {
+        return nil
+    }
+    return record
+}
+
+type tracesNewestFirst []*TraceRecord
+
+func (p tracesNewestFirst) Len() int           { return len(p) }
+func (p tracesNewestFirst) Less(i, j int) bool { return p[i].StartTime.After(p[j].StartTime) }
+func (p tracesNewestFirst) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// HeaderDecisionTracer lists the decisions visited in the X-Webmachine-Trace
+// response header.
+type HeaderDecisionTracer struct{}
+
+func NewHeaderDecisionTracer() *HeaderDecisionTracer {
+    return new(HeaderDecisionTracer)
+}
+
+func (p *HeaderDecisionTracer) StartTrace(req Request, resp ResponseWriter, handler RequestHandler) DecisionTrace {
+    return &headerTrace{resp: resp}
+}
+
+type headerTrace struct {
+    resp      ResponseWriter
+    decisions []string
+}
+
+func (p *headerTrace) Decision(decisionId WMDecision) {
+    p.decisions = append(p.decisions, decisionId.Id())
+    if p.resp.StatusCode() == 0 {
+        p.resp.Header().Set(TRACE_HEADER, strings.Join(p.decisions, ","))
+    }
+}
+
+func (p *headerTrace) Callback(name string, results ...interface{}) {
+}
+
+func (p *headerTrace) FinishTrace(statusCode int) {
+}
+
+// tracingRequestHandler reports every callback and its results to a
+// DecisionTrace before handing them back to the decision core.
+type tracingRequestHandler struct {
+    handler RequestHandler
+    trace   DecisionTrace
+}
+
+func newTracingRequestHandler(handler RequestHandler, trace DecisionTrace) *tracingRequestHandler {
+    return &tracingRequestHandler{handler: handler, trace: trace}
+}
+
+func (p *tracingRequestHandler) StartRequest(req Request, cxt Context) (Request, Context) {
+    req, cxt = p.handler.StartRequest(req, cxt)
+    p.trace.Callback("StartRequest")
+    return req, cxt
+}
+
+func (p *tracingRequestHandler) ResourceExists(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.ResourceExists(req, cxt)
+    p.trace.Callback("ResourceExists", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) ServiceAvailable(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.ServiceAvailable(req, cxt)
+    p.trace.Callback("ServiceAvailable", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) IsAuthorized(req Request, cxt Context) (bool, string, Request, Context, int, error) {
+    v, auth, req, cxt, code, err := p.handler.IsAuthorized(req, cxt)
+    p.trace.Callback("IsAuthorized", v, auth, code, err)
+    return v, auth, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) Forbidden(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.Forbidden(req, cxt)
+    p.trace.Callback("Forbidden", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) AllowMissingPost(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.AllowMissingPost(req, cxt)
+    p.trace.Callback("AllowMissingPost", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) MalformedRequest(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.MalformedRequest(req, cxt)
+    p.trace.Callback("MalformedRequest", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) URITooLong(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.URITooLong(req, cxt)
+    p.trace.Callback("URITooLong", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) KnownContentType(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.KnownContentType(req, cxt)
+    p.trace.Callback("KnownContentType", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) ValidContentHeaders(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.ValidContentHeaders(req, cxt)
+    p.trace.Callback("ValidContentHeaders", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) ValidEntityLength(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.ValidEntityLength(req, cxt)
+    p.trace.Callback("ValidEntityLength", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) Options(req Request, cxt Context) ([]string, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.Options(req, cxt)
+    p.trace.Callback("Options", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) AllowedMethods(req Request, cxt Context) ([]string, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.AllowedMethods(req, cxt)
+    p.trace.Callback("AllowedMethods", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) DeleteResource(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.DeleteResource(req, cxt)
+    p.trace.Callback("DeleteResource", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) DeleteCompleted(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.DeleteCompleted(req, cxt)
+    p.trace.Callback("DeleteCompleted", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) PostIsCreate(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.PostIsCreate(req, cxt)
+    p.trace.Callback("PostIsCreate", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) CreatePath(req Request, cxt Context) (string, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.CreatePath(req, cxt)
+    p.trace.Callback("CreatePath", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) ProcessPost(req Request, cxt Context) (Request, Context, int, http.Header, io.WriterTo, error) {
+    req, cxt, code, headers, writerTo, err := p.handler.ProcessPost(req, cxt)
+    p.trace.Callback("ProcessPost", code, headers, writerTo, err)
+    return req, cxt, code, headers, writerTo, err
+}
+
+func (p *tracingRequestHandler) ContentTypesProvided(req Request, cxt Context) ([]MediaTypeHandler, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.ContentTypesProvided(req, cxt)
+    p.trace.Callback("ContentTypesProvided", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) ContentTypesAccepted(req Request, cxt Context) ([]MediaTypeInputHandler, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.ContentTypesAccepted(req, cxt)
+    p.trace.Callback("ContentTypesAccepted", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) IsLanguageAvailable(languages []string, req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.IsLanguageAvailable(languages, req, cxt)
+    p.trace.Callback("IsLanguageAvailable", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) CharsetsProvided(charsets []string, req Request, cxt Context) ([]CharsetHandler, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.CharsetsProvided(charsets, req, cxt)
+    p.trace.Callback("CharsetsProvided", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) EncodingsProvided(encodings []string, req Request, cxt Context) ([]EncodingHandler, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.EncodingsProvided(encodings, req, cxt)
+    p.trace.Callback("EncodingsProvided", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) Variances(req Request, cxt Context) ([]string, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.Variances(req, cxt)
+    p.trace.Callback("Variances", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) IsConflict(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.IsConflict(req, cxt)
+    p.trace.Callback("IsConflict", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) MultipleChoices(req Request, cxt Context) (bool, http.Header, Request, Context, int, error) {
+    v, headers, req, cxt, code, err := p.handler.MultipleChoices(req, cxt)
+    p.trace.Callback("MultipleChoices", v, headers, code, err)
+    return v, headers, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) PreviouslyExisted(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.PreviouslyExisted(req, cxt)
+    p.trace.Callback("PreviouslyExisted", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) MovedPermanently(req Request, cxt Context) (string, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.MovedPermanently(req, cxt)
+    p.trace.Callback("MovedPermanently", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) MovedTemporarily(req Request, cxt Context) (string, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.MovedTemporarily(req, cxt)
+    p.trace.Callback("MovedTemporarily", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) LastModified(req Request, cxt Context) (time.Time, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.LastModified(req, cxt)
+    p.trace.Callback("LastModified", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) Expires(req Request, cxt Context) (time.Time, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.Expires(req, cxt)
+    p.trace.Callback("Expires", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) GenerateETag(req Request, cxt Context) (string, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.GenerateETag(req, cxt)
+    p.trace.Callback("GenerateETag", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) FinishRequest(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.FinishRequest(req, cxt)
+    p.trace.Callback("FinishRequest", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) ResponseIsRedirect(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, cxt, code, err := p.handler.ResponseIsRedirect(req, cxt)
+    p.trace.Callback("ResponseIsRedirect", v, code, err)
+    return v, req, cxt, code, err
+}
+
+func (p *tracingRequestHandler) HasRespBody(req Request, cxt Context) bool {
+    v := p.handler.HasRespBody(req, cxt)
+    p.trace.Callback("HasRespBody", v)
+    return v
+}
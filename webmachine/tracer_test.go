@@ -0,0 +1,109 @@
+package webmachine
+
+import (
+    "io/ioutil"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "reflect"
+    "sync"
+    "testing"
+)
+
+type recordingLogger struct {
+    mutex    sync.Mutex
+    messages []string
+    fields   []LogFields
+}
+
+func (p *recordingLogger) Enabled(level LogLevel) bool {
+    return level >= LOG_LEVEL_WARN
+}
+
+func (p *recordingLogger) Log(level LogLevel, msg string, fields LogFields) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    p.messages = append(p.messages, msg)
+    p.fields = append(p.fields, fields)
+}
+
+func traceTestRequest(logger Logger) Request {
+    return &request{req: httptest.NewRequest(GET, "/", nil), logger: logger}
+}
+
+func TestMemoryDecisionTracerWraparound(t *testing.T) {
+    tracer := NewMemoryDecisionTracer(3)
+    var ids []string
+    for i := 0; i < 5; i++ {
+        trace := tracer.StartTrace(traceTestRequest(nil), nil, nil)
+        trace.FinishTrace(200)
+        ids = append(ids, trace.(*traceRecorder).record.Id)
+    }
+    var got []string
+    for _, record := range tracer.Traces() {
+        got = append(got, record.Id)
+    }
+    if want := []string{ids[4], ids[3], ids[2]}; !reflect.DeepEqual(got, want) {
+        t.Errorf("Traces() = %v, want %v", got, want)
+    }
+    if tracer.Trace(ids[1]) != nil || tracer.Trace(ids[2]) == nil {
+        t.Error("Trace() returned an evicted trace or lost a kept one")
+    }
+    tracer.Clear()
+    if len(tracer.Traces()) != 0 {
+        t.Error("Clear() kept traces")
+    }
+}
+
+func TestHeaderDecisionTracer(t *testing.T) {
+    wm := NewWebMachine()
+    wm.SetDecisionTracer(NewHeaderDecisionTracer())
+    wm.AddRouteHandler(&etagTestResource{etag: "a"})
+    req := httptest.NewRequest(GET, "/", nil)
+    req.Header.Set("If-None-Match", `"a"`)
+    rec := httptest.NewRecorder()
+    wm.ServeHTTP(rec, req)
+    want := "v3b13,v3b13b,v3b12,v3b11,v3b10,v3b9,v3b8,v3b7,v3b6,v3b5,v3b4,v3b3,v3c3,v3d4,v3e5,v3f6,v3g7,v3g8,v3h10,v3i12,v3i13,v3k13,v3j18"
+    if trace := rec.Header().Get(TRACE_HEADER); rec.Code != 304 || trace != want {
+        t.Errorf("status %d, %s: %s, want %s", rec.Code, TRACE_HEADER, trace, want)
+    }
+}
+
+func TestFileDecisionTracer(t *testing.T) {
+    dir, err := ioutil.TempDir("", "wmtrace")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    tracer := NewFileDecisionTracer(dir)
+    logger := new(recordingLogger)
+    trace := tracer.StartTrace(traceTestRequest(logger), nil, nil)
+    trace.Callback("GenerateETag", "a")
+    trace.FinishTrace(200)
+    id := trace.(*traceRecorder).record.Id
+    traces := tracer.Traces()
+    if len(traces) != 1 || traces[0].Id != id || traces[0].StatusCode != 200 || len(traces[0].Callbacks) != 1 {
+        t.Errorf("Traces() = %v", traces)
+    }
+    if record := tracer.Trace(id); record == nil || record.Id != id {
+        t.Errorf("Trace(%q) = %v", id, record)
+    }
+    if tracer.Trace("../"+id) != nil {
+        t.Error("Trace() read outside its directory")
+    }
+
+    // a value that cannot be encoded
+    trace = tracer.StartTrace(traceTestRequest(logger), nil, nil)
+    trace.Callback("StartRequest", make(chan int))
+    trace.FinishTrace(200)
+    // a directory that cannot be created
+    file := filepath.Join(dir, id+".json")
+    trace = NewFileDecisionTracer(filepath.Join(file, "sub")).StartTrace(traceTestRequest(logger), nil, nil)
+    trace.FinishTrace(200)
+    if len(logger.messages) != 2 || logger.messages[0] != "error writing trace" || logger.fields[1]["error"] == nil {
+        t.Errorf("logged %v %v", logger.messages, logger.fields)
+    }
+    // without a logger the error is dropped
+    trace = NewFileDecisionTracer(filepath.Join(file, "sub")).StartTrace(traceTestRequest(nil), nil, nil)
+    trace.FinishTrace(200)
+}
@@ -0,0 +1,320 @@
+package webmachine
+
+import (
+    "bytes"
+    "fmt"
+    "html"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// v3 decision diagram edges, taken from the transitions in decision.go.
+var traceDiagramEdges = [][2]WMDecision{
+    {v3b13, v3b13b}, {v3b13b, v3b12}, {v3b12, v3b11}, {v3b11, v3b10}, {v3b10, v3b9},
+    {v3b9, v3b8}, {v3b8, v3b7}, {v3b7, v3b6}, {v3b6, v3b5}, {v3b5, v3b4}, {v3b4, v3b3},
+    {v3b3, v3c3}, {v3c3, v3c4}, {v3c3, v3d4}, {v3c4, v3d4}, {v3d4, v3d5}, {v3d4, v3e5},
+    {v3d5, v3e5}, {v3e5, v3e6}, {v3e5, v3f6}, {v3e6, v3f6}, {v3f6, v3f7}, {v3f6, v3g7},
+    {v3f7, v3g7}, {v3g7, v3g8}, {v3g7, v3h7}, {v3g8, v3g9}, {v3g8, v3h10}, {v3g9, v3g11},
+    {v3g9, v3h10}, {v3g11, v3h10}, {v3h7, v3i7}, {v3h10, v3h11}, {v3h10, v3i12},
+    {v3h11, v3h12}, {v3h11, v3i12}, {v3h12, v3i12}, {v3i4, v3p3}, {v3i7, v3i4}, {v3i7, v3k7},
+    {v3i12, v3i13}, {v3i12, v3l13}, {v3i13, v3j18}, {v3i13, v3k13}, {v3k5, v3l5},
+    {v3k7, v3k5}, {v3k7, v3l7}, {v3k13, v3j18}, {v3k13, v3l13}, {v3l5, v3m5}, {v3l7, v3m7},
+    {v3l13, v3l14}, {v3l13, v3m16}, {v3l14, v3l15}, {v3l14, v3m16}, {v3l15, v3l17},
+    {v3l15, v3m16}, {v3l17, v3m16}, {v3m5, v3n5}, {v3m7, v3n11}, {v3m16, v3m20},
+    {v3m16, v3n16}, {v3m20, v3m20b}, {v3m20b, v3o20}, {v3n5, v3n11}, {v3n11, v3p11},
+    {v3n16, v3n11}, {v3n16, v3o16}, {v3o14, v3p11}, {v3o16, v3o14}, {v3o16, v3o18},
+    {v3o20, v3o18}, {v3p3, v3p11}, {v3p11, v3o20},
+}
+
+const (
+    traceDiagramColumnWidth = 110
+    traceDiagramRowHeight   = 36
+    traceDiagramMargin      = 40
+    traceDiagramNodeRadius  = 15
+)
+
+// TraceViewer is a RouteHandler that lists recently traced requests and
+// draws each one on the v3 decision diagram.  Mount it under a path prefix,
+// e.g. NewTraceViewer("/wmtrace", tracer).
+type TraceViewer struct {
+    DefaultRequestHandler
+    urlPathPrefix string
+    store         DecisionTraceStore
+}
+
+type traceViewerContext struct {
+    record *TraceRecord
+    svg    bool
+}
+
+func NewTraceViewer(urlPathPrefix string, store DecisionTraceStore) *TraceViewer {
+    return &TraceViewer{urlPathPrefix: strings.TrimRight(urlPathPrefix, "/"), store: store}
+}
+
+func (p *TraceViewer) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    path := req.URL().Path
+    if path == p.urlPathPrefix || strings.HasPrefix(path, p.urlPathPrefix+"/") {
+        return p
+    }
+    return nil
+}
+
+func (p *TraceViewer) StartRequest(req Request, cxt Context) (Request, Context) {
+    tvc := new(traceViewerContext)
+    id := strings.Trim(req.URL().Path[len(p.urlPathPrefix):], "/")
+    if strings.HasSuffix(id, ".svg") {
+        id = id[:len(id)-len(".svg")]
+        tvc.svg = true
+    }
+    if len(id) > 0 && p.store != nil {
+        tvc.record = p.store.Trace(id)
+    }
+    return req, tvc
+}
+
+func (p *TraceViewer) ResourceExists(req Request, cxt Context) (bool, Request, Context, int, error) {
+    tvc := cxt.(*traceViewerContext)
+    id := strings.Trim(req.URL().Path[len(p.urlPathPrefix):], "/")
+    return len(id) == 0 || tvc.record != nil, req, cxt, 0, nil
+}
+
+func (p *TraceViewer) ContentTypesProvided(req Request, cxt Context) ([]MediaTypeHandler, Request, Context, int, error) {
+    tvc := cxt.(*traceViewerContext)
+    var arr []MediaTypeHandler
+    switch {
+    case tvc.record != nil && tvc.svg:
+        arr = []MediaTypeHandler{&traceDiagramMediaTypeHandler{record: tvc.record}}
+    case tvc.record != nil:
+        arr = []MediaTypeHandler{&traceDetailMediaTypeHandler{urlPathPrefix: p.urlPathPrefix, record: tvc.record}}
+    default:
+        arr = []MediaTypeHandler{&traceListMediaTypeHandler{urlPathPrefix: p.urlPathPrefix, store: p.store}}
+    }
+    return arr, req, cxt, 0, nil
+}
+
+func (p *TraceViewer) HasRespBody(req Request, cxt Context) bool {
+    return true
+}
+
+type traceListEntry struct {
+    Id         string
+    URL        string
+    Method     string
+    Path       string
+    Resource   string
+    StatusCode int
+    StartTime  string
+    Duration   string
+}
+
+type traceListMediaTypeHandler struct {
+    urlPathPrefix string
+    store         DecisionTraceStore
+}
+
+func (p *traceListMediaTypeHandler) MediaTypeOutput() string {
+    return MIME_TYPE_HTML
+}
+
+func (p *traceListMediaTypeHandler) MediaTypeHandleOutputTo(req Request, cxt Context, writer io.Writer, resp ResponseWriter) {
+    var traces []*TraceRecord
+    if p.store != nil {
+        traces = p.store.Traces()
+    }
+    entries := make([]traceListEntry, len(traces))
+    for i, record := range traces {
+        entries[i] = traceListEntry{
+            Id:         record.Id,
+            URL:        p.urlPathPrefix + "/" + record.Id,
+            Method:     record.Method,
+            Path:       record.Path,
+            Resource:   record.Resource,
+            StatusCode: record.StatusCode,
+            StartTime:  record.StartTime.Format(time.RFC3339),
+            Duration:   record.EndTime.Sub(record.StartTime).String(),
+        }
+    }
+    HTML_TRACE_LIST_TEMPLATE.Execute(writer, entries)
+}
+
+type traceDetailCallback struct {
+    Name    string
+    Results string
+}
+
+type traceDetailDecision struct {
+    Id          string
+    Description string
+    Callbacks   []traceDetailCallback
+}
+
+type traceDetail struct {
+    ListURL   string
+    SVGURL    string
+    Record    *TraceRecord
+    Duration  string
+    Decisions []traceDetailDecision
+}
+
+type traceDetailMediaTypeHandler struct {
+    urlPathPrefix string
+    record        *TraceRecord
+}
+
+func (p *traceDetailMediaTypeHandler) MediaTypeOutput() string {
+    return MIME_TYPE_HTML
+}
+
+func (p *traceDetailMediaTypeHandler) MediaTypeHandleOutputTo(req Request, cxt Context, writer io.Writer, resp ResponseWriter) {
+    detail := &traceDetail{
+        ListURL:   p.urlPathPrefix + "/",
+        SVGURL:    p.urlPathPrefix + "/" + p.record.Id + ".svg",
+        Record:    p.record,
+        Duration:  p.record.EndTime.Sub(p.record.StartTime).String(),
+        Decisions: make([]traceDetailDecision, 0, len(p.record.Decisions)+1),
+    }
+    start := p.record.CallbacksAt("")
+    if len(start) > 0 {
+        detail.Decisions = append(detail.Decisions, traceDetailDecision{Id: "", Description: "before the first decision", Callbacks: traceDetailCallbacks(start)})
+    }
+    for _, id := range p.record.Decisions {
+        detail.Decisions = append(detail.Decisions, traceDetailDecision{
+            Id:          id,
+            Description: traceDecisionDescription(id),
+            Callbacks:   traceDetailCallbacks(p.record.CallbacksAt(id)),
+        })
+    }
+    HTML_TRACE_DETAIL_TEMPLATE.Execute(writer, detail)
+}
+
+func traceDetailCallbacks(callbacks []TraceCallback) []traceDetailCallback {
+    arr := make([]traceDetailCallback, len(callbacks))
+    for i, callback := range callbacks {
+        arr[i] = traceDetailCallback{Name: callback.Name, Results: traceResultsString(callback.Results)}
+    }
+    return arr
+}
+
+func traceResultsString(results []interface{}) string {
+    arr := make([]string, len(results))
+    for i, result := range results {
+        arr[i] = fmt.Sprint(result)
+    }
+    return strings.Join(arr, ", ")
+}
+
+func traceDecisionDescription(id string) string {
+    if d, ok := traceDecisionFromId(id); ok {
+        s := d.String()
+        if index := strings.Index(s, ": "); index >= 0 {
+            return s[index+2:]
+        }
+        return s
+    }
+    return ""
+}
+
+func traceDecisionFromId(id string) (WMDecision, bool) {
+    for d := v3b13; d <= v3p11; d++ {
+        if d.Id() == id {
+            return d, true
+        }
+    }
+    return wmResponded, false
+}
+
+type traceDiagramMediaTypeHandler struct {
+    record *TraceRecord
+}
+
+func (p *traceDiagramMediaTypeHandler) MediaTypeOutput() string {
+    return MIME_TYPE_SVG
+}
+
+func (p *traceDiagramMediaTypeHandler) MediaTypeHandleOutputTo(req Request, cxt Context, writer io.Writer, resp ResponseWriter) {
+    writeTraceDiagram(writer, p.record)
+}
+
+// traceDiagramPosition places a node using the column letter and row number
+// of its name in the v3 diagram, e.g. v3g11 is column g, row 11.  Nodes with
+// a "b" suffix (v3b13b, v3m20b) sit half a row below their parent.
+func traceDiagramPosition(id string) (x, y int) {
+    s := strings.TrimPrefix(id, "v3")
+    if len(s) < 2 {
+        return traceDiagramMargin, traceDiagramMargin
+    }
+    column := int(s[0] - 'a')
+    digits := s[1:]
+    half := 0
+    if strings.HasSuffix(digits, "b") {
+        digits = digits[:len(digits)-1]
+        half = traceDiagramRowHeight / 2
+    }
+    row, _ := strconv.Atoi(digits)
+    x = traceDiagramMargin + column*traceDiagramColumnWidth
+    y = traceDiagramMargin + (row-1)*traceDiagramRowHeight + half
+    return
+}
+
+func writeTraceDiagram(writer io.Writer, record *TraceRecord) {
+    width := 2*traceDiagramMargin + 15*traceDiagramColumnWidth + 200
+    height := 2*traceDiagramMargin + 25*traceDiagramRowHeight
+    visited := make(map[string]int)
+    for i, id := range record.Decisions {
+        visited[id] = i + 1
+    }
+    last := ""
+    if len(record.Decisions) > 0 {
+        last = record.Decisions[len(record.Decisions)-1]
+    }
+    buf := new(bytes.Buffer)
+    fmt.Fprintf(buf, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\" font-family=\"sans-serif\" font-size=\"10\">\n", width, height, width, height)
+    buf.WriteString("<style>.edge{stroke:#ccc;stroke-width:1}.path{stroke:#d33;stroke-width:3;fill:none}.node{fill:#fff;stroke:#888}.visited{fill:#fdd;stroke:#d33;stroke-width:2}.last{fill:#d33;stroke:#900}.label{text-anchor:middle;dominant-baseline:central}.callback{fill:#555;font-size:9px}.status{font-size:14px;font-weight:bold;fill:#900}</style>\n")
+    for _, edge := range traceDiagramEdges {
+        x1, y1 := traceDiagramPosition(edge[0].Id())
+        x2, y2 := traceDiagramPosition(edge[1].Id())
+        fmt.Fprintf(buf, "<line class=\"edge\" x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\"/>\n", x1, y1, x2, y2)
+    }
+    if len(record.Decisions) > 1 {
+        buf.WriteString("<polyline class=\"path\" points=\"")
+        for i, id := range record.Decisions {
+            x, y := traceDiagramPosition(id)
+            if i > 0 {
+                buf.WriteString(" ")
+            }
+            fmt.Fprintf(buf, "%d,%d", x, y)
+        }
+        buf.WriteString("\"/>\n")
+    }
+    for d := v3b13; d <= v3p11; d++ {
+        id := d.Id()
+        x, y := traceDiagramPosition(id)
+        class := "node"
+        if id == last {
+            class = "last"
+        } else if visited[id] > 0 {
+            class = "visited"
+        }
+        callbacks := record.CallbacksAt(id)
+        fmt.Fprintf(buf, "<g><title>%s", html.EscapeString(d.String()))
+        for _, callback := range callbacks {
+            fmt.Fprintf(buf, "\n%s: %s", html.EscapeString(callback.Name), html.EscapeString(traceResultsString(callback.Results)))
+        }
+        buf.WriteString("</title>")
+        fmt.Fprintf(buf, "<circle class=\"%s\" cx=\"%d\" cy=\"%d\" r=\"%d\"/>", class, x, y, traceDiagramNodeRadius)
+        fmt.Fprintf(buf, "<text class=\"label\" x=\"%d\" y=\"%d\">%s</text>", x, y, html.EscapeString(strings.TrimPrefix(id, "v3")))
+        for i, callback := range callbacks {
+            fmt.Fprintf(buf, "<text class=\"callback\" x=\"%d\" y=\"%d\">%s: %s</text>", x+traceDiagramNodeRadius+4, y-4+i*11, html.EscapeString(callback.Name), html.EscapeString(traceResultsString(callback.Results)))
+        }
+        buf.WriteString("</g>\n")
+    }
+    if len(last) > 0 {
+        x, y := traceDiagramPosition(last)
+        fmt.Fprintf(buf, "<text class=\"status\" x=\"%d\" y=\"%d\">%d %s</text>\n", x-traceDiagramNodeRadius, y+traceDiagramNodeRadius+16, record.StatusCode, html.EscapeString(http.StatusText(record.StatusCode)))
+    }
+    buf.WriteString("</svg>\n")
+    writer.Write(buf.Bytes())
+}
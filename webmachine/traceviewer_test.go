@@ -0,0 +1,95 @@
+package webmachine
+
+import (
+    "go/ast"
+    "go/parser"
+    "go/token"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+// TestTraceDiagramEdges checks traceDiagramEdges against the transitions
+// each doV3 function in decision.go returns.
+func TestTraceDiagramEdges(t *testing.T) {
+    file, err := parser.ParseFile(token.NewFileSet(), "decision.go", nil, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    transitions := make(map[[2]string]bool)
+    for _, decl := range file.Decls {
+        fn, ok := decl.(*ast.FuncDecl)
+        if !ok || fn.Recv == nil || !strings.HasPrefix(fn.Name.Name, "doV3") {
+            continue
+        }
+        from := "v3" + strings.TrimPrefix(fn.Name.Name, "doV3")
+        ast.Inspect(fn.Body, func(node ast.Node) bool {
+            if ret, ok := node.(*ast.ReturnStmt); ok && len(ret.Results) == 1 {
+                if ident, ok := ret.Results[0].(*ast.Ident); ok && strings.HasPrefix(ident.Name, "v3") {
+                    transitions[[2]string{from, ident.Name}] = true
+                }
+            }
+            return true
+        })
+    }
+    if len(transitions) == 0 {
+        t.Fatal("no transitions found in decision.go")
+    }
+    edges := make(map[[2]string]bool)
+    for _, edge := range traceDiagramEdges {
+        edges[[2]string{edge[0].Id(), edge[1].Id()}] = true
+    }
+    for transition := range transitions {
+        if !edges[transition] {
+            t.Errorf("%s -> %s is missing from traceDiagramEdges", transition[0], transition[1])
+        }
+    }
+    for edge := range edges {
+        if !transitions[edge] {
+            t.Errorf("traceDiagramEdges has %s -> %s, which decision.go never takes", edge[0], edge[1])
+        }
+    }
+}
+
+func TestTraceViewer(t *testing.T) {
+    tracer := NewMemoryDecisionTracer(10)
+    wm := NewWebMachine()
+    wm.AddRouteHandler(NewTraceViewer("/wmtrace", tracer))
+    wm.AddRouteHandler(&etagTestResource{etag: "a"})
+    wm.SetDecisionTracer(tracer)
+    wm.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(GET, "/thing", nil))
+    traces := tracer.Traces()
+    if len(traces) != 1 {
+        t.Fatalf("%d traces recorded", len(traces))
+    }
+    id := traces[0].Id
+
+    get := func(path string) *httptest.ResponseRecorder {
+        rec := httptest.NewRecorder()
+        wm.ServeHTTP(rec, httptest.NewRequest(GET, path, nil))
+        return rec
+    }
+    rec := get("/wmtrace/")
+    if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), MIME_TYPE_HTML) || !strings.Contains(rec.Body.String(), `href="/wmtrace/`+id+`"`) {
+        t.Errorf("list: %d %q %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+    }
+    rec = get("/wmtrace/" + id)
+    body := rec.Body.String()
+    if rec.Code != http.StatusOK || !strings.Contains(body, `data="/wmtrace/`+id+`.svg"`) || !strings.Contains(body, "GenerateETag") || !strings.Contains(body, "v3o18") {
+        t.Errorf("detail: %d %s", rec.Code, body)
+    }
+    rec = get("/wmtrace/" + id + ".svg")
+    body = rec.Body.String()
+    if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), MIME_TYPE_SVG) || !strings.HasPrefix(body, "<svg") {
+        t.Errorf("diagram: %d %q %.80s", rec.Code, rec.Header().Get("Content-Type"), body)
+    }
+    if strings.Count(body, `class="visited"`)+strings.Count(body, `class="last"`) != len(traces[0].Decisions) || !strings.Contains(body, "200 OK") {
+        t.Errorf("diagram does not mark the %d decisions visited: %s", len(traces[0].Decisions), body)
+    }
+    for _, path := range []string{"/wmtrace/unknown", "/wmtrace/unknown.svg"} {
+        if rec = get(path); rec.Code != http.StatusNotFound {
+            t.Errorf("%s: status %d", path, rec.Code)
+        }
+    }
+}
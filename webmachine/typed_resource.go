@@ -0,0 +1,477 @@
+package webmachine
+
+import (
+    "io"
+    "net/http"
+    "time"
+)
+
+// TypedRequestHandler is a RequestHandler whose callbacks thread a context of
+// type C instead of the untyped Context.  Wrap one with NewTypedResource to
+// run it through the decision core.
+type TypedRequestHandler[C any] interface {
+    StartRequest(req Request, cxt C) (Request, C)
+    ResourceExists(req Request, cxt C) (bool, Request, C, int, error)
+    ServiceAvailable(req Request, cxt C) (bool, Request, C, int, error)
+    IsAuthorized(req Request, cxt C) (bool, string, Request, C, int, error)
+    Forbidden(req Request, cxt C) (bool, Request, C, int, error)
+    AllowMissingPost(req Request, cxt C) (bool, Request, C, int, error)
+    MalformedRequest(req Request, cxt C) (bool, Request, C, int, error)
+    URITooLong(req Request, cxt C) (bool, Request, C, int, error)
+    KnownContentType(req Request, cxt C) (bool, Request, C, int, error)
+    ValidContentHeaders(req Request, cxt C) (bool, Request, C, int, error)
+    ValidEntityLength(req Request, cxt C) (bool, Request, C, int, error)
+    Options(req Request, cxt C) ([]string, Request, C, int, error)
+    AllowedMethods(req Request, cxt C) ([]string, Request, C, int, error)
+    DeleteResource(req Request, cxt C) (bool, Request, C, int, error)
+    DeleteCompleted(req Request, cxt C) (bool, Request, C, int, error)
+    PostIsCreate(req Request, cxt C) (bool, Request, C, int, error)
+    CreatePath(req Request, cxt C) (string, Request, C, int, error)
+    ProcessPost(req Request, cxt C) (Request, C, int, http.Header, io.WriterTo, error)
+    ContentTypesProvided(req Request, cxt C) ([]MediaTypeHandler, Request, C, int, error)
+    ContentTypesAccepted(req Request, cxt C) ([]MediaTypeInputHandler, Request, C, int, error)
+    IsLanguageAvailable(languages []string, req Request, cxt C) (bool, Request, C, int, error)
+    CharsetsProvided(charsets []string, req Request, cxt C) ([]CharsetHandler, Request, C, int, error)
+    EncodingsProvided(encodings []string, req Request, cxt C) ([]EncodingHandler, Request, C, int, error)
+    Variances(req Request, cxt C) ([]string, Request, C, int, error)
+    IsConflict(req Request, cxt C) (bool, Request, C, int, error)
+    MultipleChoices(req Request, cxt C) (bool, http.Header, Request, C, int, error)
+    PreviouslyExisted(req Request, cxt C) (bool, Request, C, int, error)
+    MovedPermanently(req Request, cxt C) (string, Request, C, int, error)
+    MovedTemporarily(req Request, cxt C) (string, Request, C, int, error)
+    LastModified(req Request, cxt C) (time.Time, Request, C, int, error)
+    Expires(req Request, cxt C) (time.Time, Request, C, int, error)
+    GenerateETag(req Request, cxt C) (string, Request, C, int, error)
+    FinishRequest(req Request, cxt C) (bool, Request, C, int, error)
+    ResponseIsRedirect(req Request, cxt C) (bool, Request, C, int, error)
+    HasRespBody(req Request, cxt C) bool
+}
+
+// TypedRequestFinisher is the typed equivalent of RequestFinisher.
+type TypedRequestFinisher[C any] interface {
+    FinishRequestWithResult(req Request, cxt C, failed bool) (bool, Request, C, int, error)
+}
+
+// TypedDeadlineHandler is the typed equivalent of DeadlineHandler.
+type TypedDeadlineHandler[C any] interface {
+    RequestTimeout(req Request, cxt C) (time.Duration, int)
+}
+
+// TypedLanguagesProvider is the typed equivalent of LanguagesProvider.
+type TypedLanguagesProvider[C any] interface {
+    LanguagesProvided(req Request, cxt C) ([]string, Request, C, int, error)
+}
+
+// TypedVariantsProvider is the typed equivalent of VariantsProvider.
+type TypedVariantsProvider[C any] interface {
+    VariantsProvided(req Request, cxt C) ([]Variant, Request, C, int, error)
+}
+
+// TypedWebSocketHandler is the typed equivalent of WebSocketHandler.
+type TypedWebSocketHandler[C any] interface {
+    HandleWebSocket(req Request, cxt C, conn *WebSocketConn)
+}
+
+// TypedWebSocketProtocolChooser is the typed equivalent of
+// WebSocketProtocolChooser.
+type TypedWebSocketProtocolChooser[C any] interface {
+    ChooseWebSocketProtocol(req Request, cxt C, offered []string) string
+}
+
+// DefaultTypedRequestHandler provides the same defaults as
+// DefaultRequestHandler for a TypedRequestHandler to embed.
+type DefaultTypedRequestHandler[C any] struct{}
+
+func (p *DefaultTypedRequestHandler[C]) StartRequest(req Request, cxt C) (Request, C) {
+    return req, cxt
+}
+
+func (p *DefaultTypedRequestHandler[C]) ServiceAvailable(req Request, cxt C) (bool, Request, C, int, error) {
+    return true, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) AllowedMethods(req Request, cxt C) ([]string, Request, C, int, error) {
+    return []string{GET, HEAD}, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) URITooLong(req Request, cxt C) (bool, Request, C, int, error) {
+    return false, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) MalformedRequest(req Request, cxt C) (bool, Request, C, int, error) {
+    return false, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) IsAuthorized(req Request, cxt C) (bool, string, Request, C, int, error) {
+    return true, "", req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) Forbidden(req Request, cxt C) (bool, Request, C, int, error) {
+    return false, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) ValidContentHeaders(req Request, cxt C) (bool, Request, C, int, error) {
+    return true, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) KnownContentType(req Request, cxt C) (bool, Request, C, int, error) {
+    return true, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) ValidEntityLength(req Request, cxt C) (bool, Request, C, int, error) {
+    return true, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) Options(req Request, cxt C) ([]string, Request, C, int, error) {
+    return []string{}, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) ContentTypesProvided(req Request, cxt C) ([]MediaTypeHandler, Request, C, int, error) {
+    return []MediaTypeHandler{}, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) ContentTypesAccepted(req Request, cxt C) ([]MediaTypeInputHandler, Request, C, int, error) {
+    return []MediaTypeInputHandler{}, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) IsLanguageAvailable(language []string, req Request, cxt C) (bool, Request, C, int, error) {
+    return true, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) CharsetsProvided(charsets []string, req Request, cxt C) ([]CharsetHandler, Request, C, int, error) {
+    return []CharsetHandler{NewStandardCharsetHandler("utf-8")}, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) EncodingsProvided(encodings []string, req Request, cxt C) ([]EncodingHandler, Request, C, int, error) {
+    return DefaultEncodingRegistry().Handlers(), req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) Variances(req Request, cxt C) ([]string, Request, C, int, error) {
+    return []string{}, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) ResourceExists(req Request, cxt C) (bool, Request, C, int, error) {
+    return true, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) LastModified(req Request, cxt C) (time.Time, Request, C, int, error) {
+    return time.Time{}, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) PreviouslyExisted(req Request, cxt C) (bool, Request, C, int, error) {
+    return false, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) GenerateETag(req Request, cxt C) (string, Request, C, int, error) {
+    return "", req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) MovedTemporarily(req Request, cxt C) (string, Request, C, int, error) {
+    return "", req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) MovedPermanently(req Request, cxt C) (string, Request, C, int, error) {
+    return "", req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) AllowMissingPost(req Request, cxt C) (bool, Request, C, int, error) {
+    return false, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) DeleteResource(req Request, cxt C) (bool, Request, C, int, error) {
+    return false, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) DeleteCompleted(req Request, cxt C) (bool, Request, C, int, error) {
+    return true, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) PostIsCreate(req Request, cxt C) (bool, Request, C, int, error) {
+    return false, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) CreatePath(req Request, cxt C) (string, Request, C, int, error) {
+    return "", req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) ProcessPost(req Request, cxt C) (Request, C, int, http.Header, io.WriterTo, error) {
+    return req, cxt, 0, nil, nil, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) IsConflict(req Request, cxt C) (bool, Request, C, int, error) {
+    return false, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) Expires(req Request, cxt C) (time.Time, Request, C, int, error) {
+    return time.Time{}, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) MultipleChoices(req Request, cxt C) (bool, http.Header, Request, C, int, error) {
+    return false, nil, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) FinishRequest(req Request, cxt C) (bool, Request, C, int, error) {
+    return true, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) ResponseIsRedirect(req Request, cxt C) (bool, Request, C, int, error) {
+    return false, req, cxt, 0, nil
+}
+
+func (p *DefaultTypedRequestHandler[C]) HasRespBody(req Request, cxt C) bool {
+    return false
+}
+
+// TypedResource adapts a TypedRequestHandler to a RequestHandler.  The
+// untyped Context handed in by the decision core is converted back to C,
+// falling back to the zero value of C rather than panicking if it holds
+// something else (e.g. nil before StartRequest has run).
+type TypedResource[C any] struct {
+    handler TypedRequestHandler[C]
+}
+
+func NewTypedResource[C any](handler TypedRequestHandler[C]) *TypedResource[C] {
+    return &TypedResource[C]{handler: handler}
+}
+
+// Handler returns the wrapped TypedRequestHandler.
+func (p *TypedResource[C]) Handler() TypedRequestHandler[C] {
+    return p.handler
+}
+
+func typedContext[C any](cxt Context) C {
+    c, _ := cxt.(C)
+    return c
+}
+
+func (p *TypedResource[C]) StartRequest(req Request, cxt Context) (Request, Context) {
+    req, c := p.handler.StartRequest(req, typedContext[C](cxt))
+    return req, c
+}
+
+func (p *TypedResource[C]) ResourceExists(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.ResourceExists(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) ServiceAvailable(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.ServiceAvailable(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) IsAuthorized(req Request, cxt Context) (bool, string, Request, Context, int, error) {
+    authorized, challenge, req, c, code, err := p.handler.IsAuthorized(req, typedContext[C](cxt))
+    return authorized, challenge, req, c, code, err
+}
+
+func (p *TypedResource[C]) Forbidden(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.Forbidden(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) AllowMissingPost(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.AllowMissingPost(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) MalformedRequest(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.MalformedRequest(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) URITooLong(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.URITooLong(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) KnownContentType(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.KnownContentType(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) ValidContentHeaders(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.ValidContentHeaders(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) ValidEntityLength(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.ValidEntityLength(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) Options(req Request, cxt Context) ([]string, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.Options(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) AllowedMethods(req Request, cxt Context) ([]string, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.AllowedMethods(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) DeleteResource(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.DeleteResource(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) DeleteCompleted(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.DeleteCompleted(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) PostIsCreate(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.PostIsCreate(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) CreatePath(req Request, cxt Context) (string, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.CreatePath(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) ProcessPost(req Request, cxt Context) (Request, Context, int, http.Header, io.WriterTo, error) {
+    req, c, code, headers, writerTo, err := p.handler.ProcessPost(req, typedContext[C](cxt))
+    return req, c, code, headers, writerTo, err
+}
+
+func (p *TypedResource[C]) ContentTypesProvided(req Request, cxt Context) ([]MediaTypeHandler, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.ContentTypesProvided(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) ContentTypesAccepted(req Request, cxt Context) ([]MediaTypeInputHandler, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.ContentTypesAccepted(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) IsLanguageAvailable(languages []string, req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.IsLanguageAvailable(languages, req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) CharsetsProvided(charsets []string, req Request, cxt Context) ([]CharsetHandler, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.CharsetsProvided(charsets, req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) EncodingsProvided(encodings []string, req Request, cxt Context) ([]EncodingHandler, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.EncodingsProvided(encodings, req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) Variances(req Request, cxt Context) ([]string, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.Variances(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) IsConflict(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.IsConflict(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) MultipleChoices(req Request, cxt Context) (bool, http.Header, Request, Context, int, error) {
+    v, headers, req, c, code, err := p.handler.MultipleChoices(req, typedContext[C](cxt))
+    return v, headers, req, c, code, err
+}
+
+func (p *TypedResource[C]) PreviouslyExisted(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.PreviouslyExisted(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) MovedPermanently(req Request, cxt Context) (string, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.MovedPermanently(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) MovedTemporarily(req Request, cxt Context) (string, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.MovedTemporarily(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) LastModified(req Request, cxt Context) (time.Time, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.LastModified(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) Expires(req Request, cxt Context) (time.Time, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.Expires(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) GenerateETag(req Request, cxt Context) (string, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.GenerateETag(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) FinishRequest(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.FinishRequest(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) ResponseIsRedirect(req Request, cxt Context) (bool, Request, Context, int, error) {
+    v, req, c, code, err := p.handler.ResponseIsRedirect(req, typedContext[C](cxt))
+    return v, req, c, code, err
+}
+
+func (p *TypedResource[C]) HasRespBody(req Request, cxt Context) bool {
+    return p.handler.HasRespBody(req, typedContext[C](cxt))
+}
+
+func (p *TypedResource[C]) FinishRequestWithResult(req Request, cxt Context, failed bool) (bool, Request, Context, int, error) {
+    if finisher, ok := p.handler.(TypedRequestFinisher[C]); ok {
+        v, req, c, code, err := finisher.FinishRequestWithResult(req, typedContext[C](cxt), failed)
+        return v, req, c, code, err
+    }
+    return p.FinishRequest(req, cxt)
+}
+
+func (p *TypedResource[C]) RequestTimeout(req Request, cxt Context) (time.Duration, int) {
+    if deadlineHandler, ok := p.handler.(TypedDeadlineHandler[C]); ok {
+        return deadlineHandler.RequestTimeout(req, typedContext[C](cxt))
+    }
+    return 0, 0
+}
+
+func (p *TypedResource[C]) LanguagesProvided(req Request, cxt Context) ([]string, Request, Context, int, error) {
+    if provider, ok := p.handler.(TypedLanguagesProvider[C]); ok {
+        v, req, c, code, err := provider.LanguagesProvided(req, typedContext[C](cxt))
+        return v, req, c, code, err
+    }
+    return nil, req, cxt, 0, nil
+}
+
+func (p *TypedResource[C]) VariantsProvided(req Request, cxt Context) ([]Variant, Request, Context, int, error) {
+    if provider, ok := p.handler.(TypedVariantsProvider[C]); ok {
+        v, req, c, code, err := provider.VariantsProvided(req, typedContext[C](cxt))
+        return v, req, c, code, err
+    }
+    return nil, req, cxt, 0, nil
+}
+
+// AllowFormatOverrides reports whether the wrapped handler is
+// FormatOverridable and allows them.
+func (p *TypedResource[C]) AllowFormatOverrides() bool {
+    overridable, ok := p.handler.(FormatOverridable)
+    return ok && overridable.AllowFormatOverrides()
+}
+
+// AcceptsWebSockets reports whether the wrapped handler is a
+// TypedWebSocketHandler, since TypedResource always has HandleWebSocket.
+func (p *TypedResource[C]) AcceptsWebSockets() bool {
+    _, ok := p.handler.(TypedWebSocketHandler[C])
+    return ok
+}
+
+func (p *TypedResource[C]) HandleWebSocket(req Request, cxt Context, conn *WebSocketConn) {
+    if handler, ok := p.handler.(TypedWebSocketHandler[C]); ok {
+        handler.HandleWebSocket(req, typedContext[C](cxt), conn)
+    }
+}
+
+func (p *TypedResource[C]) ChooseWebSocketProtocol(req Request, cxt Context, offered []string) string {
+    if chooser, ok := p.handler.(TypedWebSocketProtocolChooser[C]); ok {
+        return chooser.ChooseWebSocketProtocol(req, typedContext[C](cxt), offered)
+    }
+    return ""
+}
@@ -0,0 +1,129 @@
+package webmachine
+
+import (
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+type typedRouteHandler[C any] struct {
+    *TypedResource[C]
+}
+
+func (p *typedRouteHandler[C]) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    return p.TypedResource
+}
+
+type typedTestContext struct {
+    calls []string
+}
+
+// typedTestResource records each typed callback in its context and writes
+// them out as the body.
+type typedTestResource struct {
+    DefaultTypedRequestHandler[*typedTestContext]
+    failed *bool
+}
+
+func (p *typedTestResource) StartRequest(req Request, cxt *typedTestContext) (Request, *typedTestContext) {
+    return req, &typedTestContext{calls: []string{"StartRequest"}}
+}
+
+func (p *typedTestResource) ResourceExists(req Request, cxt *typedTestContext) (bool, Request, *typedTestContext, int, error) {
+    cxt.calls = append(cxt.calls, "ResourceExists")
+    return true, req, cxt, 0, nil
+}
+
+func (p *typedTestResource) GenerateETag(req Request, cxt *typedTestContext) (string, Request, *typedTestContext, int, error) {
+    cxt.calls = append(cxt.calls, "GenerateETag")
+    return "e", req, cxt, 0, nil
+}
+
+func (p *typedTestResource) ContentTypesProvided(req Request, cxt *typedTestContext) ([]MediaTypeHandler, Request, *typedTestContext, int, error) {
+    return []MediaTypeHandler{&typedTestMediaTypeHandler{MIME_TYPE_JSON}, &typedTestMediaTypeHandler{MIME_TYPE_CSV}}, req, cxt, 0, nil
+}
+
+func (p *typedTestResource) LanguagesProvided(req Request, cxt *typedTestContext) ([]string, Request, *typedTestContext, int, error) {
+    return []string{"en", "fr"}, req, cxt, 0, nil
+}
+
+func (p *typedTestResource) RequestTimeout(req Request, cxt *typedTestContext) (time.Duration, int) {
+    cxt.calls = append(cxt.calls, "RequestTimeout")
+    return time.Minute, 0
+}
+
+func (p *typedTestResource) FinishRequestWithResult(req Request, cxt *typedTestContext, failed bool) (bool, Request, *typedTestContext, int, error) {
+    *p.failed = failed
+    return true, req, cxt, 0, nil
+}
+
+func (p *typedTestResource) AllowFormatOverrides() bool {
+    return true
+}
+
+type typedTestMediaTypeHandler struct {
+    mediaType string
+}
+
+func (p *typedTestMediaTypeHandler) MediaTypeOutput() string {
+    return p.mediaType
+}
+
+func (p *typedTestMediaTypeHandler) MediaTypeHandleOutputTo(req Request, cxt Context, writer io.Writer, resp ResponseWriter) {
+    io.WriteString(writer, strings.Join(cxt.(*typedTestContext).calls, ","))
+}
+
+func TestTypedResource(t *testing.T) {
+    failed := true
+    wm := NewWebMachine()
+    wm.SetFormatOverrides(NewDefaultFormatOverrides())
+    wm.AddRouteHandler(&typedRouteHandler[*typedTestContext]{NewTypedResource[*typedTestContext](&typedTestResource{failed: &failed})})
+    tests := []struct {
+        url         string
+        contentType string
+    }{
+        {"/thing", MIME_TYPE_JSON},
+        // the typed handler opts in to format overrides through the adapter
+        {"/thing.csv", MIME_TYPE_CSV},
+    }
+    for _, tt := range tests {
+        req := httptest.NewRequest(GET, tt.url, nil)
+        req.Header.Set("Accept-Language", "fr")
+        rec := httptest.NewRecorder()
+        wm.ServeHTTP(rec, req)
+        if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), tt.contentType) || rec.Header().Get("Content-Language") != "fr" {
+            t.Errorf("%s: status %d, Content-Type %q, Content-Language %q", tt.url, rec.Code, rec.Header().Get("Content-Type"), rec.Header().Get("Content-Language"))
+        }
+        if body := rec.Body.String(); body != "StartRequest,RequestTimeout,ResourceExists,GenerateETag" {
+            t.Errorf("%s: callbacks %s", tt.url, body)
+        }
+        if failed {
+            t.Errorf("%s: FinishRequestWithResult was told the request failed", tt.url)
+        }
+        failed = true
+    }
+}
+
+func TestTypedContext(t *testing.T) {
+    if c := typedContext[*typedTestContext](nil); c != nil {
+        t.Errorf("typedContext(nil) = %v", c)
+    }
+    if c := typedContext[int]("not an int"); c != 0 {
+        t.Errorf("typedContext(string) = %v, want 0", c)
+    }
+    if c := typedContext[int](5); c != 5 {
+        t.Errorf("typedContext(5) = %v", c)
+    }
+    // callbacks reached before StartRequest get the zero value
+    resource := NewTypedResource[*typedTestContext](new(typedTestResource))
+    if _, _, cxt, _, _ := resource.ContentTypesProvided(nil, "wrong type"); cxt.(*typedTestContext) != nil {
+        t.Errorf("context %v, want the zero value", cxt)
+    }
+    plain := NewTypedResource[*typedTestContext](new(DefaultTypedRequestHandler[*typedTestContext]))
+    if plain.AllowFormatOverrides() {
+        t.Error("a handler that is not FormatOverridable allows overrides")
+    }
+}
@@ -1,6 +1,7 @@
 package webmachine
 
 import (
+    "context"
     "io"
     "mime/multipart"
     "net/http"
@@ -14,6 +15,10 @@ type Flusher interface {
 
 type Request interface {
     UnderlyingRequest() *http.Request
+    Context() context.Context // cancelled when the client goes away or a deadline passes
+    WithContext(ctx context.Context) Request
+    WithBody(body io.ReadCloser) Request // body replaces the request body, e.g. once decoded
+
     Method() string  // GET, POST, PUT, etc.
     RawURL() string  // The raw URL given in the request
     URL() *url.URL   // Parsed URL
@@ -40,7 +45,15 @@ type Request interface {
     ParseMultipartForm(maxMemory int64) error
     Trailer() http.Header
     HostParts() []string
+    HostBindings() map[string]string // values of the ":name" labels of the Dispatcher host pattern matched
+    HostTokens() []string            // the host labels matched by the "*" of the Dispatcher host pattern
     URLParts() []string
+    PathBindings() map[string]string // values of the ":name" segments of the Dispatcher pattern matched
+    PathInfo() string                // the path matched by the "*" of the Dispatcher pattern, still escaped
+    DispatchPath() string            // the Dispatcher pattern matched, or ""
+    // SetDispatchMatch records how a Dispatcher routed the request.
+    SetDispatchMatch(match *DispatchMatch)
+    Logger() Logger
 }
 
 type Context interface{}
@@ -49,6 +62,18 @@ type request struct {
     req       *http.Request
     hostParts []string
     urlParts  []string
+    dispatch  DispatchMatch
+    logger    Logger
+}
+
+// DispatchMatch is what a Dispatcher found when routing a request, as
+// returned by the Request methods of the same names.
+type DispatchMatch struct {
+    HostBindings map[string]string
+    HostTokens   []string
+    PathBindings map[string]string
+    PathInfo     string
+    DispatchPath string
 }
 
 type RouteHandler interface {
@@ -60,6 +85,16 @@ type MediaTypeHandler interface {
     MediaTypeHandleOutputTo(req Request, cxt Context, writer io.Writer, resp ResponseWriter)
 }
 
+// SeekableMediaTypeHandler may be implemented by a MediaTypeHandler whose
+// representation can be read from any offset.  The decision core then serves
+// it itself, handling Range, If-Range, Accept-Ranges and Content-Length.  If
+// content is nil MediaTypeHandleOutputTo is used instead.  content is closed
+// afterwards if it is an io.Closer.
+type SeekableMediaTypeHandler interface {
+    MediaTypeHandler
+    MediaTypeOutputContent(req Request, cxt Context) (content io.ReadSeeker, size int64, err error)
+}
+
 type MediaTypeInputHandler interface {
     MediaTypeInput() string
     MediaTypeHandleInputFrom(req Request, cxt Context) (int, http.Header, io.WriterTo)
@@ -67,13 +102,97 @@ type MediaTypeInputHandler interface {
 
 type CharsetHandler interface {
     Charset() string
-    CharsetConverter(req Request, cxt Context, reader io.Reader) io.Reader
+    CharsetConverter(req Request, cxt Context, reader io.Reader) io.Reader // request body in Charset() to UTF-8
+}
+
+// CharsetEncodingHandler may be implemented by a CharsetHandler to convert
+// response bodies, written in UTF-8, into its charset.
+type CharsetEncodingHandler interface {
+    CharsetEncoder(req Request, cxt Context, writer io.Writer) io.Writer
 }
 
 type EncodingHandler interface {
     Encoding() string
     Encoder(req Request, cxt Context, writer io.Writer) io.Writer
-    Decoder(req Request, cxt Context, reader io.Reader) io.Reader
+    Decoder(req Request, cxt Context, reader io.Reader) io.Reader // nil if reader is not validly encoded
+}
+
+// LeveledEncodingHandler may be implemented by an EncodingHandler whose
+// encoder takes the compression level from the CompressionPolicy.
+type LeveledEncodingHandler interface {
+    EncoderLevel(req Request, cxt Context, writer io.Writer, level int) io.Writer
+}
+
+// RequestFinisher may be implemented by a RequestHandler that needs to know
+// whether the request failed, i.e. panicked or ended with a 5xx status.  When
+// implemented it is called instead of FinishRequest.
+type RequestFinisher interface {
+    FinishRequestWithResult(req Request, cxt Context, failed bool) (bool, Request, Context, int, error)
+}
+
+// DeadlineHandler may be implemented by a RequestHandler to bound how long
+// the decision core works on a request.  Once the timeout passes the
+// request's Context is cancelled and, if nothing has been written yet, the
+// returned status (503 or 504, defaulting to 503) is sent.  The deadline is
+// only checked between decisions, so a callback or MediaTypeHandler that
+// overruns it still completes; long-running ones should watch req.Context().
+type DeadlineHandler interface {
+    RequestTimeout(req Request, cxt Context) (time.Duration, int)
+}
+
+// LanguagesProvider may be implemented by a RequestHandler to list the
+// language tags its representations are available in, most preferred first.
+// The tag best matching Accept-Language is sent as Content-Language.  If none
+// matches, the first tag is sent as a default, as RFC 7231 section 5.3.5
+// allows; the response is 406 only if the header gives that tag, or "*", a
+// q-value of 0.  An empty list leaves the decision to IsLanguageAvailable.
+type LanguagesProvider interface {
+    LanguagesProvided(req Request, cxt Context) ([]string, Request, Context, int, error)
+}
+
+// VariantsProvider may be implemented by a RequestHandler whose
+// representations are also available at URLs of their own.  Those variants
+// are listed in an Alternates header, the negotiated one is sent as
+// Content-Location and each dimension they differ in is added to Vary.
+type VariantsProvider interface {
+    VariantsProvided(req Request, cxt Context) ([]Variant, Request, Context, int, error)
+}
+
+// WebSocketHandler may be implemented by a RequestHandler to accept
+// WebSocket connections.  Once ServiceAvailable, IsAuthorized and Forbidden
+// have passed, a GET asking to upgrade to websocket gets the RFC 6455
+// handshake and HandleWebSocket is called with the connection, which is
+// closed when it returns.  Other requests go through the decisions as usual.
+type WebSocketHandler interface {
+    HandleWebSocket(req Request, cxt Context, conn *WebSocketConn)
+}
+
+// WebSocketProtocolChooser may be implemented by a WebSocketHandler to pick
+// one of the subprotocols offered in Sec-WebSocket-Protocol, or "" for none.
+// It is only called if the client offered any.
+type WebSocketProtocolChooser interface {
+    ChooseWebSocketProtocol(req Request, cxt Context, offered []string) string
+}
+
+// WebSocketAcceptor may be implemented by a WebSocketHandler that does not
+// always accept WebSocket connections, such as an adapter wrapping a handler
+// that may or may not handle them.  While AcceptsWebSockets returns false,
+// upgrade requests go through the decisions like any other.
+type WebSocketAcceptor interface {
+    AcceptsWebSockets() bool
+}
+
+// FormatOverridable may be implemented by a RequestHandler to let a URL
+// extension or query parameter in the WebMachine's FormatOverrides choose its
+// media type.  Other resources see the URL unchanged.
+type FormatOverridable interface {
+    AllowFormatOverrides() bool
+}
+
+// ErrorRenderer writes the status and body of a response for a halted or
+// failed request.
+type ErrorRenderer interface {
+    RenderError(req Request, resp ResponseWriter, statusCode int, err error)
 }
 
 type RequestHandler interface {
@@ -115,14 +234,40 @@ type RequestHandler interface {
     HasRespBody(req Request, cxt Context) bool
 }
 
+// DecisionTracer is notified of every request handled by a WebMachine and
+// returns the DecisionTrace that records it.
+type DecisionTracer interface {
+    StartTrace(req Request, resp ResponseWriter, handler RequestHandler) DecisionTrace
+}
+
+// DecisionTrace receives each decision visited, each RequestHandler
+// callback invoked along with its results, and the final status code.
+type DecisionTrace interface {
+    Decision(decisionId WMDecision)
+    Callback(name string, results ...interface{})
+    FinishTrace(statusCode int)
+}
+
 type WebMachine interface {
     ServeHTTP(http.ResponseWriter, *http.Request)
     AddRouteHandler(RouteHandler)
     RemoveRouteHandler(RouteHandler)
+    SetDecisionTracer(DecisionTracer)
+    SetLogger(Logger)
+    SetErrorRenderer(ErrorRenderer)
+    SetCompressionPolicy(*CompressionPolicy)
+    SetDecompressionLimits(*DecompressionLimits)
+    SetFormatOverrides(*FormatOverrides)
 }
 
 type webMachine struct {
-    routeHandlers []RouteHandler
+    routeHandlers       []RouteHandler
+    tracer              DecisionTracer
+    logger              Logger
+    errorRenderer       ErrorRenderer
+    compressionPolicy   *CompressionPolicy
+    decompressionLimits *DecompressionLimits
+    formatOverrides     *FormatOverrides
 }
 
 type WriteThrough struct {
@@ -0,0 +1,124 @@
+package webmachine
+
+import (
+    "mime"
+    "strconv"
+    "strings"
+)
+
+// Variant describes one representation a resource negotiates between.
+// Empty fields do not vary.
+type Variant struct {
+    // URL is where the variant can be fetched directly, relative to the
+    // resource, or "" if it has no URL of its own.
+    URL       string
+    MediaType string
+    Charset   string
+    Language  string
+    Encoding  string
+    // Quality is the source quality from 0 to 1, with 0 taken as 1.
+    Quality float64
+}
+
+// matches reports whether the variant is the representation negotiated, a
+// media type without parameters matching any parameters.
+func (p *Variant) matches(mediaType, charset, language, encoding string) bool {
+    if len(p.MediaType) > 0 {
+        want, wantParams, err := mime.ParseMediaType(p.MediaType)
+        got, gotParams, err2 := mime.ParseMediaType(mediaType)
+        if err != nil || err2 != nil || want != got {
+            return false
+        }
+        for k, v := range wantParams {
+            if !strings.EqualFold(gotParams[k], v) {
+                return false
+            }
+        }
+    }
+    if len(p.Charset) > 0 && canonicalCharset(p.Charset) != canonicalCharset(charset) {
+        return false
+    }
+    if len(p.Language) > 0 && !strings.EqualFold(p.Language, language) {
+        return false
+    }
+    if len(p.Encoding) > 0 && canonicalEncoding(p.Encoding) != canonicalEncoding(encoding) {
+        return false
+    }
+    return true
+}
+
+func (p *Variant) baseMediaType() string {
+    mediaType, _, _ := mime.ParseMediaType(p.MediaType)
+    return mediaType
+}
+
+// alternate formats the variant as an RFC 2295 variant description.
+func (p *Variant) alternate() string {
+    quality := p.Quality
+    if quality <= 0 || quality > 1 {
+        quality = 1
+    }
+    s := "{" + strconv.Quote(p.URL) + " " + strconv.FormatFloat(quality, 'f', -1, 64)
+    if len(p.MediaType) > 0 {
+        s += " {type " + p.MediaType + "}"
+    }
+    if len(p.Charset) > 0 {
+        s += " {charset " + p.Charset + "}"
+    }
+    if len(p.Language) > 0 {
+        s += " {language " + p.Language + "}"
+    }
+    if len(p.Encoding) > 0 {
+        s += " {encoding " + p.Encoding + "}"
+    }
+    return s + "}"
+}
+
+// alternatesHeader lists the variants that have a URL of their own, or
+// returns "" if none do.
+func alternatesHeader(variants []Variant) string {
+    var alternates []string
+    for i := range variants {
+        if len(variants[i].URL) > 0 {
+            alternates = append(alternates, variants[i].alternate())
+        }
+    }
+    return strings.Join(alternates, ", ")
+}
+
+// variantsDiffer reports whether the variants have more than one value for
+// the field returned by field.
+func variantsDiffer(variants []Variant, field func(*Variant) string) bool {
+    first := ""
+    for i := range variants {
+        value := strings.ToLower(field(&variants[i]))
+        if len(value) == 0 {
+            continue
+        }
+        if len(first) == 0 {
+            first = value
+        } else if value != first {
+            return true
+        }
+    }
+    return false
+}
+
+// appendVary adds the header names in add not already in vary, ignoring
+// case.
+func appendVary(vary []string, add ...string) []string {
+    for _, name := range add {
+        name = strings.TrimSpace(name)
+        found := len(name) == 0
+        for _, existing := range vary {
+            if strings.EqualFold(existing, name) {
+                found = true
+                break
+            }
+        }
+        if !found {
+            vary = append(vary, name)
+        }
+    }
+    return vary
+}
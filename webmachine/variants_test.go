@@ -0,0 +1,159 @@
+package webmachine
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+type variantTestResource struct {
+    DefaultRequestHandler
+    mediaTypes []MediaTypeHandler
+    charsets   []CharsetHandler
+    languages  []string
+    encodings  []EncodingHandler
+    variants   []Variant
+}
+
+func (p *variantTestResource) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    return p
+}
+
+func (p *variantTestResource) ContentTypesProvided(req Request, cxt Context) ([]MediaTypeHandler, Request, Context, int, error) {
+    return p.mediaTypes, req, cxt, 0, nil
+}
+
+func (p *variantTestResource) CharsetsProvided(charsets []string, req Request, cxt Context) ([]CharsetHandler, Request, Context, int, error) {
+    return p.charsets, req, cxt, 0, nil
+}
+
+func (p *variantTestResource) EncodingsProvided(encodings []string, req Request, cxt Context) ([]EncodingHandler, Request, Context, int, error) {
+    return p.encodings, req, cxt, 0, nil
+}
+
+func (p *variantTestResource) LanguagesProvided(req Request, cxt Context) ([]string, Request, Context, int, error) {
+    return p.languages, req, cxt, 0, nil
+}
+
+func (p *variantTestResource) VariantsProvided(req Request, cxt Context) ([]Variant, Request, Context, int, error) {
+    return p.variants, req, cxt, 0, nil
+}
+
+func (p *variantTestResource) GenerateETag(req Request, cxt Context) (string, Request, Context, int, error) {
+    return "v1", req, cxt, 0, nil
+}
+
+func newVariantTestResource() *variantTestResource {
+    return &variantTestResource{
+        mediaTypes: []MediaTypeHandler{&formatTestMediaTypeHandler{MIME_TYPE_TEXT_PLAIN, "plain"}},
+        charsets:   []CharsetHandler{NewStandardCharsetHandler("utf-8")},
+        languages:  []string{"en"},
+        encodings:  []EncodingHandler{NewIdentityEncoder()},
+    }
+}
+
+func TestVariantHeaders(t *testing.T) {
+    plainAndHTML := []MediaTypeHandler{&formatTestMediaTypeHandler{MIME_TYPE_TEXT_PLAIN, "plain"}, &formatTestMediaTypeHandler{MIME_TYPE_HTML, "html"}}
+    documents := []Variant{
+        {URL: "doc.en.txt", MediaType: MIME_TYPE_TEXT_PLAIN, Language: "en"},
+        {URL: "doc.fr.txt", MediaType: MIME_TYPE_TEXT_PLAIN, Language: "fr", Quality: 0.9},
+        {URL: "doc.en.html", MediaType: MIME_TYPE_HTML, Language: "en"},
+    }
+    const alternates = `{"doc.en.txt" 1 {type text/plain} {language en}}, {"doc.fr.txt" 0.9 {type text/plain} {language fr}}, {"doc.en.html" 1 {type text/html} {language en}}`
+    tests := []struct {
+        name            string
+        configure       func(*variantTestResource)
+        header          map[string]string
+        status          int
+        vary            string
+        alternates      string
+        contentLocation string
+    }{
+        {"one of each", func(r *variantTestResource) {}, nil, http.StatusOK, "", "", ""},
+        {"media types", func(r *variantTestResource) { r.mediaTypes = plainAndHTML }, nil, http.StatusOK, "Accept", "", ""},
+        {"charsets", func(r *variantTestResource) {
+            r.charsets = append(r.charsets, NewISO88591CharsetHandler())
+        }, nil, http.StatusOK, "Accept-Charset", "", ""},
+        {"languages", func(r *variantTestResource) { r.languages = []string{"en", "fr"} }, nil, http.StatusOK, "Accept-Language", "", ""},
+        {"encodings", func(r *variantTestResource) {
+            r.encodings = append(r.encodings, NewGZipEncoder())
+        }, nil, http.StatusOK, "Accept-Encoding", "", ""},
+        {"all", func(r *variantTestResource) {
+            r.mediaTypes = plainAndHTML
+            r.charsets = append(r.charsets, NewISO88591CharsetHandler())
+            r.languages = []string{"en", "fr"}
+            r.encodings = append(r.encodings, NewGZipEncoder())
+        }, nil, http.StatusOK, "Accept, Accept-Encoding, Accept-Charset, Accept-Language", "", ""},
+        // variants without URLs only add to Vary
+        {"variants without URLs", func(r *variantTestResource) {
+            r.variants = []Variant{{Charset: "utf-8"}, {Charset: "ISO-8859-1"}}
+        }, nil, http.StatusOK, "Accept-Charset", "", ""},
+        {"variants", func(r *variantTestResource) {
+            r.mediaTypes = plainAndHTML
+            r.languages = []string{"en", "fr"}
+            r.variants = documents
+        }, map[string]string{"Accept-Language": "fr"}, http.StatusOK, "negotiate, Accept, Accept-Language", alternates, "doc.fr.txt"},
+        {"variants html", func(r *variantTestResource) {
+            r.mediaTypes = plainAndHTML
+            r.languages = []string{"en", "fr"}
+            r.variants = documents
+        }, map[string]string{"Accept": "text/html"}, http.StatusOK, "negotiate, Accept, Accept-Language", alternates, "doc.en.html"},
+        // no variant matches the French HTML negotiated
+        {"no matching variant", func(r *variantTestResource) {
+            r.mediaTypes = plainAndHTML
+            r.languages = []string{"en", "fr"}
+            r.variants = documents
+        }, map[string]string{"Accept": "text/html", "Accept-Language": "fr"}, http.StatusOK, "negotiate, Accept, Accept-Language", alternates, ""},
+        {"not modified", func(r *variantTestResource) {
+            r.mediaTypes = plainAndHTML
+            r.variants = documents
+        }, map[string]string{"If-None-Match": `"v1"`}, http.StatusNotModified, "negotiate, Accept, Accept-Language", alternates, "doc.en.txt"},
+    }
+    for _, tt := range tests {
+        resource := newVariantTestResource()
+        tt.configure(resource)
+        wm := NewWebMachine()
+        wm.AddRouteHandler(resource)
+        req := httptest.NewRequest(GET, "/", nil)
+        for k, v := range tt.header {
+            req.Header.Set(k, v)
+        }
+        rec := httptest.NewRecorder()
+        wm.ServeHTTP(rec, req)
+        headers := rec.Header()
+        if rec.Code != tt.status || headers.Get("Vary") != tt.vary || headers.Get("Content-Location") != tt.contentLocation {
+            t.Errorf("%s: %d, Vary %q, Content-Location %q, want %d, %q, %q", tt.name, rec.Code, headers.Get("Vary"), headers.Get("Content-Location"), tt.status, tt.vary, tt.contentLocation)
+        }
+        if headers.Get("Alternates") != tt.alternates || (len(tt.alternates) > 0) != (headers.Get("TCN") == "choice") {
+            t.Errorf("%s: Alternates %q, TCN %q, want %q", tt.name, headers.Get("Alternates"), headers.Get("TCN"), tt.alternates)
+        }
+    }
+}
+
+func TestVariantMatches(t *testing.T) {
+    tests := []struct {
+        variant   Variant
+        mediaType string
+        charset   string
+        language  string
+        encoding  string
+        matches   bool
+    }{
+        {Variant{}, "text/plain", "utf-8", "en", "gzip", true},
+        {Variant{MediaType: "text/plain"}, "text/plain; format=flowed", "", "", "", true},
+        {Variant{MediaType: "text/plain; format=flowed"}, "text/plain", "", "", "", false},
+        {Variant{MediaType: "text/plain; format=Flowed"}, "text/plain; format=flowed", "", "", "", true},
+        {Variant{MediaType: "text/html"}, "text/plain", "", "", "", false},
+        {Variant{Charset: "latin1"}, "", "ISO-8859-1", "", "", true},
+        {Variant{Charset: "utf-8"}, "", "ISO-8859-1", "", "", false},
+        {Variant{Language: "EN"}, "", "", "en", "", true},
+        {Variant{Language: "en"}, "", "", "en-US", "", false},
+        {Variant{Encoding: "x-gzip"}, "", "", "", "gzip", true},
+        {Variant{Encoding: "gzip"}, "", "", "", "identity", false},
+    }
+    for _, tt := range tests {
+        if matches := tt.variant.matches(tt.mediaType, tt.charset, tt.language, tt.encoding); matches != tt.matches {
+            t.Errorf("%+v matches(%q, %q, %q, %q) = %v", tt.variant, tt.mediaType, tt.charset, tt.language, tt.encoding, matches)
+        }
+    }
+}
@@ -1,12 +1,11 @@
 package webmachine
 
 import (
-    "log"
     "net/http"
 )
 
 func NewWebMachine() WebMachine {
-    return new(webMachine)
+    return &webMachine{logger: NewNoopLogger(), errorRenderer: NewNegotiatingErrorRenderer(), compressionPolicy: NewDefaultCompressionPolicy(), decompressionLimits: NewDefaultDecompressionLimits()}
 }
 
 func (p *webMachine) AddRouteHandler(handler RouteHandler) {
@@ -25,19 +24,88 @@ func (p *webMachine) RemoveRouteHandler(handler RouteHandler) {
     }
 }
 
+func (p *webMachine) SetDecisionTracer(tracer DecisionTracer) {
+    p.tracer = tracer
+}
+
+func (p *webMachine) SetLogger(logger Logger) {
+    if logger == nil {
+        logger = NewNoopLogger()
+    }
+    p.logger = logger
+}
+
+func (p *webMachine) SetErrorRenderer(renderer ErrorRenderer) {
+    if renderer == nil {
+        renderer = NewNegotiatingErrorRenderer()
+    }
+    p.errorRenderer = renderer
+}
+
+func (p *webMachine) SetCompressionPolicy(policy *CompressionPolicy) {
+    if policy == nil {
+        policy = NewDefaultCompressionPolicy()
+    }
+    p.compressionPolicy = policy
+}
+
+func (p *webMachine) SetDecompressionLimits(limits *DecompressionLimits) {
+    if limits == nil {
+        limits = NewDefaultDecompressionLimits()
+    }
+    p.decompressionLimits = limits
+}
+
+// SetFormatOverrides lets URLs choose the media type of FormatOverridable
+// resources, see FormatOverrides.  nil, the default, turns them off.
+func (p *webMachine) SetFormatOverrides(overrides *FormatOverrides) {
+    p.formatOverrides = overrides
+}
+
 func (p *webMachine) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-    r := NewRequestFromHttpRequest(req)
     rs := NewResponseWriter(resp)
-    log.Print("running URL: ", r.URL().Path, "\n")
-    for _, h := range p.routeHandlers {
-        rh := h.(RouteHandler)
+    r, handler, override := p.route(req, rs)
+    logger := r.Logger()
+    logger.Log(LOG_LEVEL_DEBUG, "running URL", nil)
+    if handler != nil {
+        handleRequest(p, handler, r, rs, override)
+        return
+    }
+    logger.Log(LOG_LEVEL_INFO, "no route handlers matched", nil)
+    resp.WriteHeader(http.StatusBadRequest)
+}
+
+// route finds the handler for req.  If the URL asks for a format override,
+// the request is routed without its extension first and the override used
+// only if that finds a FormatOverridable resource allowing it.
+func (p *webMachine) route(req *http.Request, rs ResponseWriter) (Request, RequestHandler, *formatOverride) {
+    if p.formatOverrides != nil {
+        if stripped, override := p.formatOverrides.match(req); override != nil {
+            r := p.newRequest(stripped)
+            handler := p.handlerFor(r, rs)
+            if fo, ok := handler.(FormatOverridable); ok && fo.AllowFormatOverrides() {
+                return r, handler, override
+            }
+            if stripped == req {
+                return r, handler, nil
+            }
+        }
+    }
+    r := p.newRequest(req)
+    return r, p.handlerFor(r, rs), nil
+}
 
+func (p *webMachine) newRequest(req *http.Request) Request {
+    r := NewRequestFromHttpRequest(req)
+    r.(*request).logger = withLogFields(p.logger, LogFields{"method": req.Method, "path": req.URL.Path})
+    return r
+}
+
+func (p *webMachine) handlerFor(r Request, rs ResponseWriter) RequestHandler {
+    for _, rh := range p.routeHandlers {
         if handler := rh.HandlerFor(r, rs); handler != nil {
-            log.Print("found route handler for: ", r.URL().Path, " ", handler, "\n")
-            handleRequest(handler, r, rs)
-            return
+            return handler
         }
     }
-    log.Print("no route handlers matched: ", r.URL().Path, "\n")
-    resp.WriteHeader(http.StatusBadRequest)
+    return nil
 }
@@ -0,0 +1,369 @@
+package webmachine
+
+import (
+    "bufio"
+    "crypto/sha1"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "io"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "unicode/utf8"
+)
+
+const (
+    WEBSOCKET_CONTINUATION_FRAME = 0
+    WEBSOCKET_TEXT_MESSAGE       = 1
+    WEBSOCKET_BINARY_MESSAGE     = 2
+    WEBSOCKET_CLOSE_MESSAGE      = 8
+    WEBSOCKET_PING_MESSAGE       = 9
+    WEBSOCKET_PONG_MESSAGE       = 10
+)
+
+const (
+    WEBSOCKET_CLOSE_NORMAL           = 1000
+    WEBSOCKET_CLOSE_GOING_AWAY       = 1001
+    WEBSOCKET_CLOSE_PROTOCOL_ERROR   = 1002
+    WEBSOCKET_CLOSE_UNSUPPORTED_DATA = 1003
+    WEBSOCKET_CLOSE_NO_STATUS        = 1005
+    WEBSOCKET_CLOSE_INVALID_PAYLOAD  = 1007
+    WEBSOCKET_CLOSE_MESSAGE_TOO_BIG  = 1009
+    WEBSOCKET_CLOSE_INTERNAL_ERROR   = 1011
+)
+
+const (
+    DEFAULT_WEBSOCKET_READ_LIMIT = 16 << 20
+    WEBSOCKET_VERSION            = "13"
+    websocketAcceptGUID          = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// WebSocketCloseError is returned by ReadMessage once the connection has
+// been closed, by either side, with the close code and reason.
+type WebSocketCloseError struct {
+    Code   int
+    Reason string
+}
+
+func (p *WebSocketCloseError) Error() string {
+    s := "websocket: closed with code " + strconv.Itoa(p.Code)
+    if len(p.Reason) > 0 {
+        s += ": " + p.Reason
+    }
+    return s
+}
+
+// WebSocketConn is a message-oriented WebSocket connection as handed to
+// WebSocketHandler.HandleWebSocket.  ReadMessage answers pings and close
+// frames itself.  One goroutine may read while others write.
+type WebSocketConn struct {
+    conn        net.Conn
+    reader      *bufio.Reader
+    writeMutex  sync.Mutex
+    closeSent   bool
+    readLimit   int64
+    subprotocol string
+    pongHandler func(data []byte)
+}
+
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader, subprotocol string) *WebSocketConn {
+    return &WebSocketConn{conn: conn, reader: reader, readLimit: DEFAULT_WEBSOCKET_READ_LIMIT, subprotocol: subprotocol}
+}
+
+// Subprotocol returns the Sec-WebSocket-Protocol agreed in the handshake.
+func (p *WebSocketConn) Subprotocol() string {
+    return p.subprotocol
+}
+
+func (p *WebSocketConn) RemoteAddr() net.Addr {
+    return p.conn.RemoteAddr()
+}
+
+// SetReadLimit sets the largest message ReadMessage accepts; larger ones
+// close the connection with WEBSOCKET_CLOSE_MESSAGE_TOO_BIG.
+func (p *WebSocketConn) SetReadLimit(limit int64) {
+    p.readLimit = limit
+}
+
+// SetPongHandler sets a function called with the payload of each pong.
+func (p *WebSocketConn) SetPongHandler(fn func(data []byte)) {
+    p.pongHandler = fn
+}
+
+func (p *WebSocketConn) SetReadDeadline(t time.Time) error {
+    return p.conn.SetReadDeadline(t)
+}
+
+func (p *WebSocketConn) SetWriteDeadline(t time.Time) error {
+    return p.conn.SetWriteDeadline(t)
+}
+
+// ReadMessage returns the next text or binary message, reassembling
+// fragmented messages.  After a close frame it returns a
+// *WebSocketCloseError.
+func (p *WebSocketConn) ReadMessage() (messageType int, data []byte, err error) {
+    for {
+        fin, opcode, payload, err := p.readFrame()
+        if err != nil {
+            return 0, nil, err
+        }
+        switch opcode {
+        case WEBSOCKET_PING_MESSAGE:
+            if err = p.writeFrame(WEBSOCKET_PONG_MESSAGE, payload); err != nil {
+                return 0, nil, err
+            }
+            continue
+        case WEBSOCKET_PONG_MESSAGE:
+            if p.pongHandler != nil {
+                p.pongHandler(payload)
+            }
+            continue
+        case WEBSOCKET_CLOSE_MESSAGE:
+            code, reason := WEBSOCKET_CLOSE_NO_STATUS, ""
+            if len(payload) == 1 {
+                return 0, nil, p.fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "invalid close frame")
+            } else if len(payload) >= 2 {
+                code = int(binary.BigEndian.Uint16(payload))
+                reason = string(payload[2:])
+                if !validCloseCode(code) {
+                    return 0, nil, p.fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "invalid close code")
+                }
+                if !utf8.ValidString(reason) {
+                    return 0, nil, p.fail(WEBSOCKET_CLOSE_INVALID_PAYLOAD, "invalid close reason")
+                }
+            }
+            replyCode := code
+            if replyCode == WEBSOCKET_CLOSE_NO_STATUS {
+                replyCode = WEBSOCKET_CLOSE_NORMAL
+            }
+            p.Close(replyCode, "")
+            return 0, nil, &WebSocketCloseError{Code: code, Reason: reason}
+        case WEBSOCKET_TEXT_MESSAGE, WEBSOCKET_BINARY_MESSAGE:
+            if messageType != 0 {
+                return 0, nil, p.fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "expected continuation frame")
+            }
+            messageType = opcode
+            data = payload
+        case WEBSOCKET_CONTINUATION_FRAME:
+            if messageType == 0 {
+                return 0, nil, p.fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "unexpected continuation frame")
+            }
+            data = append(data, payload...)
+        default:
+            return 0, nil, p.fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "unknown opcode")
+        }
+        if int64(len(data)) > p.readLimit {
+            return 0, nil, p.fail(WEBSOCKET_CLOSE_MESSAGE_TOO_BIG, "message too big")
+        }
+        if fin {
+            if messageType == WEBSOCKET_TEXT_MESSAGE && !utf8.Valid(data) {
+                return 0, nil, p.fail(WEBSOCKET_CLOSE_INVALID_PAYLOAD, "invalid UTF-8 in text message")
+            }
+            return messageType, data, nil
+        }
+    }
+}
+
+// WriteMessage sends data as a single text or binary frame.
+func (p *WebSocketConn) WriteMessage(messageType int, data []byte) error {
+    if messageType != WEBSOCKET_TEXT_MESSAGE && messageType != WEBSOCKET_BINARY_MESSAGE {
+        return errors.New("websocket: invalid message type " + strconv.Itoa(messageType))
+    }
+    return p.writeFrame(messageType, data)
+}
+
+func (p *WebSocketConn) Ping(data []byte) error {
+    if len(data) > 125 {
+        return errors.New("websocket: ping payload too long")
+    }
+    return p.writeFrame(WEBSOCKET_PING_MESSAGE, data)
+}
+
+// Close sends a close frame with code and reason, unless one has been sent
+// already, and closes the connection.  A reason too long for a control frame
+// is cut short at a character boundary.
+func (p *WebSocketConn) Close(code int, reason string) error {
+    p.writeMutex.Lock()
+    alreadySent := p.closeSent
+    p.closeSent = true
+    p.writeMutex.Unlock()
+    if !alreadySent {
+        if n := 125 - 2; len(reason) > n {
+            for n > 0 && !utf8.RuneStart(reason[n]) {
+                n--
+            }
+            reason = reason[:n]
+        }
+        payload := make([]byte, 2, 2+len(reason))
+        binary.BigEndian.PutUint16(payload, uint16(code))
+        payload = append(payload, reason...)
+        p.writeRawFrame(WEBSOCKET_CLOSE_MESSAGE, payload)
+    }
+    return p.conn.Close()
+}
+
+// validCloseCode reports whether code may be received in a close frame: the
+// codes defined by RFC 6455 section 7.4.1 and registered since, apart from
+// those that must not be sent, or an application code from 3000 to 4999.
+func validCloseCode(code int) bool {
+    if code >= 3000 && code <= 4999 {
+        return true
+    }
+    if code < WEBSOCKET_CLOSE_NORMAL || code > 1014 {
+        return false
+    }
+    return code != 1004 && code != WEBSOCKET_CLOSE_NO_STATUS && code != 1006
+}
+
+// fail closes the connection after a protocol violation by the client.
+func (p *WebSocketConn) fail(code int, reason string) error {
+    p.Close(code, reason)
+    return &WebSocketCloseError{Code: code, Reason: reason}
+}
+
+func (p *WebSocketConn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+    var header [2]byte
+    if _, err = io.ReadFull(p.reader, header[:]); err != nil {
+        return
+    }
+    fin = header[0]&0x80 != 0
+    opcode = int(header[0] & 0x0f)
+    if header[0]&0x70 != 0 {
+        err = p.fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "reserved bits set")
+        return
+    }
+    if header[1]&0x80 == 0 {
+        err = p.fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "client frames must be masked")
+        return
+    }
+    length := uint64(header[1] & 0x7f)
+    switch length {
+    case 126:
+        var ext [2]byte
+        if _, err = io.ReadFull(p.reader, ext[:]); err != nil {
+            return
+        }
+        length = uint64(binary.BigEndian.Uint16(ext[:]))
+    case 127:
+        var ext [8]byte
+        if _, err = io.ReadFull(p.reader, ext[:]); err != nil {
+            return
+        }
+        length = binary.BigEndian.Uint64(ext[:])
+    }
+    if opcode >= WEBSOCKET_CLOSE_MESSAGE && (!fin || length > 125) {
+        err = p.fail(WEBSOCKET_CLOSE_PROTOCOL_ERROR, "invalid control frame")
+        return
+    }
+    if length > uint64(p.readLimit) {
+        err = p.fail(WEBSOCKET_CLOSE_MESSAGE_TOO_BIG, "message too big")
+        return
+    }
+    var mask [4]byte
+    if _, err = io.ReadFull(p.reader, mask[:]); err != nil {
+        return
+    }
+    payload = make([]byte, length)
+    if _, err = io.ReadFull(p.reader, payload); err != nil {
+        return
+    }
+    for i := range payload {
+        payload[i] ^= mask[i%4]
+    }
+    return
+}
+
+func (p *WebSocketConn) writeFrame(opcode int, payload []byte) error {
+    p.writeMutex.Lock()
+    closed := p.closeSent
+    p.writeMutex.Unlock()
+    if closed {
+        return &WebSocketCloseError{Code: WEBSOCKET_CLOSE_NORMAL, Reason: "close already sent"}
+    }
+    return p.writeRawFrame(opcode, payload)
+}
+
+// writeRawFrame writes one unmasked, final frame, even after a close frame.
+func (p *WebSocketConn) writeRawFrame(opcode int, payload []byte) error {
+    p.writeMutex.Lock()
+    defer p.writeMutex.Unlock()
+    frame := make([]byte, 0, 10+len(payload))
+    frame = append(frame, 0x80|byte(opcode))
+    switch length := len(payload); {
+    case length <= 125:
+        frame = append(frame, byte(length))
+    case length <= 0xffff:
+        frame = append(frame, 126, byte(length>>8), byte(length))
+    default:
+        frame = append(frame, 127)
+        frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+    }
+    frame = append(frame, payload...)
+    _, err := p.conn.Write(frame)
+    return err
+}
+
+// isWebSocketUpgrade reports whether req asks to switch to WebSocket.
+func isWebSocketUpgrade(req Request) bool {
+    return req.Method() == GET && headerHasToken(req.Header(), "Connection", "upgrade") && headerHasToken(req.Header(), "Upgrade", "websocket")
+}
+
+// headerTokens returns the comma separated tokens of every value of the
+// named header.
+func headerTokens(header http.Header, name string) []string {
+    var tokens []string
+    for _, value := range header[http.CanonicalHeaderKey(name)] {
+        for _, token := range strings.Split(value, ",") {
+            if token = strings.TrimSpace(token); len(token) > 0 {
+                tokens = append(tokens, token)
+            }
+        }
+    }
+    return tokens
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+    for _, t := range headerTokens(header, name) {
+        if strings.EqualFold(t, token) {
+            return true
+        }
+    }
+    return false
+}
+
+// acceptWebSocket checks the client's half of the RFC 6455 opening
+// handshake, hijacks the connection and sends the server's half.  If it
+// fails before hijacking, the status and error to send are returned.
+func acceptWebSocket(req Request, resp ResponseWriter, subprotocol string) (*WebSocketConn, int, error) {
+    if req.Header().Get("Sec-WebSocket-Version") != WEBSOCKET_VERSION {
+        return nil, http.StatusUpgradeRequired, NewHalt(http.StatusUpgradeRequired, errors.New("unsupported WebSocket version")).WithHeader("Sec-WebSocket-Version", WEBSOCKET_VERSION)
+    }
+    key := strings.TrimSpace(req.Header().Get("Sec-WebSocket-Key"))
+    if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+        return nil, http.StatusBadRequest, errors.New("invalid Sec-WebSocket-Key")
+    }
+    hijacker, ok := resp.(http.Hijacker)
+    if !ok {
+        return nil, http.StatusInternalServerError, errors.New("connection cannot be upgraded")
+    }
+    conn, brw, err := hijacker.Hijack()
+    if err != nil {
+        return nil, http.StatusInternalServerError, err
+    }
+    hash := sha1.Sum([]byte(key + websocketAcceptGUID))
+    handshake := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n"
+    if len(subprotocol) > 0 {
+        handshake += "Sec-WebSocket-Protocol: " + subprotocol + "\r\n"
+    }
+    handshake += "\r\n"
+    conn.SetDeadline(time.Time{})
+    if _, err = conn.Write([]byte(handshake)); err != nil {
+        conn.Close()
+        return nil, 0, err
+    }
+    return newWebSocketConn(conn, brw.Reader, subprotocol), http.StatusSwitchingProtocols, nil
+}
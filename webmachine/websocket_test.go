@@ -0,0 +1,303 @@
+package webmachine
+
+import (
+    "bufio"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "unicode/utf8"
+)
+
+// pipeHijacker is a ResponseWriter whose connection is one end of a
+// net.Pipe.
+type pipeHijacker struct {
+    *httptest.ResponseRecorder
+    conn net.Conn
+}
+
+func (p *pipeHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    return p.conn, bufio.NewReadWriter(bufio.NewReader(p.conn), bufio.NewWriter(p.conn)), nil
+}
+
+// dialWebSocket serves a WebSocket upgrade request for handler over a pipe
+// and returns the client's end, with the handshake response read, and the
+// recorder for anything written before hijacking.
+func dialWebSocket(t *testing.T, handler RouteHandler, header map[string]string) (net.Conn, *bufio.Reader, *http.Response, *httptest.ResponseRecorder) {
+    server, client := net.Pipe()
+    client.SetDeadline(time.Now().Add(5 * time.Second))
+    wm := NewWebMachine()
+    wm.AddRouteHandler(handler)
+    req := httptest.NewRequest(GET, "/", nil)
+    req.Header.Set("Connection", "Upgrade")
+    req.Header.Set("Upgrade", "websocket")
+    req.Header.Set("Sec-WebSocket-Version", WEBSOCKET_VERSION)
+    req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+    for k, v := range header {
+        req.Header.Set(k, v)
+    }
+    rec := httptest.NewRecorder()
+    done := make(chan bool)
+    go func() {
+        wm.ServeHTTP(&pipeHijacker{ResponseRecorder: rec, conn: server}, req)
+        server.Close()
+        close(done)
+    }()
+    reader := bufio.NewReader(client)
+    resp, err := http.ReadResponse(reader, req)
+    if err != nil {
+        // nothing was hijacked, so the response went to the recorder
+        <-done
+        client.Close()
+        return nil, nil, nil, rec
+    }
+    return client, reader, resp, rec
+}
+
+type typedWebSocketContext struct {
+    greeting string
+}
+
+type typedWebSocketResource struct {
+    DefaultTypedRequestHandler[*typedWebSocketContext]
+}
+
+func (p *typedWebSocketResource) StartRequest(req Request, cxt *typedWebSocketContext) (Request, *typedWebSocketContext) {
+    return req, &typedWebSocketContext{greeting: "hello"}
+}
+
+func (p *typedWebSocketResource) ContentTypesProvided(req Request, cxt *typedWebSocketContext) ([]MediaTypeHandler, Request, *typedWebSocketContext, int, error) {
+    return []MediaTypeHandler{&formatTestMediaTypeHandler{MIME_TYPE_TEXT_PLAIN, "plain"}}, req, cxt, 0, nil
+}
+
+type typedWebSocketHandler struct {
+    typedWebSocketResource
+}
+
+func (p *typedWebSocketHandler) HandleWebSocket(req Request, cxt *typedWebSocketContext, conn *WebSocketConn) {
+    conn.WriteMessage(WEBSOCKET_TEXT_MESSAGE, []byte(cxt.greeting+" "+conn.Subprotocol()))
+}
+
+func (p *typedWebSocketHandler) ChooseWebSocketProtocol(req Request, cxt *typedWebSocketContext, offered []string) string {
+    return offered[len(offered)-1]
+}
+
+func TestTypedWebSocketHandler(t *testing.T) {
+    resource := &typedRouteHandler[*typedWebSocketContext]{NewTypedResource[*typedWebSocketContext](new(typedWebSocketHandler))}
+    client, reader, resp, _ := dialWebSocket(t, resource, map[string]string{"Sec-WebSocket-Protocol": "chat, superchat"})
+    if resp == nil {
+        t.Fatal("typed WebSocket handler did not upgrade")
+    }
+    defer client.Close()
+    if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Protocol") != "superchat" {
+        t.Fatalf("handshake: %d %v", resp.StatusCode, resp.Header)
+    }
+    fin, opcode, payload := readTestFrame(t, reader)
+    if !fin || opcode != WEBSOCKET_TEXT_MESSAGE || string(payload) != "hello superchat" {
+        t.Errorf("got frame %v %d %q", fin, opcode, payload)
+    }
+
+    plain := &typedRouteHandler[*typedWebSocketContext]{NewTypedResource[*typedWebSocketContext](new(typedWebSocketResource))}
+    client, _, resp, rec := dialWebSocket(t, plain, nil)
+    if resp != nil {
+        client.Close()
+        t.Fatal("typed resource without a WebSocket handler upgraded")
+    }
+    if rec.Code != http.StatusOK || rec.Body.String() != "plain" {
+        t.Errorf("got %d %q, want the plain representation", rec.Code, rec.Body.String())
+    }
+}
+
+// readTestFrame reads one unmasked frame as sent by the server.
+func readTestFrame(t *testing.T, reader *bufio.Reader) (fin bool, opcode int, payload []byte) {
+    header := make([]byte, 2)
+    if _, err := io.ReadFull(reader, header); err != nil {
+        t.Fatal(err)
+    }
+    fin = header[0]&0x80 != 0
+    opcode = int(header[0] & 0x0f)
+    length := int(header[1] & 0x7f)
+    if header[1]&0x80 != 0 || length > 125 {
+        t.Fatalf("unexpected frame header %x", header)
+    }
+    payload = make([]byte, length)
+    if _, err := io.ReadFull(reader, payload); err != nil {
+        t.Fatal(err)
+    }
+    return
+}
+
+type echoWebSocketResource struct {
+    DefaultRequestHandler
+}
+
+func (p *echoWebSocketResource) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    return p
+}
+
+func (p *echoWebSocketResource) HandleWebSocket(req Request, cxt Context, conn *WebSocketConn) {
+    for {
+        messageType, data, err := conn.ReadMessage()
+        if err != nil {
+            return
+        }
+        conn.WriteMessage(messageType, data)
+    }
+}
+
+// writeTestFrame writes one frame as a client would, masked unless
+// unmasked is set.
+func writeTestFrame(t *testing.T, conn net.Conn, fin bool, opcode int, payload []byte, unmasked bool) {
+    frame := []byte{byte(opcode), byte(len(payload))}
+    if fin {
+        frame[0] |= 0x80
+    }
+    mask := []byte{0x12, 0x34, 0x56, 0x78}
+    if unmasked {
+        frame = append(frame, payload...)
+    } else {
+        frame[1] |= 0x80
+        frame = append(frame, mask...)
+        for i, b := range payload {
+            frame = append(frame, b^mask[i%4])
+        }
+    }
+    if _, err := conn.Write(frame); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func closePayload(code int, reason string) []byte {
+    return append([]byte{byte(code >> 8), byte(code)}, reason...)
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+    client, _, resp, _ := dialWebSocket(t, new(echoWebSocketResource), nil)
+    if resp == nil {
+        t.Fatal("no upgrade")
+    }
+    defer client.Close()
+    // the example key and accept value from RFC 6455 section 1.3
+    if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+        t.Errorf("handshake: %d %v", resp.StatusCode, resp.Header)
+    }
+
+    _, _, resp, rec := dialWebSocket(t, new(echoWebSocketResource), map[string]string{"Sec-WebSocket-Version": "8"})
+    if resp != nil || rec.Code != http.StatusUpgradeRequired || rec.Header().Get("Sec-WebSocket-Version") != WEBSOCKET_VERSION {
+        t.Errorf("old version: %d %v", rec.Code, rec.Header())
+    }
+    _, _, resp, rec = dialWebSocket(t, new(echoWebSocketResource), map[string]string{"Sec-WebSocket-Key": "short"})
+    if resp != nil || rec.Code != http.StatusBadRequest {
+        t.Errorf("invalid key: %d", rec.Code)
+    }
+}
+
+func TestWebSocketFraming(t *testing.T) {
+    client, reader, resp, _ := dialWebSocket(t, new(echoWebSocketResource), nil)
+    if resp == nil {
+        t.Fatal("no upgrade")
+    }
+    defer client.Close()
+
+    writeTestFrame(t, client, true, WEBSOCKET_TEXT_MESSAGE, []byte("hello"), false)
+    if fin, opcode, payload := readTestFrame(t, reader); !fin || opcode != WEBSOCKET_TEXT_MESSAGE || string(payload) != "hello" {
+        t.Errorf("echo: %v %d %q", fin, opcode, payload)
+    }
+
+    // a ping between fragments is answered before the message completes
+    writeTestFrame(t, client, false, WEBSOCKET_BINARY_MESSAGE, []byte("ab"), false)
+    writeTestFrame(t, client, true, WEBSOCKET_PING_MESSAGE, []byte("p"), false)
+    if _, opcode, payload := readTestFrame(t, reader); opcode != WEBSOCKET_PONG_MESSAGE || string(payload) != "p" {
+        t.Errorf("pong: %d %q", opcode, payload)
+    }
+    writeTestFrame(t, client, true, WEBSOCKET_CONTINUATION_FRAME, []byte("cd"), false)
+    if _, opcode, payload := readTestFrame(t, reader); opcode != WEBSOCKET_BINARY_MESSAGE || string(payload) != "abcd" {
+        t.Errorf("fragmented: %d %q", opcode, payload)
+    }
+
+    writeTestFrame(t, client, true, WEBSOCKET_CLOSE_MESSAGE, closePayload(WEBSOCKET_CLOSE_GOING_AWAY, "bye"), false)
+    if _, opcode, payload := readTestFrame(t, reader); opcode != WEBSOCKET_CLOSE_MESSAGE || string(payload) != string(closePayload(WEBSOCKET_CLOSE_GOING_AWAY, "")) {
+        t.Errorf("close: %d %v", opcode, payload)
+    }
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+    tests := []struct {
+        name     string
+        opcode   int
+        payload  []byte
+        unmasked bool
+        code     int
+    }{
+        {"empty close", WEBSOCKET_CLOSE_MESSAGE, nil, false, WEBSOCKET_CLOSE_NORMAL},
+        {"application close code", WEBSOCKET_CLOSE_MESSAGE, closePayload(3000, ""), false, 3000},
+        {"close code below 1000", WEBSOCKET_CLOSE_MESSAGE, closePayload(999, ""), false, WEBSOCKET_CLOSE_PROTOCOL_ERROR},
+        {"close code 1005", WEBSOCKET_CLOSE_MESSAGE, closePayload(WEBSOCKET_CLOSE_NO_STATUS, ""), false, WEBSOCKET_CLOSE_PROTOCOL_ERROR},
+        {"close code 1006", WEBSOCKET_CLOSE_MESSAGE, closePayload(1006, ""), false, WEBSOCKET_CLOSE_PROTOCOL_ERROR},
+        {"close code 1015", WEBSOCKET_CLOSE_MESSAGE, closePayload(1015, ""), false, WEBSOCKET_CLOSE_PROTOCOL_ERROR},
+        {"close code 5000", WEBSOCKET_CLOSE_MESSAGE, closePayload(5000, ""), false, WEBSOCKET_CLOSE_PROTOCOL_ERROR},
+        {"one byte close", WEBSOCKET_CLOSE_MESSAGE, []byte{3}, false, WEBSOCKET_CLOSE_PROTOCOL_ERROR},
+        {"invalid close reason", WEBSOCKET_CLOSE_MESSAGE, closePayload(WEBSOCKET_CLOSE_NORMAL, "\xff"), false, WEBSOCKET_CLOSE_INVALID_PAYLOAD},
+        {"unmasked frame", WEBSOCKET_TEXT_MESSAGE, []byte("hi"), true, WEBSOCKET_CLOSE_PROTOCOL_ERROR},
+        {"invalid UTF-8", WEBSOCKET_TEXT_MESSAGE, []byte("\xc3"), false, WEBSOCKET_CLOSE_INVALID_PAYLOAD},
+        {"continuation first", WEBSOCKET_CONTINUATION_FRAME, []byte("hi"), false, WEBSOCKET_CLOSE_PROTOCOL_ERROR},
+        {"unknown opcode", 3, nil, false, WEBSOCKET_CLOSE_PROTOCOL_ERROR},
+    }
+    for _, tt := range tests {
+        client, reader, resp, _ := dialWebSocket(t, new(echoWebSocketResource), nil)
+        if resp == nil {
+            t.Fatal("no upgrade")
+        }
+        writeTestFrame(t, client, true, tt.opcode, tt.payload, tt.unmasked)
+        _, opcode, payload := readTestFrame(t, reader)
+        if opcode != WEBSOCKET_CLOSE_MESSAGE || len(payload) < 2 || int(payload[0])<<8|int(payload[1]) != tt.code {
+            t.Errorf("%s: got frame %d %v, want close %d", tt.name, opcode, payload, tt.code)
+        }
+        client.Close()
+    }
+}
+
+func TestWebSocketCloseReasonTruncation(t *testing.T) {
+    server, client := net.Pipe()
+    defer client.Close()
+    client.SetDeadline(time.Now().Add(5 * time.Second))
+    conn := newWebSocketConn(server, bufio.NewReader(server), "")
+    go conn.Close(WEBSOCKET_CLOSE_GOING_AWAY, strings.Repeat("é", 100))
+    _, opcode, payload := readTestFrame(t, bufio.NewReader(client))
+    if opcode != WEBSOCKET_CLOSE_MESSAGE || len(payload) > 125 || !utf8.Valid(payload[2:]) {
+        t.Errorf("close frame %d of %d bytes, valid UTF-8 %v", opcode, len(payload), utf8.Valid(payload[2:]))
+    }
+    if len(payload) != 2+122 {
+        t.Errorf("reason of %d bytes, want 122", len(payload)-2)
+    }
+}
+
+type refusingWebSocketResource struct {
+    echoWebSocketResource
+}
+
+func (p *refusingWebSocketResource) HandlerFor(req Request, writer ResponseWriter) RequestHandler {
+    return p
+}
+
+func (p *refusingWebSocketResource) ContentTypesProvided(req Request, cxt Context) ([]MediaTypeHandler, Request, Context, int, error) {
+    return []MediaTypeHandler{&formatTestMediaTypeHandler{MIME_TYPE_TEXT_PLAIN, "plain"}}, req, cxt, 0, nil
+}
+
+func (p *refusingWebSocketResource) AcceptsWebSockets() bool {
+    return false
+}
+
+func TestWebSocketAcceptor(t *testing.T) {
+    client, _, resp, rec := dialWebSocket(t, new(refusingWebSocketResource), nil)
+    if resp != nil {
+        client.Close()
+        t.Fatal("a WebSocketAcceptor refusing upgrades upgraded")
+    }
+    if rec.Code != http.StatusOK || rec.Body.String() != "plain" {
+        t.Errorf("got %d %q, want the plain representation", rec.Code, rec.Body.String())
+    }
+}